@@ -0,0 +1,381 @@
+/*
+Package admin provides a REST API to administrate embiam.
+
+The handler manages entities, entity tokens, roles and default roles.
+Mount it with a prefix, e.g.
+
+	http.Handle("/api/embiam/admin/", http.StripPrefix("/api/embiam/admin", admin.NewHandler(nil)))
+
+Endpoints (relative to the prefix)
+
+	GET    /entity          list of all entities (PublicEntity)
+	POST   /entity          create entity {"nick":"optional","roles":["optional"]}, returns password and secret
+	GET    /entity/{nick}   read entity
+	PUT    /entity/{nick}   update entity (active and roles)
+	DELETE /entity/{nick}   delete entity
+	PUT    /entity/{nick}/password
+	                        set password {"password":"..."}, it must comply with the password policy
+	GET    /entityToken     list of all unused entity tokens
+	POST   /entityToken     create entity token
+	GET    /role            read roles
+	PUT    /role            save roles
+	GET    /defaultRole     read default roles
+	PUT    /defaultRole     save default roles
+
+Every request needs a valid identity token and an authorization
+for the ressource of the endpoint (e.g. embiam.entity). The action
+depends on the method: read (GET), create (POST), update (PUT) and
+delete (DELETE). The role embiam.admin with ressource embiam.* and
+action * allows everything, embiam.reader allows read.
+*/
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/janso/embiam"
+	"github.com/janso/embiam/httpauth"
+)
+
+// Ressources of the admin API
+const (
+	RessourceEntity      = "embiam.entity"
+	RessourceEntityToken = "embiam.entityToken"
+	RessourceRole        = "embiam.role"
+	RessourceDefaultRole = "embiam.defaultRole"
+)
+
+// Actions of the admin API
+const (
+	ActionRead   = "read"
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+type (
+	// NewEntityRequest is the body of POST /entity
+	NewEntityRequest struct {
+		Nick  string              `json:"nick"`
+		Roles []embiam.RoleIdType `json:"roles"`
+	}
+
+	// NewEntityResponse is the response of POST /entity, the entity with the generated password and secret (without hashes)
+	NewEntityResponse struct {
+		embiam.PublicEntity
+		Password string `json:"password"`
+		Secret   string `json:"secret"`
+	}
+
+	// PasswordRequest is the body of PUT /entity/{nick}/password
+	PasswordRequest struct {
+		Password string `json:"password"`
+	}
+
+	// routeStruct contains the handlers of a path, one per method (guarded by authorization checks)
+	routeStruct map[string]http.Handler
+)
+
+// actionForMethod maps the HTTP methods to the actions for the authorization check
+var actionForMethod = map[string]string{
+	http.MethodGet:    ActionRead,
+	http.MethodPost:   ActionCreate,
+	http.MethodPut:    ActionUpdate,
+	http.MethodDelete: ActionDelete,
+}
+
+// NewHandler creates the handler of the admin API
+// authenticator checks the identity tokens, if it is nil httpauth.DefaultAuthenticator is used
+func NewHandler(authenticator *httpauth.Authenticator) http.Handler {
+	if authenticator == nil {
+		authenticator = httpauth.DefaultAuthenticator
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/entity", newRoute(authenticator, RessourceEntity, map[string]http.HandlerFunc{
+		http.MethodGet:  readEntityList,
+		http.MethodPost: createEntity,
+	}))
+	mux.Handle("/entity/", newRoute(authenticator, RessourceEntity, map[string]http.HandlerFunc{
+		http.MethodGet:    readEntity,
+		http.MethodPut:    updateEntity,
+		http.MethodDelete: deleteEntity,
+	}))
+	mux.Handle("/entityToken", newRoute(authenticator, RessourceEntityToken, map[string]http.HandlerFunc{
+		http.MethodGet:  readEntityTokenList,
+		http.MethodPost: createEntityToken,
+	}))
+	mux.Handle("/role", newRoute(authenticator, RessourceRole, map[string]http.HandlerFunc{
+		http.MethodGet: readRoles,
+		http.MethodPut: saveRoles,
+	}))
+	mux.Handle("/defaultRole", newRoute(authenticator, RessourceDefaultRole, map[string]http.HandlerFunc{
+		http.MethodGet: readDefaultRoles,
+		http.MethodPut: saveDefaultRoles,
+	}))
+	return mux
+}
+
+// newRoute guards the handlers of a path with the authorization check for ressource and the action of the method
+func newRoute(authenticator *httpauth.Authenticator, ressource string, handlers map[string]http.HandlerFunc) routeStruct {
+	route := routeStruct{}
+	for method, handler := range handlers {
+		route[method] = authenticator.RequireAuthorization(ressource, actionForMethod[method], handler)
+	}
+	return route
+}
+
+// ServeHTTP calls the handler of the request's method
+func (route routeStruct) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler, ok := route[r.Method]
+	if !ok {
+		allowed := make([]string, 0, len(route))
+		for method := range route {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+/********************************************************************
+	ENTITY
+********************************************************************/
+
+// readEntityList sends all entities
+func readEntityList(w http.ResponseWriter, r *http.Request) {
+	nicks, err := embiam.Db.ReadEntityList()
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	entities := make([]embiam.PublicEntity, 0, len(nicks))
+	for _, nick := range nicks {
+		entity, err := embiam.Db.ReadPublicEntityByNick(nick)
+		if err != nil {
+			sendError(w, err)
+			return
+		}
+		entities = append(entities, *entity)
+	}
+	sendJSON(w, http.StatusOK, entities)
+}
+
+// createEntity creates an entity and sends it with password and secret
+func createEntity(w http.ResponseWriter, r *http.Request) {
+	request := NewEntityRequest{}
+	if !readJSON(w, r, &request) {
+		return
+	}
+	newEntity, err := embiam.CreateEntityBy(httpauth.ActorFromContext(r.Context()), request.Nick, request.Roles)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	entity, err := embiam.Db.ReadPublicEntityByNick(newEntity.Nick)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusCreated, NewEntityResponse{
+		PublicEntity: *entity,
+		Password:     newEntity.Password,
+		Secret:       newEntity.Secret,
+	})
+}
+
+// readEntity sends the entity of the nick in the path
+func readEntity(w http.ResponseWriter, r *http.Request) {
+	nick, ok := nickFromPath(w, r)
+	if !ok {
+		return
+	}
+	entity, err := embiam.Db.ReadPublicEntityByNick(nick)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, entity)
+}
+
+// updateEntity changes active and roles of the entity of the nick in the path
+func updateEntity(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, passwordPathSuffix) {
+		setPassword(w, r)
+		return
+	}
+	nick, ok := nickFromPath(w, r)
+	if !ok {
+		return
+	}
+	publicEntity := embiam.PublicEntity{}
+	if !readJSON(w, r, &publicEntity) {
+		return
+	}
+	publicEntity.Nick = nick
+	entity, err := embiam.UpdateEntityBy(httpauth.ActorFromContext(r.Context()), publicEntity)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, entity)
+}
+
+// deleteEntity deletes the entity of the nick in the path
+func deleteEntity(w http.ResponseWriter, r *http.Request) {
+	nick, ok := nickFromPath(w, r)
+	if !ok {
+		return
+	}
+	err := embiam.DeleteEntityBy(httpauth.ActorFromContext(r.Context()), nick)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPassword sets the password of the nick in the path /entity/{nick}/password
+func setPassword(w http.ResponseWriter, r *http.Request) {
+	nick, ok := nickFromPath(w, r)
+	if !ok {
+		return
+	}
+	request := PasswordRequest{}
+	if !readJSON(w, r, &request) {
+		return
+	}
+	err := embiam.SetPasswordBy(httpauth.ActorFromContext(r.Context()), nick, request.Password)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// passwordPathSuffix follows the nick in the path of setPassword
+const passwordPathSuffix = "/password"
+
+// nickFromPath gets the nick from the path /entity/{nick} (or /entity/{nick}/password for PUT) and checks that the entity exists
+func nickFromPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	nick := strings.TrimPrefix(r.URL.Path, "/entity/")
+	if r.Method == http.MethodPut {
+		nick = strings.TrimSuffix(nick, passwordPathSuffix)
+	}
+	if !embiam.IsValidNick(nick) || !embiam.Db.EntityExists(nick) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return "", false
+	}
+	return nick, true
+}
+
+/********************************************************************
+	ENTITY TOKEN
+********************************************************************/
+
+// readEntityTokenList sends all unused entity tokens
+func readEntityTokenList(w http.ResponseWriter, r *http.Request) {
+	entityTokens, err := embiam.ReadEntityTokens()
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, entityTokens)
+}
+
+// createEntityToken creates an entity token and sends it with the PIN
+func createEntityToken(w http.ResponseWriter, r *http.Request) {
+	entityToken, err := embiam.NewEntityTokenBy(httpauth.ActorFromContext(r.Context()))
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusCreated, entityToken)
+}
+
+/********************************************************************
+	ROLE
+********************************************************************/
+
+// readRoles sends all roles
+func readRoles(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, http.StatusOK, embiam.GetRoles())
+}
+
+// saveRoles checks and saves all roles
+func saveRoles(w http.ResponseWriter, r *http.Request) {
+	roles := embiam.RoleCacheMap{}
+	if !readJSON(w, r, &roles) {
+		return
+	}
+	err := embiam.SaveRolesBy(httpauth.ActorFromContext(r.Context()), roles)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, roles)
+}
+
+// readDefaultRoles sends the default roles
+func readDefaultRoles(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, http.StatusOK, embiam.GetDefaultRoles())
+}
+
+// saveDefaultRoles checks and saves the default roles
+func saveDefaultRoles(w http.ResponseWriter, r *http.Request) {
+	defaultRoles := []embiam.RoleIdType{}
+	if !readJSON(w, r, &defaultRoles) {
+		return
+	}
+	err := embiam.SaveDefaultRolesBy(httpauth.ActorFromContext(r.Context()), defaultRoles)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, defaultRoles)
+}
+
+/********************************************************************
+	HELPER
+********************************************************************/
+
+// readJSON decodes the body of the request to v, if it fails 400 Bad Request is sent
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// sendJSON sends v as json with status
+func sendJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// sendError sends the status code for err, e.g. 404 Not Found for embiam.ErrEntityNotFound
+// unexpected errors are logged and sent as 500 Internal Server Error (without details)
+func sendError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, embiam.ErrEntityNotFound):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case errors.Is(err, embiam.ErrEntityExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, embiam.ErrInvalidNick), errors.Is(err, embiam.ErrRoleNotFound), errors.Is(err, embiam.ErrRoleCycle),
+		errors.Is(err, embiam.ErrPasswordPolicy):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Error in admin API: %s\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
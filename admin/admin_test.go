@@ -0,0 +1,198 @@
+package admin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/janso/embiam"
+)
+
+const (
+	testPassword = `SeCrEtSeCrEt`
+	testHost     = `192.0.2.1`
+)
+
+// signIn creates an entity with roles and returns the value for the header field Authorization
+func signIn(t *testing.T, nick string, roles []embiam.RoleIdType) string {
+	e := embiam.Entity{
+		Nick:         nick,
+		PasswordHash: testHash(t, testPassword),
+		Active:       true,
+		Roles:        roles,
+	}
+	err := embiam.Db.SaveEntity(&e)
+	if err != nil {
+		t.Errorf("embiam.Db.SaveEntity(&e) returned error %s; want save entity without error\n", err)
+	}
+	identityToken, err := embiam.CheckIdentity(nick, testPassword, testHost)
+	if err != nil {
+		t.Errorf("embiam.CheckIdentity(%s, testPassword, testHost) returned error %s; want identity token\n", nick, err)
+	}
+	return "embiam " + base64.StdEncoding.EncodeToString([]byte(identityToken.Token))
+}
+
+// testHash returns the hash of password for test fixtures
+func testHash(t *testing.T, password string) string {
+	hash, err := embiam.HashPassword(password)
+	if err != nil {
+		t.Fatalf("embiam.HashPassword(password) returned error %s; want hash\n", err)
+	}
+	return hash
+}
+
+// call sends a request to handler and returns the response
+func call(handler http.Handler, method, path, authValue, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.RemoteAddr = testHost + ":1234"
+	if authValue != "" {
+		r.Header.Set("Authorization", authValue)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminHandler(t *testing.T) {
+	// initialize embiam with admin roles
+	embiam.Initialize(new(embiam.DbTransient))
+	roles := embiam.GetRoles()
+	roles["embiam.admin"] = embiam.RoleBodyStruct{Authorization: []embiam.AuthorizationStruct{{
+		Ressource: "embiam.*",
+		Action:    embiam.ActionMap{embiam.ActionAsteriks: {}},
+	}}}
+	roles["embiam.reader"] = embiam.RoleBodyStruct{Authorization: []embiam.AuthorizationStruct{{
+		Ressource: "embiam.*",
+		Action:    embiam.ActionMap{"read": {}},
+	}}}
+	err := embiam.SaveRoles(roles)
+	if err != nil {
+		t.Errorf("embiam.SaveRoles(roles) returned error %s; want no error\n", err)
+	}
+	admin := signIn(t, `ADM1N`, []embiam.RoleIdType{`embiam.admin`})
+	reader := signIn(t, `READER`, []embiam.RoleIdType{`embiam.reader`})
+	user := signIn(t, `USER`, []embiam.RoleIdType{`application`})
+	handler := NewHandler(nil)
+
+	// authentication and authorization
+	tests := []struct {
+		method     string
+		path       string
+		authValue  string
+		wantStatus int
+	}{
+		{http.MethodGet, "/entity", "", http.StatusUnauthorized},
+		{http.MethodGet, "/entity", user, http.StatusForbidden},
+		{http.MethodGet, "/entity", reader, http.StatusOK},
+		{http.MethodGet, "/entity", admin, http.StatusOK},
+		{http.MethodPost, "/entityToken", reader, http.StatusForbidden},
+		{http.MethodDelete, "/entity/USER", reader, http.StatusForbidden},
+		{http.MethodGet, "/entity/UNKNOWN", admin, http.StatusNotFound},
+		{http.MethodGet, "/entity/.USER", admin, http.StatusNotFound},
+		{http.MethodPatch, "/role", admin, http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		w := call(handler, test.method, test.path, test.authValue, "")
+		if w.Code != test.wantStatus {
+			t.Errorf("%s %s returned status %d; want %d\n", test.method, test.path, w.Code, test.wantStatus)
+		}
+	}
+
+	// create, read, update and delete entity
+	w := call(handler, http.MethodPost, "/entity", admin, `{"nick":"N1CK0001","roles":["embiam.reader"]}`)
+	newEntity := NewEntityResponse{}
+	body := w.Body.String()
+	json.Unmarshal([]byte(body), &newEntity)
+	if w.Code != http.StatusCreated || newEntity.Nick != `N1CK0001` || newEntity.Password == "" || newEntity.Secret == "" || len(newEntity.Roles) != 1 {
+		t.Errorf("POST /entity returned status %d and %v; want new entity with password and secret\n", w.Code, newEntity)
+	}
+	if strings.Contains(body, `passwordHash`) || strings.Contains(body, `secretHash`) {
+		t.Errorf("POST /entity returned %s; want no hashes\n", body)
+	}
+	w = call(handler, http.MethodPost, "/entity", admin, `{"nick":"N1CK0001"}`)
+	if w.Code != http.StatusConflict {
+		t.Errorf("POST /entity for existing nick returned status %d; want %d\n", w.Code, http.StatusConflict)
+	}
+	w = call(handler, http.MethodPost, "/entity", admin, `{"roles":["unknown"]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST /entity with unknown role returned status %d; want %d\n", w.Code, http.StatusBadRequest)
+	}
+	w = call(handler, http.MethodPut, "/entity/N1CK0001", admin, `{"active":false,"roles":["application"]}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("PUT /entity/N1CK0001 returned status %d; want %d\n", w.Code, http.StatusOK)
+	}
+	w = call(handler, http.MethodGet, "/entity/N1CK0001", reader, "")
+	publicEntity := embiam.PublicEntity{}
+	json.NewDecoder(w.Body).Decode(&publicEntity)
+	if publicEntity.Active || len(publicEntity.Roles) != 1 || publicEntity.Roles[0] != `application` {
+		t.Errorf("GET /entity/N1CK0001 returned %v; want inactive entity with role application\n", publicEntity)
+	}
+	w = call(handler, http.MethodDelete, "/entity/N1CK0001", admin, "")
+	if w.Code != http.StatusNoContent || embiam.Db.EntityExists(`N1CK0001`) {
+		t.Errorf("DELETE /entity/N1CK0001 returned status %d; want deleted entity\n", w.Code)
+	}
+
+	// update roles of signed in entity: reader becomes admin
+	w = call(handler, http.MethodPut, "/entity/READER", admin, `{"active":true,"roles":["embiam.admin"]}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("PUT /entity/READER returned status %d; want %d\n", w.Code, http.StatusOK)
+	}
+	w = call(handler, http.MethodPost, "/entityToken", reader, "")
+	if w.Code != http.StatusCreated {
+		t.Errorf("POST /entityToken returned status %d after role change; want %d\n", w.Code, http.StatusCreated)
+	}
+
+	// set password: the password policy is checked
+	w = call(handler, http.MethodPut, "/entity/USER/password", admin, `{"password":"short"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT /entity/USER/password with weak password returned status %d; want %d\n", w.Code, http.StatusBadRequest)
+	}
+	w = call(handler, http.MethodPut, "/entity/USER/password", admin, `{"password":"Tr0ub4dor&3horse"}`)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("PUT /entity/USER/password returned status %d; want %d\n", w.Code, http.StatusNoContent)
+	}
+	if _, err := embiam.CheckIdentity(`USER`, `Tr0ub4dor&3horse`, testHost); err != nil {
+		t.Errorf("embiam.CheckIdentity(USER, ...) returned error %s after PUT /entity/USER/password; want identity token\n", err)
+	}
+	w = call(handler, http.MethodPut, "/entity/UNKNOWN/password", admin, `{"password":"Tr0ub4dor&3horse"}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("PUT /entity/UNKNOWN/password returned status %d; want %d\n", w.Code, http.StatusNotFound)
+	}
+
+	// list entity tokens
+	w = call(handler, http.MethodGet, "/entityToken", admin, "")
+	entityTokens := []embiam.EntityToken{}
+	json.NewDecoder(w.Body).Decode(&entityTokens)
+	if len(entityTokens) != 1 || entityTokens[0].Pin == "" {
+		t.Errorf("GET /entityToken returned %v; want one entity token\n", entityTokens)
+	}
+
+	// roles: inconsistent roles are rejected
+	w = call(handler, http.MethodPut, "/role", admin, `{"a":{"containedRoles":["a"]}}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT /role with cycle returned status %d; want %d\n", w.Code, http.StatusBadRequest)
+	}
+	w = call(handler, http.MethodGet, "/role", reader, "")
+	readRoles := embiam.RoleCacheMap{}
+	json.NewDecoder(w.Body).Decode(&readRoles)
+	if len(readRoles) != len(roles) {
+		t.Errorf("GET /role returned %d roles; want %d\n", len(readRoles), len(roles))
+	}
+
+	// default roles
+	w = call(handler, http.MethodPut, "/defaultRole", admin, `["unknown"]`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT /defaultRole with unknown role returned status %d; want %d\n", w.Code, http.StatusBadRequest)
+	}
+	w = call(handler, http.MethodPut, "/defaultRole", admin, `["embiam.reader"]`)
+	if w.Code != http.StatusOK {
+		t.Errorf("PUT /defaultRole returned status %d; want %d\n", w.Code, http.StatusOK)
+	}
+	defaultRoles := embiam.GetDefaultRoles()
+	if len(defaultRoles) != 1 || defaultRoles[0] != `embiam.reader` {
+		t.Errorf("embiam.GetDefaultRoles() returned %v; want [embiam.reader]\n", defaultRoles)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+The command verifies the audit trail of embiam (see embiam.OpenAuditTrail).
+It checks the hash chain and the signatures of all records with the public
+keys, compares the trail with the head (sequence number and hash of the last
+record, saved outside of the trail) and reports the first broken link.
+
+	$ verifyaudittrail -dir embiamDb/audit/ -keys publicKeys.json -head head.json
+	audit trail is intact, 42 records verified
+
+Both files are written to the key directory of the audit trail. Keep copies,
+that can't be changed by the server, to verify the trail. Without -head the
+command can't detect removed records at the end of the trail.
+
+The exit code is 1, if the audit trail is broken, and 2 for other errors.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/janso/embiam"
+)
+
+func main() {
+	dir := flag.String("dir", "embiamDb/audit/", "directory of the audit trail")
+	keysPath := flag.String("keys", "", "file with the public keys (publicKeys.json of the key directory)")
+	headPath := flag.String("head", "", "file with the head of the audit trail (head.json of the key directory)")
+	flag.Parse()
+
+	if *keysPath == "" {
+		fmt.Fprintf(os.Stderr, "Error flag -keys is missing\n")
+		os.Exit(2)
+	}
+	jsonBytes, err := ioutil.ReadFile(*keysPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error %s\n", err)
+		os.Exit(2)
+	}
+	keys, err := embiam.ParseAuditTrailPublicKeys(jsonBytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error %s\n", err)
+		os.Exit(2)
+	}
+	head := embiam.AuditTrailHead{}
+	if *headPath != "" {
+		jsonBytes, err = ioutil.ReadFile(*headPath)
+		if err == nil {
+			err = json.Unmarshal(jsonBytes, &head)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	records, err := embiam.VerifyAuditTrail(*dir, keys, head)
+	trailError := &embiam.AuditTrailError{}
+	if errors.As(err, &trailError) {
+		fmt.Printf("audit trail is broken: first broken link in line %d (%s), %d records verified before\n", trailError.Line, trailError.Reason, records)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error %s\n", err)
+		os.Exit(2)
+	}
+	fmt.Printf("audit trail is intact, %d records verified\n", records)
+}
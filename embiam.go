@@ -6,8 +6,11 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"math/rand"
+	"log"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -16,39 +19,119 @@ import (
 var Configuration ConfigurationStruct
 
 type ConfigurationStruct struct {
-	ServerId                     string `json:"serverId"`
-	Port                         string `json:"port"`
-	EntityTokenValidityHours     int    `json:"entityTokenValidityHours"`
-	IdentityTokenValiditySeconds int    `json:"identityTokenValiditySeconds"`
-	MaxSignInAttempts            int    `json:"maxSignInAttempts"`
+	ServerId                     string         `json:"serverId"`
+	Port                         string         `json:"port"`
+	EntityTokenValidityHours     int            `json:"entityTokenValidityHours"`
+	IdentityTokenValiditySeconds int            `json:"identityTokenValiditySeconds"`
+	MaxSignInAttempts            int            `json:"maxSignInAttempts"`
+	LockoutSeconds               int            `json:"lockoutSeconds"`
+	LockoutMaxSeconds            int            `json:"lockoutMaxSeconds"`
+	SignInRateLimitPerMinute     int            `json:"signInRateLimitPerMinute"`
+	SignInRateLimitBurst         int            `json:"signInRateLimitBurst"`
+	SignInRateLimitMaxKeys       int            `json:"signInRateLimitMaxKeys"`
+	TOTPIssuer                   string         `json:"totpIssuer"`
+	TOTPDriftSteps               int            `json:"totpDriftSteps"`
+	TOTPEncryptionKey            string         `json:"totpEncryptionKey"`
+	PasswordPolicy               PasswordPolicy `json:"passwordPolicy"`
+	PasswordMaxAgeDays           int            `json:"passwordMaxAgeDays"`    // 0: passwords don't expire
+	PasswordHistoryDepth         int            `json:"passwordHistoryDepth"`  // number of previous passwords, that can't be reused (the current password never can)
+	PasswordHashAlgorithm        string         `json:"passwordHashAlgorithm"` // bcrypt or argon2id
+	BcryptCost                   int            `json:"bcryptCost"`
+	Argon2Time                   int            `json:"argon2Time"`
+	Argon2Memory                 int            `json:"argon2Memory"` // KiB
+	Argon2Threads                int            `json:"argon2Threads"`
+	IdentityTokenCacheMaxSize    int            `json:"identityTokenCacheMaxSize"`
+	IdentityTokenSweepSeconds    int            `json:"identityTokenSweepSeconds"`
+	RefreshTokenValidityHours    int            `json:"refreshTokenValidityHours"`
+	SessionLifetimeHours         int            `json:"sessionLifetimeHours"`
+	SignedIdentityTokens         bool           `json:"signedIdentityTokens"`
 }
 
-// Initialize prepares embiam
+// Initialize prepares embiam with the default configuration (see DefaultConfiguration)
 func Initialize(aDb DbInterface) {
-	// initialize randomizer
-	rand.Seed(time.Now().UTC().UnixNano())
-
-	// set default configuration
-	sid := ServerId{}
-	sid.New()
-	Configuration = ConfigurationStruct{
-		ServerId:                     sid.String(),
-		Port:                         "8242",
-		EntityTokenValidityHours:     168,
-		IdentityTokenValiditySeconds: 720,
-		MaxSignInAttempts:            5,
+	err := InitializeWithConfiguration(aDb, DefaultConfiguration())
+	if err != nil {
+		log.Fatalf("Error %s\n", err)
+	}
+}
+
+// InitializeWithConfiguration prepares embiam with config, e.g. from LoadConfiguration
+// if config doesn't contain a ServerId, a new one is generated. Without a TOTP encryption key EnrollTOTP fails
+func InitializeWithConfiguration(aDb DbInterface, config ConfigurationStruct) error {
+	// check and set configuration
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+	if config.ServerId == "" {
+		sid := ServerId{}
+		sid.New()
+		config.ServerId = sid.String()
 	}
+	Configuration = config
+	initializePasswordHashers(config)
 
 	// initialize entity model
 	Db = aDb
 	Db.Initialize()
 
 	//  initialize the token cache
-	identityTokenCache := identityTokenCacheType{}
-	identityTokenCache.Cache = make(identityTokenCacheItemSlice, 0, 1024)
+	sweepInterval := time.Second * time.Duration(Configuration.IdentityTokenSweepSeconds)
+	identityTokenCache.initialize(Configuration.IdentityTokenCacheMaxSize, sweepInterval)
+	refreshTokenCache.initialize(sweepInterval)
+	signingKeyStore, _ := aDb.(SigningKeyStore)
+	err = signingKeys.initialize(signingKeyStore)
+	if err != nil {
+		return fmt.Errorf("error loading signing keys: %w", err)
+	}
+	signInRateLimiter.initialize(Configuration.SignInRateLimitPerMinute, Configuration.SignInRateLimitBurst, Configuration.SignInRateLimitMaxKeys)
 
 	// initialize authorizations
 	initializeAuthorizations()
+
+	// load identity tokens from the token store
+	tokenStore, ok := aDb.(TokenStore)
+	if !ok {
+		tokenStore = new(MemoryTokenStore)
+	}
+	err = InitializeTokenStore(tokenStore)
+	if err != nil {
+		log.Printf("Error loading identity tokens: %s\n", err)
+	}
+	return nil
+}
+
+// DefaultConfiguration returns the configuration used by Initialize (without ServerId and TOTP encryption key)
+func DefaultConfiguration() ConfigurationStruct {
+	return ConfigurationStruct{
+		Port:                         "8242",
+		EntityTokenValidityHours:     168,
+		IdentityTokenValiditySeconds: 720,
+		MaxSignInAttempts:            5,
+		LockoutSeconds:               60,
+		LockoutMaxSeconds:            3600,
+		SignInRateLimitPerMinute:     60,
+		SignInRateLimitBurst:         20,
+		SignInRateLimitMaxKeys:       100000,
+		TOTPIssuer:                   "embiam",
+		TOTPDriftSteps:               1,
+		PasswordHashAlgorithm:        PasswordHashBcrypt,
+		BcryptCost:                   bcrypt.DefaultCost,
+		Argon2Time:                   3,
+		Argon2Memory:                 64 * 1024,
+		Argon2Threads:                4,
+		PasswordHistoryDepth:         5,
+		IdentityTokenCacheMaxSize:    1000000,
+		IdentityTokenSweepSeconds:    60,
+		RefreshTokenValidityHours:    24,
+		SessionLifetimeHours:         168,
+		PasswordPolicy: PasswordPolicy{
+			MinLength:           12,
+			MinCharacterClasses: 3,
+			MinEntropyBits:      50,
+			ForbiddenSubstrings: []string{"password", "embiam"},
+		},
+	}
 }
 
 // CheckAuthIdentity checks an authValue and provides and identity token (for validFor)
@@ -59,26 +142,31 @@ func CheckAuthIdentity(authValue string, validFor string) (identityTokenStruct,
 		and it is determined by r.Header.Get("Authorization")
 		it's value consists of the term embiam an the nick and password,
 		separated by colon and base64-encoded. Like in simple authentication
+		For entities with TOTP the code follows after a space,
+		e.g. embiam TjFDSzAwMDE6U2VDckV0U2VDckV0 123456
 	*/
-	errorInvalidAuthorization := errors.New("invalid authorization")
 	authPart := strings.Split(authValue, " ")
 	if len(authPart) < 2 {
-		return identityTokenStruct{}, "", errorInvalidAuthorization
+		return identityTokenStruct{}, "", ErrInvalidAuthValue
 	}
 	if authPart[0] != "embiam" {
-		return identityTokenStruct{}, "", errorInvalidAuthorization
+		return identityTokenStruct{}, "", ErrInvalidAuthValue
 	}
 	// base64 decode
 	decodedCredentials, err := base64.StdEncoding.DecodeString(authPart[1])
 	if err != nil {
-		return identityTokenStruct{}, "", errorInvalidAuthorization
+		return identityTokenStruct{}, "", ErrInvalidAuthValue
 	}
 	// split username and password
 	splitResult := strings.Split(string(decodedCredentials), ":")
 	if len(splitResult) < 2 {
-		return identityTokenStruct{}, "", errorInvalidAuthorization
+		return identityTokenStruct{}, "", ErrInvalidAuthValue
+	}
+	// do actual check (with one-time password, if provided)
+	if len(authPart) >= 3 {
+		identityToken, err := CheckIdentityWithOTP(splitResult[0], splitResult[1], authPart[2], validFor)
+		return identityToken, splitResult[0], err
 	}
-	// do actual check
 	identityToken, err := CheckIdentity(splitResult[0], splitResult[1], validFor)
 	// return identity token, nick and error
 	return identityToken, splitResult[0], err
@@ -86,50 +174,159 @@ func CheckAuthIdentity(authValue string, validFor string) (identityTokenStruct,
 
 // CheckIdentity checks nick and password and provides and identity token (for validFor)
 func CheckIdentity(nick, password, validFor string) (identityTokenStruct, error) {
+	identityToken, err := checkIdentity(nick, password, "", validFor)
+	audit(AuditSignIn, nick, Actor{ValidFor: validFor}, err, nil)
+	return identityToken, err
+}
+
+// checkIdentity checks nick, password and the one-time password (for entities with TOTP) and provides and identity token
+// (without audit event for the sign in)
+func checkIdentity(nick, password, code, validFor string) (identityTokenStruct, error) {
 	identityToken := identityTokenStruct{}
-	// read complete entity by nick
-	entity, err := Db.ReadEntityByNick(nick)
+	// check password
+	entity, needsRehash, err := readEntityWithPassword(nick, password, validFor)
+	if err != nil {
+		return identityToken, err
+	}
+	// check second factor
+	err = checkSecondFactor(entity, code, validFor)
+	if err != nil {
+		return identityToken, err
+	}
+	// an expired password must be changed with ChangePassword before the sign in
+	if entity.PasswordExpired() {
+		return identityToken, ErrPasswordExpired
+	}
+	// save successful sign in, the counter of wrong passwords starts again
+	// a hash of an outdated algorithm (or with outdated parameters) is replaced
+	entity.PasswordHash = rehash(entity.PasswordHash, password, needsRehash)
+	entity.WrongPasswordCounter = 0
+	entity.LastSignIn = time.Now().UTC()
+	err = Db.SaveEntity(entity)
 	if err != nil {
 		return identityToken, err
 	}
+
+	// create identity token (and start a new session for refresh tokens)
+	return issueIdentityToken(entity, validFor, "")
+}
+
+// readEntityWithPassword reads the entity for nick and compares password with the saved hash of the password
+// the rate limit and the lock after wrong passwords are checked; a wrong password is counted
+// needsRehash is set, if the hash of the password is outdated (see verifyHash)
+func readEntityWithPassword(nick, password, validFor string) (entity *Entity, needsRehash bool, err error) {
+	// check rate limit of client and nick (also for unknown nicks)
+	err = checkSignInRateLimit(nick, validFor)
+	if err != nil {
+		return nil, false, err
+	}
+	// read complete entity by nick
+	entity, err = Db.ReadEntityByNick(nick)
+	if err != nil {
+		if errors.Is(err, ErrEntityNotFound) {
+			// don't reveal that the nick doesn't exist
+			return nil, false, ErrInvalidCredentials
+		}
+		return nil, false, err
+	}
 	// check if entity is active
 	if !entity.Active {
-		return identityToken, errors.New("entity is not active")
+		return nil, false, ErrEntityInactive
+	}
+	// check if entity is locked because of wrong passwords (before the expensive check of the password)
+	lockedUntil := entity.LockedUntil()
+	if time.Now().Before(lockedUntil) {
+		return nil, false, &LockedError{Until: lockedUntil}
 	}
 	// compare given password with saved hash of password
-	err = bcrypt.CompareHashAndPassword([]byte(entity.PasswordHash), []byte(password))
+	ok, needsRehash, err := verifyHash(entity.PasswordHash, password)
 	if err != nil {
-		// wrong password
-		entity.WrongPasswordCounter++
-		if entity.WrongPasswordCounter > Configuration.MaxSignInAttempts {
-			// deactivate entity because of multiple wrong attempts
-			entity.Active = false
-		}
-		// save failed signin
-		entity.LastSignInAttempt = time.Now().UTC()
-		err = Db.SaveEntity(entity)
-		if err != nil {
-			return identityToken, err
-		}
-		// return error
-		return identityToken, errors.New("invalid password")
+		return nil, false, err
 	}
-	// save successful sign in
-	entity.LastSignIn = time.Now().UTC()
-	err = Db.SaveEntity(entity)
+	if !ok {
+		return nil, false, failSignIn(entity, validFor, ErrInvalidCredentials)
+	}
+	return entity, needsRehash, nil
+}
+
+// checkSecondFactor checks the one-time password code of entities with TOTP, a wrong code is counted like a wrong password
+func checkSecondFactor(entity *Entity, code, validFor string) error {
+	if !entity.TOTPEnabled {
+		return nil
+	}
+	if code == "" {
+		return ErrOTPRequired
+	}
+	err := useTOTPCode(entity, code)
+	if errors.Is(err, ErrInvalidOTP) {
+		return failSignIn(entity, validFor, err)
+	}
+	return err
+}
+
+// failSignIn counts a wrong password (or one-time password) and saves the failed sign in
+// it returns cause or a LockedError, if the entity is locked now
+func failSignIn(entity *Entity, validFor string, cause error) error {
+	entity.WrongPasswordCounter++
+	entity.LastSignInAttempt = time.Now().UTC()
+	err := Db.SaveEntity(entity)
 	if err != nil {
-		return identityToken, err
+		return err
+	}
+	// lock entity because of multiple wrong attempts
+	lockedUntil := entity.LockedUntil()
+	if time.Now().Before(lockedUntil) {
+		audit(AuditEntityLocked, entity.Nick, Actor{ValidFor: validFor}, nil, map[string]string{"lockedUntil": lockedUntil.Format(time.RFC3339)})
+		return &LockedError{Until: lockedUntil}
 	}
+	return cause
+}
+
+// issueIdentityToken creates an identity token for entity (and validFor) and prepares the authorizations of the entity
+// if refresh tokens are configured, a refresh token of family is provided too; an empty family starts a new session
+func issueIdentityToken(entity *Entity, validFor, family string) (identityTokenStruct, error) {
+	identityToken := identityTokenStruct{}
 
-	// create identity token
-	identityToken.Token = generateIdentityToken()
+	// start new session
+	if family == "" && Configuration.RefreshTokenValidityHours > 0 {
+		family = refreshTokenCache.newFamily(entity.Nick, validFor)
+	}
 
 	// set end of validity
-	seconds := Configuration.IdentityTokenValiditySeconds // get number of minutes from config
+	seconds := Configuration.IdentityTokenValiditySeconds // get number of seconds from config
 	identityToken.ValidUntil = time.Now().UTC().Add(time.Second * time.Duration(seconds))
 
+	// create refresh token
+	if family != "" {
+		refreshToken, refreshValidUntil, sessionEnd, err := refreshTokenCache.add(family)
+		if err != nil {
+			return identityTokenStruct{}, err
+		}
+		identityToken.RefreshToken = refreshToken
+		identityToken.RefreshValidUntil = &refreshValidUntil
+		// the identity token is not valid longer than the session
+		if identityToken.ValidUntil.After(sessionEnd) {
+			identityToken.ValidUntil = sessionEnd
+		}
+	}
+
+	// create identity token (random or signed)
+	if Configuration.SignedIdentityTokens {
+		token, err := signIdentityToken(entity.Nick, validFor, identityToken.ValidUntil, entity.MustChangePassword)
+		if err != nil {
+			return identityTokenStruct{}, err
+		}
+		identityToken.Token = token
+	} else {
+		identityToken.Token = generateIdentityToken()
+	}
+
 	// add identity token to cache
-	identityTokenCache.add(identityToken.Token, identityToken.ValidUntil, validFor, nick)
+	identityToken.MustChangePassword = entity.MustChangePassword
+	err := identityTokenCache.add(identityToken.Token, identityToken.ValidUntil, validFor, entity.Nick, family, entity.MustChangePassword)
+	if err != nil {
+		return identityTokenStruct{}, err
+	}
 
 	// prepare authorizations for nick
 	err = AddNicksAuthorizationsToCache(entity)
@@ -142,7 +339,17 @@ func CheckIdentity(nick, password, validFor string) (identityTokenStruct, error)
 }
 
 // IsAuthIdentityTokenValid checks if the identity token is valid, validFor contains information about the client, e.g. the IP address
+// restricted identity tokens (see Entity.MustChangePassword) are not valid
 func IsAuthIdentityTokenValid(authValue string, validFor string) bool {
+	token, ok := IdentityTokenFromAuthValue(authValue)
+	if !ok {
+		return false
+	}
+	return IsIdentityTokenValid(token, validFor)
+}
+
+// IdentityTokenFromAuthValue extracts the identity token from an authValue
+func IdentityTokenFromAuthValue(authValue string) (string, bool) {
 	/*
 		authValue is transfered in the http header in field "Authorization"
 		and it is determined by r.Header.Get("Authorization")
@@ -151,22 +358,37 @@ func IsAuthIdentityTokenValid(authValue string, validFor string) bool {
 	*/
 	authPart := strings.Split(authValue, " ")
 	if len(authPart) < 2 {
-		return false
+		return "", false
 	}
 	if authPart[0] != "embiam" {
-		return false
+		return "", false
 	}
 	// base64 decode
 	decodedToken, err := base64.StdEncoding.DecodeString(authPart[1])
 	if err != nil {
-		return false
+		return "", false
 	}
-	return identityTokenCache.isIdentityTokenValid(string(decodedToken), validFor)
+	return string(decodedToken), true
 }
 
 // IsIdentityTokenValid checks if the identity token is valid, validFor contains information about the client, e.g. the IP address
+// restricted identity tokens (see Entity.MustChangePassword) are not valid
 func IsIdentityTokenValid(token string, validFor string) bool {
-	return identityTokenCache.isIdentityTokenValid(token, validFor)
+	return identityTokenCache.isIdentityTokenValid(token, validFor) && !identityTokenCache.isRestricted(token)
+}
+
+// IsIdentityTokenRestricted checks if the identity token is only authorized to change the password (see Entity.MustChangePassword)
+func IsIdentityTokenRestricted(token string) bool {
+	return identityTokenCache.isRestricted(token)
+}
+
+// GetNickForIdentityToken returns the nick of a valid identity token (for validFor)
+func GetNickForIdentityToken(token string, validFor string) (string, bool) {
+	if !identityTokenCache.isIdentityTokenValid(token, validFor) {
+		return "", false
+	}
+	nick := identityTokenCache.getNick(token)
+	return nick, nick != ""
 }
 
 /********************************************************************
@@ -178,8 +400,25 @@ func IsIdentityTokenValid(token string, validFor string) bool {
 	The entity also contains the hash of the password and hash
 	of the secret. The secret is a second, more complex,
 	password and it is used to chance the password or to
-	unlock the entity, after it was disabled, e.g. after
-	multiple unsuccessful password entries.
+	unlock the entity, after it was locked, e.g. after
+	multiple unsuccessful password entries. Instead of the secret
+	a recovery code can be used once (see GenerateRecoveryCodes).
+
+	After more than Configuration.MaxSignInAttempts wrong
+	passwords the entity is locked for LockoutSeconds. Every
+	further wrong password doubles the lock (up to
+	LockoutMaxSeconds). The lock ends automatically, a successful
+	sign in clears the counter. Entity.Active is only changed
+	by the administrator.
+
+	Wrong secrets and recovery codes (ResetPassword, UnlockEntity)
+	are counted separately with the same limits, so that an entity
+	locked by wrong passwords can still be unlocked.
+
+	An administrator creates entities with CreateEntity or sets
+	passwords with SetPassword, both set MustChangePassword. An
+	entity saved with Db.SaveEntity and a password known to the
+	administrator needs MustChangePassword too.
 *********************************************************************/
 
 type (
@@ -195,6 +434,15 @@ type (
 		CreateTimeStamp      time.Time    `json:"createTimeStamp"`
 		UpdateTimeStamp      time.Time    `json:"updateTimeStamp"`
 		Roles                []RoleIdType `json:"roles"`
+		TOTPSeed             string       `json:"totpSeed,omitempty"`        // encrypted seed for one-time passwords
+		TOTPEnabled          bool         `json:"totpEnabled,omitempty"`     // enrollment confirmed, a code is required for sign in
+		TOTPLastCounter      int64        `json:"totpLastCounter,omitempty"` // time step of the last used code
+		RecoveryCodeHashes   []string     `json:"recoveryCodeHashes,omitempty"`
+		PasswordChangedAt    time.Time    `json:"passwordChangedAt"`
+		WrongSecretCounter   int          `json:"wrongSecretCounter,omitempty"` // wrong secrets and recovery codes
+		LastSecretAttempt    time.Time    `json:"lastSecretAttempt"`
+		PasswordHistory      []string     `json:"passwordHistory,omitempty"`    // hashes of previous passwords, newest first
+		MustChangePassword   bool         `json:"mustChangePassword,omitempty"` // sign in provides only a restricted identity token
 	}
 
 	// PublicEntity describes a user or a device (without hashes)
@@ -207,6 +455,10 @@ type (
 		CreateTimeStamp      time.Time    `json:"createTimeStamp"`
 		UpdateTimeStamp      time.Time    `json:"updateTimeStamp"`
 		Roles                []RoleIdType `json:"roles"`
+		TOTPEnabled          bool         `json:"totpEnabled"`
+		RecoveryCodes        int          `json:"recoveryCodes"` // number of unused recovery codes
+		PasswordChangedAt    time.Time    `json:"passwordChangedAt"`
+		MustChangePassword   bool         `json:"mustChangePassword"`
 	}
 
 	// NewEntity contains all fields of Entity but also the password and the secret (not only the hash)
@@ -223,11 +475,24 @@ type (
 		CreateTimeStamp      time.Time    `json:"createTimeStamp"`
 		UpdateTimeStamp      time.Time    `json:"updateTimeStamp"`
 		Roles                []RoleIdType `json:"roles"`
+		MustChangePassword   bool         `json:"mustChangePassword"`
 	}
 )
 
 // NewEntity creates a new entity using an entityToken and PIN
 func NewEntity(entityToken, pin string) (newEntity NewEntityStruct, err error) {
+	return RedeemEntityToken(entityToken, pin, "")
+}
+
+// RedeemEntityToken creates a new entity using an entityToken and PIN, validFor identifies the client
+func RedeemEntityToken(entityToken, pin, validFor string) (NewEntityStruct, error) {
+	ne, err := redeemEntityToken(entityToken, pin)
+	audit(AuditEntityTokenRedeemed, ne.Nick, Actor{ValidFor: validFor}, err, map[string]string{"entityToken": hashToken(entityToken)})
+	return ne, err
+}
+
+// redeemEntityToken creates a new entity using an entityToken and PIN (without audit event)
+func redeemEntityToken(entityToken, pin string) (newEntity NewEntityStruct, err error) {
 	// prepare new entity
 	ne := NewEntityStruct{}
 
@@ -238,46 +503,456 @@ func NewEntity(entityToken, pin string) (newEntity NewEntityStruct, err error) {
 	}
 	// check validity
 	if et.ValidUntil.Before(time.Now()) {
-		return ne, errors.New("validity of entity token expired")
+		return ne, ErrEntityTokenExpired
 	}
 	// check pin
 	if et.Pin != pin {
-		return ne, errors.New("invalid PIN")
+		return ne, ErrInvalidPIN
+	}
+
+	// create entity with a unique nick and the default roles
+	ne, err = createEntity("", GetDefaultRoles(), false)
+	if err != nil {
+		return NewEntityStruct{}, err
+	}
+
+	// delete entity token
+	err = Db.deleteEntityToken(et.Token)
+	if err != nil {
+		return NewEntityStruct{}, err
+	}
+
+	return ne, nil
+}
+
+// CreateEntity creates a new entity without entity token, e.g. by an administrator
+// if nick is empty, a unique nick is generated; if roles is nil, the default roles are assigned
+// the entity must change the password (see MustChangePassword)
+func CreateEntity(nick string, roles []RoleIdType) (NewEntityStruct, error) {
+	return CreateEntityBy(Actor{}, nick, roles)
+}
+
+// CreateEntityBy creates a new entity like CreateEntity, actor is recorded in the audit event
+func CreateEntityBy(actor Actor, nick string, roles []RoleIdType) (NewEntityStruct, error) {
+	ne, err := createEntityChecked(nick, roles)
+	if ne.Nick != "" {
+		nick = ne.Nick
+	}
+	audit(AuditEntityCreated, nick, actor, err, map[string]string{"roles": joinRoles(ne.Roles)})
+	return ne, err
+}
+
+// createEntityChecked checks nick and roles and creates the entity
+func createEntityChecked(nick string, roles []RoleIdType) (NewEntityStruct, error) {
+	if nick != "" {
+		if !IsValidNick(nick) {
+			return NewEntityStruct{}, fmt.Errorf("%w %s", ErrInvalidNick, nick)
+		}
+		if Db.EntityExists(nick) {
+			return NewEntityStruct{}, fmt.Errorf("%w: %s", ErrEntityExists, nick)
+		}
 	}
+	if roles == nil {
+		roles = GetDefaultRoles()
+	}
+	err := checkRolesExist(roles)
+	if err != nil {
+		return NewEntityStruct{}, err
+	}
+	// the administrator knows the password, so it must be changed
+	return createEntity(nick, roles, true)
+}
+
+// createEntity creates and saves an entity with generated password and secret
+func createEntity(nick string, roles []RoleIdType, mustChangePassword bool) (NewEntityStruct, error) {
+	ne := NewEntityStruct{}
+	var err error
 
 	// create entity with password and secret
 	ne.Password = generatePassword(32)
 	ne.Secret = generatePassword(64)
-	ne.PasswordHash = Hash(ne.Password)
-	ne.SecretHash = Hash(ne.Secret)
+	ne.PasswordHash, err = HashPassword(ne.Password)
+	if err != nil {
+		return NewEntityStruct{}, err
+	}
+	ne.SecretHash, err = HashPassword(ne.Secret)
+	if err != nil {
+		return NewEntityStruct{}, err
+	}
 	ne.Active = true
 	ne.CreateTimeStamp = time.Now().UTC()
+	ne.Roles = roles
+	ne.MustChangePassword = mustChangePassword
 
 	// generate a unique nick
-	for {
+	ne.Nick = nick
+	for ne.Nick == "" {
 		ne.Nick = generateNick()
-		if !Db.EntityExists(ne.Nick) {
-			break
+		if Db.EntityExists(ne.Nick) {
+			ne.Nick = ""
 		}
 	}
 
-	// assign default roles
-	ne.Roles = defaultRoles
-
 	// save new entity
 	e := ne.toEntity()
 	err = Db.SaveEntity(&e)
 	if err != nil {
 		return NewEntityStruct{}, err
 	}
+	return ne, nil
+}
 
-	// delete entity token
-	err = Db.deleteEntityToken(et.Token)
+// UpdateEntity changes the fields of an entity, that are maintained by an administrator (active and roles)
+// a deactivated entity is signed out; the activation clears the counter of wrong passwords
+func UpdateEntity(publicEntity PublicEntity) (PublicEntity, error) {
+	return UpdateEntityBy(Actor{}, publicEntity)
+}
+
+// UpdateEntityBy changes an entity like UpdateEntity, actor is recorded in the audit event
+func UpdateEntityBy(actor Actor, publicEntity PublicEntity) (PublicEntity, error) {
+	updatedEntity, err := updateEntity(publicEntity)
+	audit(AuditEntityUpdated, publicEntity.Nick, actor, err, map[string]string{
+		"active": strconv.FormatBool(publicEntity.Active),
+		"roles":  joinRoles(publicEntity.Roles),
+	})
+	return updatedEntity, err
+}
+
+// updateEntity changes active and roles of an entity (without audit event)
+func updateEntity(publicEntity PublicEntity) (PublicEntity, error) {
+	entity, err := Db.ReadEntityByNick(publicEntity.Nick)
 	if err != nil {
-		return NewEntityStruct{}, err
+		return PublicEntity{}, err
+	}
+	err = checkRolesExist(publicEntity.Roles)
+	if err != nil {
+		return PublicEntity{}, err
 	}
+	if publicEntity.Active && !entity.Active {
+		entity.WrongPasswordCounter = 0
+	}
+	entity.Active = publicEntity.Active
+	entity.Roles = publicEntity.Roles
+	entity.UpdateTimeStamp = time.Now().UTC()
+	err = Db.SaveEntity(entity)
+	if err != nil {
+		return PublicEntity{}, err
+	}
+	// sign out deactivated entity or update the authorizations of the signed in entity
+	if !entity.Active {
+		err = RevokeAllIdentityTokensForNick(entity.Nick)
+	} else {
+		err = updateNicksAuthorizationsInCache(entity)
+	}
+	return entity.toPublicEntity(), err
+}
 
-	return ne, nil
+// IsValidNick checks if nick contains only letters, digits, '-' and '_' (and can be used as filename)
+func IsValidNick(nick string) bool {
+	if len(nick) == 0 || len(nick) > 64 {
+		return false
+	}
+	for _, c := range nick {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// ResetPassword checks the secret of an entity and provides a new generated password
+// the counter of wrong passwords is cleared, so that an entity locked by CheckIdentity is unlocked.
+// The attempts are rate limited like sign ins (for validFor and nick), wrong secrets are counted (see readEntityWithSecret)
+func ResetPassword(nick, secret, validFor string) (newPassword string, err error) {
+	// read entity and check secret
+	entity, err := readEntityWithSecret(nick, secret, validFor)
+	if err == nil {
+		newPassword, err = resetPassword(entity)
+	}
+	audit(AuditPasswordReset, nick, Actor{ValidFor: validFor}, err, map[string]string{"with": "secret"})
+	return newPassword, err
+}
+
+// UnlockEntity checks the secret of an entity and unlocks it before the lock by CheckIdentity ends
+// the counter of wrong passwords is cleared, the password is kept
+func UnlockEntity(nick, secret, validFor string) error {
+	// read entity and check secret
+	entity, err := readEntityWithSecret(nick, secret, validFor)
+	if err == nil {
+		err = unlockEntity(entity)
+	}
+	audit(AuditEntityUnlocked, nick, Actor{ValidFor: validFor}, err, map[string]string{"with": "secret"})
+	return err
+}
+
+// readEntityWithSecret reads the entity for nick and compares secret with the saved hash of the secret
+// the rate limit and the lock after wrong secrets (or recovery codes) are checked; a wrong secret is counted
+func readEntityWithSecret(nick, secret, validFor string) (*Entity, error) {
+	entity, err := readEntityForRecovery(nick, validFor, ErrInvalidSecret)
+	if err != nil {
+		return nil, err
+	}
+	// compare given secret with saved hash of secret
+	ok, needsRehash, err := verifyHash(entity.SecretHash, secret)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, failRecovery(entity, validFor, ErrInvalidSecret)
+	}
+	// the entity is saved by the caller, so an outdated hash of the secret is replaced
+	entity.SecretHash = rehash(entity.SecretHash, secret, needsRehash)
+	return entity, nil
+}
+
+// readEntityForRecovery checks the rate limit of a reset or an unlock and reads the entity for nick
+// a lock after wrong passwords doesn't matter, but a lock after wrong secrets or recovery codes.
+// For an unknown nick invalid is returned, the error of a wrong secret or code (both wrap ErrInvalidCredentials)
+func readEntityForRecovery(nick, validFor string, invalid error) (*Entity, error) {
+	// check rate limit of client and nick (also for unknown nicks)
+	err := checkSignInRateLimit(nick, validFor)
+	if err != nil {
+		return nil, err
+	}
+	// read complete entity by nick
+	entity, err := Db.ReadEntityByNick(nick)
+	if err != nil {
+		if errors.Is(err, ErrEntityNotFound) {
+			// don't reveal that the nick doesn't exist
+			return nil, invalid
+		}
+		return nil, err
+	}
+	// an entity deactivated by the administrator stays inactive
+	if !entity.Active {
+		return nil, ErrEntityInactive
+	}
+	// check if entity is locked because of wrong secrets (before the expensive check of the secret)
+	lockedUntil := entity.RecoveryLockedUntil()
+	if time.Now().Before(lockedUntil) {
+		return nil, &LockedError{Until: lockedUntil}
+	}
+	return entity, nil
+}
+
+// failRecovery counts a wrong secret (or recovery code) and saves the failed attempt
+// it returns cause or a LockedError, if resets and unlocks are locked now
+func failRecovery(entity *Entity, validFor string, cause error) error {
+	entity.WrongSecretCounter++
+	entity.LastSecretAttempt = time.Now().UTC()
+	err := Db.SaveEntity(entity)
+	if err != nil {
+		return err
+	}
+	// lock entity because of multiple wrong attempts
+	lockedUntil := entity.RecoveryLockedUntil()
+	if time.Now().Before(lockedUntil) {
+		audit(AuditEntityLocked, entity.Nick, Actor{ValidFor: validFor}, nil, map[string]string{"lockedUntil": lockedUntil.Format(time.RFC3339), "by": "secret"})
+		return &LockedError{Until: lockedUntil}
+	}
+	return cause
+}
+
+// resetPassword sets a new generated password for entity, unlocks and saves it
+// all identity tokens and sessions of the entity are revoked, so a stolen session ends with the reset
+func resetPassword(entity *Entity) (string, error) {
+	newPassword := generatePassword(32)
+	hash, err := HashPassword(newPassword)
+	if err != nil {
+		return "", err
+	}
+	entity.replacePasswordHash(hash)
+	err = unlockEntity(entity)
+	if err != nil {
+		return "", err
+	}
+	err = RevokeAllIdentityTokensForNick(entity.Nick)
+	if err != nil {
+		return "", err
+	}
+	return newPassword, nil
+}
+
+// recoveryCodeMutex serializes the use of recovery codes, so that a code can't be used twice by concurrent requests
+var recoveryCodeMutex sync.Mutex
+
+// GenerateRecoveryCodes generates new recovery codes for the entity of nick, the previous codes are invalid
+// the codes are returned only once, the entity only keeps their hashes
+func GenerateRecoveryCodes(nick string) ([]string, error) {
+	const recoveryCodeCount = 10
+	recoveryCodeMutex.Lock()
+	defer recoveryCodeMutex.Unlock()
+	entity, err := Db.ReadEntityByNick(nick)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	entity.RecoveryCodeHashes = make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = generateRecoveryCode()
+		entity.RecoveryCodeHashes[i], err = HashPassword(normalizeRecoveryCode(codes[i]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	entity.UpdateTimeStamp = time.Now().UTC()
+	err = Db.SaveEntity(entity)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// ResetPasswordWithRecoveryCode works like ResetPassword, but uses a recovery code instead of the secret
+// the recovery code can't be used again
+func ResetPasswordWithRecoveryCode(nick, code, validFor string) (newPassword string, err error) {
+	recoveryCodeMutex.Lock()
+	defer recoveryCodeMutex.Unlock()
+	// read entity and use recovery code
+	entity, err := readEntityWithRecoveryCode(nick, code, validFor)
+	if err == nil {
+		// save entity with the remaining recovery codes
+		newPassword, err = resetPassword(entity)
+	}
+	audit(AuditPasswordReset, nick, Actor{ValidFor: validFor}, err, map[string]string{"with": "recoveryCode"})
+	return newPassword, err
+}
+
+// UnlockEntityWithRecoveryCode works like UnlockEntity, but uses a recovery code instead of the secret
+// the recovery code can't be used again
+func UnlockEntityWithRecoveryCode(nick, code, validFor string) error {
+	recoveryCodeMutex.Lock()
+	defer recoveryCodeMutex.Unlock()
+	// read entity and use recovery code
+	entity, err := readEntityWithRecoveryCode(nick, code, validFor)
+	if err == nil {
+		// save entity with the remaining recovery codes
+		err = unlockEntity(entity)
+	}
+	audit(AuditEntityUnlocked, nick, Actor{ValidFor: validFor}, err, map[string]string{"with": "recoveryCode"})
+	return err
+}
+
+// readEntityWithRecoveryCode reads the entity for nick and removes the hash of code from its recovery codes
+// rate limit, lock and wrong codes are handled like in readEntityWithSecret
+// the entity isn't saved, the caller must hold recoveryCodeMutex
+func readEntityWithRecoveryCode(nick, code, validFor string) (*Entity, error) {
+	entity, err := readEntityForRecovery(nick, validFor, ErrInvalidRecoveryCode)
+	if err != nil {
+		return nil, err
+	}
+	// compare given code with saved hashes of the recovery codes
+	code = normalizeRecoveryCode(code)
+	for i, hash := range entity.RecoveryCodeHashes {
+		if ok, _, _ := verifyHash(hash, code); ok {
+			entity.RecoveryCodeHashes = append(entity.RecoveryCodeHashes[:i:i], entity.RecoveryCodeHashes[i+1:]...)
+			return entity, nil
+		}
+	}
+	return nil, failRecovery(entity, validFor, ErrInvalidRecoveryCode)
+}
+
+// normalizeRecoveryCode removes separators and spaces and converts to upper case, so that 4kz7q m2pxw is accepted too
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// unlockEntity clears the counters of wrong passwords and secrets and saves the entity
+func unlockEntity(entity *Entity) error {
+	entity.WrongPasswordCounter = 0
+	entity.WrongSecretCounter = 0
+	entity.UpdateTimeStamp = time.Now().UTC()
+	return Db.SaveEntity(entity)
+}
+
+// DeactivateEntity deactivates the entity of nick and revokes all its identity tokens
+func DeactivateEntity(nick string) error {
+	return DeactivateEntityBy(Actor{}, nick)
+}
+
+// DeactivateEntityBy deactivates an entity like DeactivateEntity, actor is recorded in the audit event
+func DeactivateEntityBy(actor Actor, nick string) error {
+	err := deactivateEntity(nick)
+	audit(AuditEntityUpdated, nick, actor, err, map[string]string{"active": "false"})
+	return err
+}
+
+// deactivateEntity deactivates the entity of nick and revokes all its identity tokens (without audit event)
+func deactivateEntity(nick string) error {
+	entity, err := Db.ReadEntityByNick(nick)
+	if err != nil {
+		return err
+	}
+	entity.Active = false
+	entity.UpdateTimeStamp = time.Now().UTC()
+	err = Db.SaveEntity(entity)
+	if err != nil {
+		return err
+	}
+	return RevokeAllIdentityTokensForNick(nick)
+}
+
+// DeleteEntity deletes the entity of nick from Db and revokes all its identity tokens
+func DeleteEntity(nick string) error {
+	return DeleteEntityBy(Actor{}, nick)
+}
+
+// DeleteEntityBy deletes an entity like DeleteEntity, actor is recorded in the audit event
+func DeleteEntityBy(actor Actor, nick string) error {
+	err := Db.DeleteEntity(nick)
+	if err == nil {
+		err = RevokeAllIdentityTokensForNick(nick)
+	}
+	audit(AuditEntityDeleted, nick, actor, err, nil)
+	return err
+}
+
+// LockedUntil returns the end of the lock after too many wrong passwords (zero time, if the entity isn't locked)
+// the lock starts with the last sign in attempt, it's doubled for every further wrong password
+func (e *Entity) LockedUntil() time.Time {
+	return lockedUntil(e.WrongPasswordCounter, e.LastSignInAttempt)
+}
+
+// RecoveryLockedUntil returns the end of the lock of resets and unlocks after too many wrong secrets or recovery codes
+// the lock is computed like LockedUntil
+func (e *Entity) RecoveryLockedUntil() time.Time {
+	return lockedUntil(e.WrongSecretCounter, e.LastSecretAttempt)
+}
+
+// lockedUntil returns the end of the lock after counter wrong attempts, the last one at lastAttempt
+func lockedUntil(counter int, lastAttempt time.Time) time.Time {
+	excess := counter - Configuration.MaxSignInAttempts
+	if excess <= 0 || Configuration.LockoutSeconds <= 0 {
+		return time.Time{}
+	}
+	lockout := time.Second * time.Duration(Configuration.LockoutSeconds)
+	maxLockout := time.Second * time.Duration(Configuration.LockoutMaxSeconds)
+	for i := 1; i < excess && lockout < maxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > maxLockout {
+		lockout = maxLockout
+	}
+	return lastAttempt.Add(lockout)
+}
+
+// PasswordExpiresAt returns the end of the validity of the password (zero time, if passwords don't expire)
+// passwords of entities without PasswordChangedAt (created by older versions) expire relative to CreateTimeStamp
+func (e *Entity) PasswordExpiresAt() time.Time {
+	if Configuration.PasswordMaxAgeDays <= 0 {
+		return time.Time{}
+	}
+	changedAt := e.PasswordChangedAt
+	if changedAt.IsZero() {
+		changedAt = e.CreateTimeStamp
+	}
+	return changedAt.AddDate(0, 0, Configuration.PasswordMaxAgeDays)
+}
+
+// PasswordExpired reports if the password has to be changed before the next sign in
+func (e *Entity) PasswordExpired() bool {
+	expiresAt := e.PasswordExpiresAt()
+	return !expiresAt.IsZero() && !time.Now().Before(expiresAt)
 }
 
 // toPublicEntity converts an EntityStruct to PublicEntity
@@ -291,6 +966,10 @@ func (e *Entity) toPublicEntity() PublicEntity {
 		CreateTimeStamp:      e.CreateTimeStamp,
 		UpdateTimeStamp:      e.UpdateTimeStamp,
 		Roles:                e.Roles,
+		TOTPEnabled:          e.TOTPEnabled,
+		RecoveryCodes:        len(e.RecoveryCodeHashes),
+		PasswordChangedAt:    e.PasswordChangedAt,
+		MustChangePassword:   e.MustChangePassword,
 	}
 }
 
@@ -307,6 +986,8 @@ func (ne *NewEntityStruct) toEntity() Entity {
 		CreateTimeStamp:      ne.CreateTimeStamp,
 		UpdateTimeStamp:      ne.UpdateTimeStamp,
 		Roles:                ne.Roles,
+		PasswordChangedAt:    ne.CreateTimeStamp,
+		MustChangePassword:   ne.MustChangePassword,
 	}
 }
 
@@ -326,6 +1007,21 @@ type EntityToken struct {
 
 // NewEntityToken creates a new entity token (token itself and validity, comming from configuration)
 func NewEntityToken() (EntityToken, error) {
+	return NewEntityTokenBy(Actor{})
+}
+
+// NewEntityTokenBy creates a new entity token like NewEntityToken, actor is recorded in the audit event
+func NewEntityTokenBy(actor Actor) (EntityToken, error) {
+	et, err := newEntityToken()
+	audit(AuditEntityTokenIssued, "", actor, err, map[string]string{
+		"entityToken": hashToken(et.Token),
+		"validUntil":  et.ValidUntil.Format(time.RFC3339),
+	})
+	return et, err
+}
+
+// newEntityToken creates and saves a new entity token (without audit event)
+func newEntityToken() (EntityToken, error) {
 	// set end of validity
 	hours := Configuration.EntityTokenValidityHours // number of hours the entity token is valid
 	validUntil := time.Now().UTC().Add(time.Hour * time.Duration(hours))
@@ -338,197 +1034,30 @@ func NewEntityToken() (EntityToken, error) {
 	return et, err
 }
 
-/********************************************************************
-	IDENTITY TOKEN CACHE
-	An identity token is provides after authentication with
-	nick and password. For the subsequent actions (e.g. API calls)
-	the client (API consumer) is only using the identity token
-	instead of the credentials (nick and password).
-	So an identity token completely different than the entity token.
-********************************************************************/
-
-// identityTokenCacheItemStruct describes on record of the internal list of provided identity tokens
-type (
-	identityTokenCacheItemStruct struct {
-		Token      string
-		ValidUntil time.Time
-		ValidFor   string // identification of the caller, e.g. the IP
-		Nick       string
-	}
-
-	// identityTokenCacheItemSlice describes the internal list of provided identity tokens
-	identityTokenCacheItemSlice []identityTokenCacheItemStruct
-
-	// identityTokenCacheType is the actual type of the cache for identity tokens
-	identityTokenCacheType struct {
-		Cache identityTokenCacheItemSlice
-	}
-
-	// identityTokenStruct is the type for the identity token send to the client, containing the actual token and validUntil
-	identityTokenStruct struct {
-		Token      string    `json:"token"`
-		ValidUntil time.Time `json:"validUntil"`
-	}
-)
-
-var identityTokenCache identityTokenCacheType
-
-// add a new token to the identity token cache
-func (itc *identityTokenCacheType) add(token string, validUntil time.Time, validFor, nick string) {
-	now := time.Now().UTC()
-	emptyIdentityToken := identityTokenCacheItemStruct{}
-	newIdentityToken := identityTokenCacheItemStruct{
-		Token:      token,
-		ValidUntil: validUntil,
-		ValidFor:   validFor,
-		Nick:       nick,
-	}
-	placed := false
-
-	for i, token := range identityTokenCache.Cache {
-		// invalidate token that ran out of validity (by setting it empty)
-		if token.ValidUntil.Before(now) {
-			identityTokenCache.Cache[i] = emptyIdentityToken
-		}
-		// put new token at first empty position
-		if !placed && token == emptyIdentityToken {
-			identityTokenCache.Cache[i] = newIdentityToken
-			placed = true
-		}
-	}
-
-	if !placed {
-		itc.Cache = append(itc.Cache, newIdentityToken)
-	}
-}
-
-// isIdentityTokenValid checks if an identity token is valid
-func (itc identityTokenCacheType) isIdentityTokenValid(tokenToTest string, validFor string) bool {
-	if len(tokenToTest) == 0 {
-		return false
-	}
-
-	now := time.Now().UTC()
-	emptyIdentityToken := identityTokenCacheItemStruct{}
-
-	// ToDo: Change identityTokenCacheType from slice to map??
-	for i, identityTokenFromCache := range identityTokenCache.Cache {
-		// ToDo: Change identityTokenCache to itc
-		if identityTokenFromCache == emptyIdentityToken {
-			continue
-		}
-		// invalidate token that ran out of validity (by setting it empty)
-		if identityTokenFromCache.ValidUntil.Before(now) {
-			identityTokenCache.Cache[i] = emptyIdentityToken
-			continue
-		}
-		// check if tokens are equal
-		if identityTokenCache.Cache[i].Token == tokenToTest {
-			// check if client's address is correct
-			if identityTokenFromCache.ValidFor == validFor {
-				return true
-			}
-		}
-	}
-	return false
-}
-
-// getNick returns the nick for an identity token
-func (itc identityTokenCacheType) getNick(token string) (nick string) {
-	// ToDo: Switch itc.Cache to map??
-	for i := range itc.Cache {
-		// check if tokens are equal
-		if identityTokenCache.Cache[i].Token == token {
-			nick = identityTokenCache.Cache[i].Nick
-			return nick
-		}
+// ReadEntityTokens returns all entity tokens, that were not used to create an entity yet
+func ReadEntityTokens() ([]EntityToken, error) {
+	entityTokens, err := Db.readEntityTokenList()
+	if err != nil {
+		return nil, err
 	}
-	return ""
+	sort.Slice(entityTokens, func(i, j int) bool {
+		return entityTokens[i].ValidUntil.Before(entityTokens[j].ValidUntil)
+	})
+	return entityTokens, nil
 }
 
 /********************************************************************
-	Crypto functions and generators
+	Crypto functions
 ********************************************************************/
-var tokenChars = []byte(`123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz.,-+#(){}[];:_#*!$%=?|@~`)
-var nickChars = []byte("123456789ABCDEFGHJKLMNPQRSTUVWXYZ")
-var passwordChars = []byte("123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz.,-+#")
 
-// Hash calculates 'hash' for 'original' using bcrypt
+// Hash calculates 'hash' for 'original' using the configured PasswordHasher
+// it panics, if the hash can't be calculated
+//
+// Deprecated: use HashPassword, that returns the error
 func Hash(original string) string {
-	hash, err := bcrypt.GenerateFromPassword([]byte(original), bcrypt.DefaultCost)
+	hash, err := HashPassword(original)
 	if err != nil {
 		panic(err)
 	}
-	return string(hash)
-}
-
-// generateIdentityToken generates a identity token
-func generateIdentityToken() string {
-	const tokenLength = 24
-	password := make([]byte, tokenLength)
-	for i := range password {
-		password[i] = tokenChars[rand.Intn(len(tokenChars))]
-	}
-	return string(password)
-}
-
-// generateNick generates a nick
-func generateNick() string {
-	const nickLength = 8
-	nick := make([]byte, nickLength)
-	for i := range nick {
-		nick[i] = nickChars[rand.Intn(len(nickChars))]
-	}
-	return string(nick)
-}
-
-// generatePin generates a PIN
-func generatePin() string {
-	const pinLength = 6
-	pin := make([]byte, pinLength)
-	for i := range pin {
-		pin[i] = nickChars[rand.Intn(len(nickChars))]
-	}
-	return string(pin)
-}
-
-// generatePassword generates a password
-func generatePassword(length int) string {
-	password := make([]byte, length)
-	for i := range password {
-		password[i] = passwordChars[rand.Intn(len(passwordChars))]
-	}
-	return string(password)
-}
-
-// generateEntityToken generates a valid entity token
-func generateEntityToken() string {
-	const tokenLength = 32
-	token := make([]byte, tokenLength)
-	for i := range token {
-		token[i] = nickChars[rand.Intn(len(nickChars))]
-	}
-	return string(token)
-}
-
-// random 128-bit Id of the server
-type ServerId [2]uint64
-
-// New generates a new ServerId
-func (id *ServerId) New() {
-	id[0] = rand.Uint64()
-	id[1] = rand.Uint64()
-}
-
-// Stringer for ServerId
-func (id *ServerId) String() string {
-	a := id[0] & 0xffff
-	b := id[0] >> 16 & 0xffff
-	c := id[0] >> 32 & 0xffff
-	d := id[0] >> 48 & 0xffff
-	e := id[1] & 0xffff
-	f := id[1] >> 16 & 0xffff
-	g := id[1] >> 32 & 0xffff
-	h := id[1] >> 48 & 0xffff
-	return fmt.Sprintf("%04x.%04x.%04x.%04x-%04x.%04x.%04x.%04x", h, g, f, e, d, c, b, a)
+	return hash
 }
@@ -0,0 +1,180 @@
+package embiam
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/********************************************************************
+	AUDIT
+	embiam emits an audit event for security relevant actions:
+	sign in (successful or failed), locking of entities after
+	wrong passwords, issuing and redeeming entity tokens, changes
+	of entities, passwords, roles and default roles, password resets,
+	unlocks and enabling or disabling TOTP. Every event contains
+	the outcome and the client (validFor) of the action.
+
+	The events are written to audit sinks, see SetAuditSinks.
+	embiam provides sinks for files (JSON lines) and for memory.
+
+		sink, err := embiam.NewFileAuditSink("audit.log")
+		...
+		embiam.SetAuditSinks(sink)
+
+	Administrative functions have variants with an Actor, e.g.
+	SaveRolesBy, so that the event shows who changed the roles.
+********************************************************************/
+
+type (
+	// AuditEventType describes the action of an audit event
+	AuditEventType string
+
+	// AuditOutcome is the result of the action of an audit event
+	AuditOutcome string
+
+	// AuditEvent describes a security relevant action
+	AuditEvent struct {
+		Time     time.Time         `json:"time"`
+		Type     AuditEventType    `json:"type"`
+		Outcome  AuditOutcome      `json:"outcome"`
+		Nick     string            `json:"nick,omitempty"`    // entity affected by the action
+		Actor    string            `json:"actor,omitempty"`   // nick of the entity performing the action
+		ValidFor string            `json:"validFor"`          // identification of the client, e.g. the IP
+		Reason   string            `json:"reason,omitempty"`  // error of failed actions
+		Details  map[string]string `json:"details,omitempty"` // additional information depending on the type
+	}
+
+	// Actor identifies who performs an action: the nick (if known) and the client (validFor)
+	Actor struct {
+		Nick     string
+		ValidFor string
+	}
+
+	// AuditSink receives the audit events
+	AuditSink interface {
+		WriteAuditEvent(event AuditEvent) error
+	}
+)
+
+const (
+	AuditSignIn              AuditEventType = "signIn"
+	AuditEntityLocked        AuditEventType = "entityLocked"
+	AuditEntityTokenIssued   AuditEventType = "entityTokenIssued"
+	AuditEntityTokenRedeemed AuditEventType = "entityTokenRedeemed"
+	AuditEntityCreated       AuditEventType = "entityCreated"
+	AuditEntityUpdated       AuditEventType = "entityUpdated"
+	AuditEntityDeleted       AuditEventType = "entityDeleted"
+	AuditPasswordChanged     AuditEventType = "passwordChanged"
+	AuditPasswordReset       AuditEventType = "passwordReset"
+	AuditEntityUnlocked      AuditEventType = "entityUnlocked"
+	AuditRolesSaved          AuditEventType = "rolesSaved"
+	AuditDefaultRolesSaved   AuditEventType = "defaultRolesSaved"
+	AuditTOTPEnabled         AuditEventType = "totpEnabled"
+	AuditTOTPDisabled        AuditEventType = "totpDisabled"
+
+	AuditSuccess AuditOutcome = "success"
+	AuditFailure AuditOutcome = "failure"
+)
+
+var (
+	auditSinks      []AuditSink
+	auditSinksMutex sync.RWMutex
+)
+
+// SetAuditSinks replaces the sinks, that receive the audit events (no sinks switch the audit off)
+func SetAuditSinks(sinks ...AuditSink) {
+	auditSinksMutex.Lock()
+	defer auditSinksMutex.Unlock()
+	auditSinks = sinks
+}
+
+// audit sends an event to all sinks, the outcome depends on err
+// errors of the sinks are logged, they don't stop the action
+func audit(eventType AuditEventType, nick string, actor Actor, err error, details map[string]string) {
+	auditSinksMutex.RLock()
+	defer auditSinksMutex.RUnlock()
+	if len(auditSinks) == 0 {
+		return
+	}
+	event := AuditEvent{
+		Time:     time.Now().UTC(),
+		Type:     eventType,
+		Outcome:  AuditSuccess,
+		Nick:     nick,
+		Actor:    actor.Nick,
+		ValidFor: actor.ValidFor,
+		Details:  details,
+	}
+	if err != nil {
+		event.Outcome = AuditFailure
+		event.Reason = err.Error()
+	}
+	for _, sink := range auditSinks {
+		sinkErr := sink.WriteAuditEvent(event)
+		if sinkErr != nil {
+			log.Printf("Error writing audit event %s: %s\n", eventType, sinkErr)
+		}
+	}
+}
+
+/********************************************************************
+	AUDIT SINKS
+********************************************************************/
+
+// FileAuditSink appends the audit events as JSON lines to a file
+type FileAuditSink struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// NewFileAuditSink opens (or creates) the file path to append audit events
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{file: file}, nil
+}
+
+// WriteAuditEvent appends event as one line of json
+func (s *FileAuditSink) WriteAuditEvent(event AuditEvent) error {
+	jsonBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.file.Write(append(jsonBytes, '\n'))
+	return err
+}
+
+// Close closes the file
+func (s *FileAuditSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// MemoryAuditSink keeps the audit events in memory, e.g. for tests
+type MemoryAuditSink struct {
+	mutex  sync.Mutex
+	events []AuditEvent
+}
+
+// WriteAuditEvent adds event to the events in memory
+func (s *MemoryAuditSink) WriteAuditEvent(event AuditEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// Events returns a copy of all received events
+func (s *MemoryAuditSink) Events() []AuditEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]AuditEvent{}, s.events...)
+}
@@ -0,0 +1,94 @@
+package embiam
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	const testNick = `N1CK0001`
+
+	// initialize embiam with memory sink and file sink
+	Initialize(new(DbTransient))
+	Configuration.MaxSignInAttempts = 1
+	dir, err := ioutil.TempDir("", "embiam")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() returned error %s; want temporary directory\n", err)
+	}
+	defer os.RemoveAll(dir)
+	fileSink, err := NewFileAuditSink(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatalf("NewFileAuditSink(...) returned error %s; want file sink\n", err)
+	}
+	memorySink := new(MemoryAuditSink)
+	SetAuditSinks(memorySink, fileSink)
+	defer SetAuditSinks()
+
+	// actions
+	admin := Actor{Nick: `ADM1N`, ValidFor: `192.0.2.9`}
+	entityToken, _ := NewEntityTokenBy(admin)
+	newEntity, _ := RedeemEntityToken(entityToken.Token, entityToken.Pin, testHost)
+	CheckIdentity(newEntity.Nick, newEntity.Password, testHost)
+	CheckIdentity(newEntity.Nick, `wrong`, testHost)
+	CheckIdentity(newEntity.Nick, `wrong`, testHost)
+	UnlockEntity(newEntity.Nick, newEntity.Secret, testHost)
+	ResetPassword(newEntity.Nick, `wrong`, testHost)
+	SaveRolesBy(admin, GetRoles())
+	SaveDefaultRolesBy(admin, []RoleIdType{`unknown`})
+	DeleteEntityBy(admin, newEntity.Nick)
+
+	// check events
+	want := []AuditEvent{
+		{Type: AuditEntityTokenIssued, Outcome: AuditSuccess, Actor: admin.Nick, ValidFor: admin.ValidFor},
+		{Type: AuditEntityTokenRedeemed, Outcome: AuditSuccess, Nick: newEntity.Nick, ValidFor: testHost},
+		{Type: AuditSignIn, Outcome: AuditSuccess, Nick: newEntity.Nick, ValidFor: testHost},
+		{Type: AuditSignIn, Outcome: AuditFailure, Nick: newEntity.Nick, ValidFor: testHost},
+		{Type: AuditEntityLocked, Outcome: AuditSuccess, Nick: newEntity.Nick, ValidFor: testHost},
+		{Type: AuditSignIn, Outcome: AuditFailure, Nick: newEntity.Nick, ValidFor: testHost},
+		{Type: AuditEntityUnlocked, Outcome: AuditSuccess, Nick: newEntity.Nick, ValidFor: testHost},
+		{Type: AuditPasswordReset, Outcome: AuditFailure, Nick: newEntity.Nick, ValidFor: testHost},
+		{Type: AuditRolesSaved, Outcome: AuditSuccess, Actor: admin.Nick, ValidFor: admin.ValidFor},
+		{Type: AuditDefaultRolesSaved, Outcome: AuditFailure, Actor: admin.Nick, ValidFor: admin.ValidFor},
+		{Type: AuditEntityDeleted, Outcome: AuditSuccess, Nick: newEntity.Nick, Actor: admin.Nick, ValidFor: admin.ValidFor},
+	}
+	events := memorySink.Events()
+	if len(events) != len(want) {
+		t.Fatalf("memorySink.Events() returned %d events; want %d\n", len(events), len(want))
+	}
+	for i, event := range events {
+		if event.Type != want[i].Type || event.Outcome != want[i].Outcome || event.Nick != want[i].Nick || event.Actor != want[i].Actor || event.ValidFor != want[i].ValidFor {
+			t.Errorf("event %d is %v; want %v\n", i, event, want[i])
+		}
+		if event.Time.IsZero() || (event.Outcome == AuditFailure) != (event.Reason != "") {
+			t.Errorf("event %d is %v; want time and reason for failures\n", i, event)
+		}
+	}
+	if events[0].Details["entityToken"] == "" || events[0].Details["entityToken"] != events[1].Details["entityToken"] {
+		t.Errorf("entity token events have details %v and %v; want the same hash of the entity token\n", events[0].Details, events[1].Details)
+	}
+
+	// the file contains the same events as JSON lines
+	fileSink.Close()
+	file, _ := os.Open(filepath.Join(dir, "audit.log"))
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	i := 0
+	for scanner.Scan() {
+		event := AuditEvent{}
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			t.Errorf("line %d of audit file can't be unmarshalled: %s\n", i, err)
+		}
+		if i < len(events) && event.Type != events[i].Type {
+			t.Errorf("line %d of audit file has type %s; want %s\n", i, event.Type, events[i].Type)
+		}
+		i++
+	}
+	if i != len(events) {
+		t.Errorf("audit file has %d lines; want %d\n", i, len(events))
+	}
+}
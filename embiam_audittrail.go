@@ -0,0 +1,396 @@
+package embiam
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/********************************************************************
+	AUDIT TRAIL
+	The audit trail is a tamper-evident audit sink. The events are
+	appended as JSON lines to a file in the audit directory (see
+	DbFile.AuditPath). Every record contains the SHA-256 of the
+	previous line and is signed with an Ed25519 key, that belongs
+	to Configuration.ServerId. The private keys are kept in a key
+	directory outside of the audit directory, a new key is generated
+	for a new ServerId. The key directory also contains the public
+	keys (publicKeys.json) and the sequence number and hash of the
+	last record (head.json).
+
+		trail, err := embiam.OpenAuditTrail(db.AuditPath, "/etc/myapp/auditkey/")
+		...
+		embiam.SetAuditSinks(trail)
+
+	VerifyAuditTrail checks the chain and the signatures with the
+	public keys and reports the first broken link; the head reveals
+	removed records at the end (see cmd/verifyaudittrail).
+	A line looks like
+
+		{"record":{"seq":1,"prev":"","serverId":"...","event":{...}},"sig":"..."}
+********************************************************************/
+
+const (
+	auditTrailFilename           = "trail.jsonl"
+	auditTrailKeyFileExtension   = ".key"
+	auditTrailPublicKeysFilename = "publicKeys.json"
+	auditTrailHeadFilename       = "head.json"
+)
+
+// ErrAuditTrailBroken is wrapped by AuditTrailError
+var ErrAuditTrailBroken = errors.New("audit trail is broken")
+
+type (
+	// AuditTrail appends signed and hash-chained audit events to a file
+	AuditTrail struct {
+		mutex    sync.Mutex
+		file     *os.File
+		sequence uint64 // sequence number of the last record
+		lastHash string // SHA-256 of the last line
+		serverId string
+		key      ed25519.PrivateKey
+		keyDir   string
+	}
+
+	// AuditTrailKeySet contains the public keys to verify an audit trail (key is the ServerId)
+	AuditTrailKeySet map[string]ed25519.PublicKey
+
+	// AuditTrailHead is the last record of an audit trail, it's saved in the key directory
+	AuditTrailHead struct {
+		Sequence uint64 `json:"seq"`
+		Hash     string `json:"hash"` // SHA-256 of the last line
+	}
+
+	// AuditTrailError describes the first broken link of an audit trail
+	AuditTrailError struct {
+		Line   int // line number, starting with 1
+		Reason string
+	}
+
+	// auditTrailLineStruct is a line of the audit trail, the signature covers the raw record
+	auditTrailLineStruct struct {
+		Record    json.RawMessage `json:"record"`
+		Signature string          `json:"sig"`
+	}
+
+	// auditTrailRecordStruct is the signed content of a line
+	auditTrailRecordStruct struct {
+		Sequence     uint64     `json:"seq"`
+		PreviousHash string     `json:"prev"`
+		ServerId     string     `json:"serverId"`
+		Event        AuditEvent `json:"event"`
+	}
+
+	// auditTrailKeyStruct is a signing key of the audit trail, saved in the key directory
+	auditTrailKeyStruct struct {
+		ServerId   string `json:"serverId"`
+		PrivateKey []byte `json:"privateKey"`
+	}
+)
+
+func (e *AuditTrailError) Error() string {
+	return fmt.Sprintf("%s in line %d: %s", ErrAuditTrailBroken, e.Line, e.Reason)
+}
+
+func (e *AuditTrailError) Unwrap() error {
+	return ErrAuditTrailBroken
+}
+
+// OpenAuditTrail opens the audit trail in directory dir to append events
+// the records are signed with the key of Configuration.ServerId in keyDir, it's created if required.
+// keyDir must not be inside of dir
+func OpenAuditTrail(dir, keyDir string) (*AuditTrail, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	absKeyDir, err := filepath.Abs(keyDir)
+	if err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(absDir, absKeyDir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, errors.New("key directory of the audit trail must be outside of the audit directory")
+	}
+	err = InitializeDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(keyDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	// remove temporary files of interrupted writes of the head or a key
+	err = removeTempFiles(keyDir)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readAuditTrailKey(keyDir, Configuration.ServerId)
+	if err != nil {
+		return nil, err
+	}
+	at := &AuditTrail{serverId: Configuration.ServerId, key: key, keyDir: keyDir}
+
+	// continue the chain after the last line
+	path := filepath.Join(dir, auditTrailFilename)
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	lines := bytes.Split(bytes.TrimSuffix(content, []byte("\n")), []byte("\n"))
+	if lastLine := lines[len(lines)-1]; len(lastLine) > 0 {
+		line := auditTrailLineStruct{}
+		record := auditTrailRecordStruct{}
+		err = json.Unmarshal(lastLine, &line)
+		if err == nil {
+			err = json.Unmarshal(line.Record, &record)
+		}
+		if err != nil {
+			return nil, &AuditTrailError{Line: len(lines), Reason: "can't read last record: " + err.Error()}
+		}
+		at.sequence = record.Sequence
+		at.lastHash = hashAuditTrailLine(lastLine)
+	}
+	// don't continue a truncated trail
+	head, err := ReadAuditTrailHead(keyDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if head.Sequence > at.sequence {
+		return nil, &AuditTrailError{Line: int(at.sequence) + 1, Reason: fmt.Sprintf("trail is truncated, %d records are missing", head.Sequence-at.sequence)}
+	}
+
+	at.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return at, nil
+}
+
+// PublicKey returns the public key of the audit trail
+func (at *AuditTrail) PublicKey() ed25519.PublicKey {
+	return at.key.Public().(ed25519.PublicKey)
+}
+
+// WriteAuditEvent appends event as signed record, that is chained to the previous record
+func (at *AuditTrail) WriteAuditEvent(event AuditEvent) error {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	recordBytes, err := json.Marshal(auditTrailRecordStruct{
+		Sequence:     at.sequence + 1,
+		PreviousHash: at.lastHash,
+		ServerId:     at.serverId,
+		Event:        event,
+	})
+	if err != nil {
+		return err
+	}
+	lineBytes, err := json.Marshal(auditTrailLineStruct{
+		Record:    recordBytes,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(at.key, recordBytes)),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = at.file.Write(append(lineBytes, '\n'))
+	if err == nil {
+		err = at.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	at.sequence++
+	at.lastHash = hashAuditTrailLine(lineBytes)
+
+	// save the head outside of the trail
+	headBytes, err := json.Marshal(AuditTrailHead{Sequence: at.sequence, Hash: at.lastHash})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(at.keyDir, auditTrailHeadFilename), headBytes, 0600)
+}
+
+// Close closes the file of the audit trail
+func (at *AuditTrail) Close() error {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+	return at.file.Close()
+}
+
+// VerifyAuditTrail checks the chain and the signatures of the audit trail in directory dir with the public keys
+// it returns the number of records; if the trail is broken, the error is an AuditTrailError with the first broken link.
+// Records after head are accepted, but the trail must contain the record of head (a zero head isn't checked)
+func VerifyAuditTrail(dir string, keys AuditTrailKeySet, head AuditTrailHead) (int, error) {
+	file, err := os.Open(filepath.Join(dir, auditTrailFilename))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	previousHash := ""
+	lineNumber := 0
+	reader := bufio.NewReader(file)
+	for {
+		lineBytes, err := reader.ReadBytes('\n')
+		if err != nil && len(lineBytes) == 0 {
+			break
+		}
+		lineNumber++
+		if err != nil {
+			return lineNumber - 1, &AuditTrailError{Line: lineNumber, Reason: "incomplete line"}
+		}
+		lineBytes = bytes.TrimSuffix(lineBytes, []byte("\n"))
+
+		// read line and record
+		line := auditTrailLineStruct{}
+		record := auditTrailRecordStruct{}
+		err = json.Unmarshal(lineBytes, &line)
+		if err == nil {
+			err = json.Unmarshal(line.Record, &record)
+		}
+		if err != nil {
+			return lineNumber - 1, &AuditTrailError{Line: lineNumber, Reason: "invalid record: " + err.Error()}
+		}
+		// check chain
+		if record.Sequence != uint64(lineNumber) {
+			return lineNumber - 1, &AuditTrailError{Line: lineNumber, Reason: fmt.Sprintf("sequence number %d, want %d", record.Sequence, lineNumber)}
+		}
+		if record.PreviousHash != previousHash {
+			return lineNumber - 1, &AuditTrailError{Line: lineNumber, Reason: "hash of previous record doesn't match"}
+		}
+		// check signature
+		publicKey, ok := keys[record.ServerId]
+		if !ok {
+			return lineNumber - 1, &AuditTrailError{Line: lineNumber, Reason: "no key for ServerId " + record.ServerId}
+		}
+		signature, err := base64.StdEncoding.DecodeString(line.Signature)
+		if err != nil || !ed25519.Verify(publicKey, line.Record, signature) {
+			return lineNumber - 1, &AuditTrailError{Line: lineNumber, Reason: "invalid signature"}
+		}
+		previousHash = hashAuditTrailLine(lineBytes)
+		// check head
+		if record.Sequence == head.Sequence && previousHash != head.Hash {
+			return lineNumber - 1, &AuditTrailError{Line: lineNumber, Reason: "hash of the head doesn't match"}
+		}
+	}
+	if uint64(lineNumber) < head.Sequence {
+		return lineNumber, &AuditTrailError{Line: lineNumber + 1, Reason: fmt.Sprintf("trail is truncated, %d records are missing", head.Sequence-uint64(lineNumber))}
+	}
+	return lineNumber, nil
+}
+
+// ReadAuditTrailHead reads the head of the audit trail from the key directory
+func ReadAuditTrailHead(keyDir string) (AuditTrailHead, error) {
+	head := AuditTrailHead{}
+	jsonBytes, err := ioutil.ReadFile(filepath.Join(keyDir, auditTrailHeadFilename))
+	if err != nil {
+		return head, err
+	}
+	err = json.Unmarshal(jsonBytes, &head)
+	return head, err
+}
+
+// ExportAuditTrailPublicKeys returns the public keys of all audit trail keys in keyDir as JSON (e.g. for cmd/verifyaudittrail)
+// OpenAuditTrail saves them to publicKeys.json in keyDir, too
+func ExportAuditTrailPublicKeys(keyDir string) ([]byte, error) {
+	filenames, err := filepath.Glob(filepath.Join(keyDir, "*"+auditTrailKeyFileExtension))
+	if err != nil {
+		return nil, err
+	}
+	keys := AuditTrailKeySet{}
+	for _, filename := range filenames {
+		key, err := readAuditTrailKeyFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		keys[key.ServerId] = ed25519.PrivateKey(key.PrivateKey).Public().(ed25519.PublicKey)
+	}
+	return json.MarshalIndent(keys, "", "\t")
+}
+
+// ParseAuditTrailPublicKeys reads the public keys exported by ExportAuditTrailPublicKeys
+func ParseAuditTrailPublicKeys(jsonBytes []byte) (AuditTrailKeySet, error) {
+	keys := AuditTrailKeySet{}
+	err := json.Unmarshal(jsonBytes, &keys)
+	if err != nil {
+		return nil, err
+	}
+	for serverId, publicKey := range keys {
+		if len(publicKey) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid audit trail key for ServerId " + serverId)
+		}
+	}
+	return keys, nil
+}
+
+// readAuditTrailKey reads the signing key of serverId from keyDir
+// a missing key is generated and saved, the public keys are exported to publicKeys.json
+func readAuditTrailKey(keyDir, serverId string) (ed25519.PrivateKey, error) {
+	path := filepath.Join(keyDir, hashToken(serverId)[:32]+auditTrailKeyFileExtension)
+	key, err := readAuditTrailKeyFile(path)
+	if err == nil {
+		if key.ServerId != serverId {
+			return nil, errors.New("invalid audit trail key for ServerId " + serverId)
+		}
+		return ed25519.PrivateKey(key.PrivateKey), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	// create new key
+	_, privateKey, err := ed25519.GenerateKey(randomSource)
+	if err != nil {
+		return nil, err
+	}
+	jsonBytes, err := json.MarshalIndent(auditTrailKeyStruct{ServerId: serverId, PrivateKey: privateKey}, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(path, jsonBytes, 0600)
+	if err != nil {
+		return nil, err
+	}
+	jsonBytes, err = ExportAuditTrailPublicKeys(keyDir)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(filepath.Join(keyDir, auditTrailPublicKeysFilename), jsonBytes, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
+// readAuditTrailKeyFile reads a signing key of the audit trail
+func readAuditTrailKeyFile(path string) (auditTrailKeyStruct, error) {
+	key := auditTrailKeyStruct{}
+	jsonBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return key, err
+	}
+	err = json.Unmarshal(jsonBytes, &key)
+	if err != nil {
+		return key, err
+	}
+	if len(key.PrivateKey) != ed25519.PrivateKeySize {
+		return key, errors.New("invalid audit trail key in " + path)
+	}
+	return key, nil
+}
+
+// hashAuditTrailLine returns the SHA-256 of a line (without newline) as hex
+func hashAuditTrailLine(line []byte) string {
+	hash := sha256.Sum256(line)
+	return hex.EncodeToString(hash[:])
+}
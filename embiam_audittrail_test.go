@@ -0,0 +1,109 @@
+package embiam
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditTrail(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "embiam")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() returned error %s; want temporary directory\n", err)
+	}
+	defer os.RemoveAll(tempDir)
+	dir := filepath.Join(tempDir, "audit")
+	keyDir := filepath.Join(tempDir, "auditkey")
+
+	// the key directory must be outside of the audit directory
+	_, err = OpenAuditTrail(dir, filepath.Join(dir, "key"))
+	if err == nil {
+		t.Errorf("OpenAuditTrail(dir, dir/key) returned no error; want error for key directory in audit directory\n")
+	}
+
+	// write events
+	Initialize(new(DbTransient))
+	trail, err := OpenAuditTrail(dir, keyDir)
+	if err != nil {
+		t.Fatalf("OpenAuditTrail(dir, keyDir) returned error %s; want audit trail\n", err)
+	}
+	SetAuditSinks(trail)
+	defer SetAuditSinks()
+	CheckIdentity(`N1CK0001`, testPassword, testHost)
+	NewEntityToken()
+	trail.Close()
+
+	// reopen with new ServerId (and key), the chain is continued
+	Initialize(new(DbTransient))
+	trail, err = OpenAuditTrail(dir, keyDir)
+	if err != nil {
+		t.Fatalf("OpenAuditTrail(dir, keyDir) returned error %s after restart; want audit trail\n", err)
+	}
+	SetAuditSinks(trail)
+	CheckIdentity(`N1CK0002`, testPassword, testHost)
+	trail.Close()
+
+	// read public keys and head
+	jsonBytes, err := ioutil.ReadFile(filepath.Join(keyDir, auditTrailPublicKeysFilename))
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile() returned error %s; want public keys\n", err)
+	}
+	keys, err := ParseAuditTrailPublicKeys(jsonBytes)
+	if err != nil || len(keys) != 2 || !keys[Configuration.ServerId].Equal(trail.PublicKey()) {
+		t.Fatalf("ParseAuditTrailPublicKeys() returned %v, %v; want public keys of both ServerIds\n", keys, err)
+	}
+	head, err := ReadAuditTrailHead(keyDir)
+	if err != nil || head.Sequence != 3 {
+		t.Fatalf("ReadAuditTrailHead(keyDir) returned %v, %v; want head with sequence number 3\n", head, err)
+	}
+
+	records, err := VerifyAuditTrail(dir, keys, head)
+	if err != nil || records != 3 {
+		t.Errorf("VerifyAuditTrail(dir, keys, head) returned %d, %v; want 3 records without error\n", records, err)
+	}
+
+	// unknown key
+	_, err = VerifyAuditTrail(dir, AuditTrailKeySet{}, head)
+	trailError := &AuditTrailError{}
+	if !errors.As(err, &trailError) || trailError.Line != 1 {
+		t.Errorf("VerifyAuditTrail(dir) returned %v without keys; want broken link in line 1\n", err)
+	}
+
+	// manipulated record
+	path := filepath.Join(dir, auditTrailFilename)
+	original, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, bytes.Replace(original, []byte(`N1CK0002`), []byte(`N1CK0003`), 1), 0600)
+	records, err = VerifyAuditTrail(dir, keys, head)
+	if !errors.As(err, &trailError) || trailError.Line != 3 || records != 2 {
+		t.Errorf("VerifyAuditTrail(dir, keys, head) returned %d, %v for manipulated record; want broken link in line 3\n", records, err)
+	}
+
+	// deleted record
+	lines := bytes.SplitAfter(original, []byte("\n"))
+	ioutil.WriteFile(path, append(append([]byte{}, lines[0]...), lines[2]...), 0600)
+	_, err = VerifyAuditTrail(dir, keys, head)
+	if !errors.As(err, &trailError) || trailError.Line != 2 {
+		t.Errorf("VerifyAuditTrail(dir, keys, head) returned %v for deleted record; want broken link in line 2\n", err)
+	}
+
+	// deleted last record
+	ioutil.WriteFile(path, append(append([]byte{}, lines[0]...), lines[1]...), 0600)
+	records, err = VerifyAuditTrail(dir, keys, head)
+	if !errors.As(err, &trailError) || trailError.Line != 3 || records != 2 {
+		t.Errorf("VerifyAuditTrail(dir, keys, head) returned %d, %v for truncated trail; want broken link in line 3\n", records, err)
+	}
+	_, err = OpenAuditTrail(dir, keyDir)
+	if !errors.Is(err, ErrAuditTrailBroken) {
+		t.Errorf("OpenAuditTrail(dir, keyDir) returned %v for truncated trail; want ErrAuditTrailBroken\n", err)
+	}
+
+	// incomplete last line
+	ioutil.WriteFile(path, original[:len(original)-10], 0600)
+	_, err = VerifyAuditTrail(dir, keys, head)
+	if !errors.Is(err, ErrAuditTrailBroken) {
+		t.Errorf("VerifyAuditTrail(dir, keys, head) returned %v for incomplete line; want ErrAuditTrailBroken\n", err)
+	}
+}
@@ -1,15 +1,21 @@
 package embiam
 
 import (
-	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 )
 
 // initializeAuthorization initializes the authorization sub system
 func initializeAuthorizations() {
 	// load roles
+	roleMutex.Lock()
 	roleCache = RoleCacheMap{}
+	defaultRoles = []RoleIdType{}
+	roleMutex.Unlock()
 	ReadRoles()
+	roleMutex.Lock()
 	if roleCache == nil {
 		roleCache = RoleCacheMap{}
 	}
@@ -33,18 +39,20 @@ func initializeAuthorizations() {
 			},
 		}
 	}
+	roleMutex.Unlock()
 	// load default roles (for new entities)
-	defaultRoles = []RoleIdType{}
-	defaultRoles, _ = Db.readDefaultRoles()
-	if defaultRoles == nil {
-		defaultRoles = []RoleIdType{}
-	}
-	if len(defaultRoles) == 0 {
-		defaultRoles = []RoleIdType{`application`}
+	newDefaultRoles, _ := Db.readDefaultRoles()
+	if len(newDefaultRoles) == 0 {
+		newDefaultRoles = []RoleIdType{`application`}
 	}
+	roleMutex.Lock()
+	defaultRoles = newDefaultRoles
+	roleMutex.Unlock()
 
 	// initialize authorization cache
+	authorizationCacheMutex.Lock()
 	authorizationCache = AuthorizationCacheMap{}
+	authorizationCacheMutex.Unlock()
 }
 
 /********************************************************************
@@ -127,16 +135,19 @@ type (
 var (
 	roleCache    RoleCacheMap // all available roles
 	defaultRoles []RoleIdType // roles automatically assigned to new user
+	roleMutex    sync.RWMutex // roles can be changed at runtime, e.g. with the admin API
 )
 
 // ReadRoles loads the roles newly from Db -- ToDo: Required???
 func ReadRoles() error {
-	var err error
-	roleCache, err = Db.readRoles()
+	newRoles, err := Db.readRoles()
+	roleMutex.Lock()
+	roleCache = newRoles
+	roleMutex.Unlock()
 	if err != nil {
 		return err
 	}
-	err = roleCache.checkConsistency()
+	err = newRoles.checkConsistency()
 	if err != nil {
 		return err
 	}
@@ -145,35 +156,121 @@ func ReadRoles() error {
 
 // ReadDefaultRoles load the default roles from Db  -- ToDo: Required???
 func ReadDefaultRoles() error {
-	var err error
-	defaultRoles, err = Db.readDefaultRoles()
+	newDefaultRoles, err := Db.readDefaultRoles()
 	if err != nil {
 		return err
 	}
+	roleMutex.Lock()
+	defaultRoles = newDefaultRoles
+	roleMutex.Unlock()
 	return nil
 }
 
-// SaveRoles saves new roles -- ToDo: Required???
+// SaveRoles checks and saves new roles
+// the authorizations of signed in entities are updated
 func SaveRoles(newRoles RoleCacheMap) error {
+	return SaveRolesBy(Actor{}, newRoles)
+}
+
+// SaveRolesBy saves new roles like SaveRoles, actor is recorded in the audit event
+func SaveRolesBy(actor Actor, newRoles RoleCacheMap) error {
+	err := saveRoles(newRoles)
+	roleIds := make([]RoleIdType, 0, len(newRoles))
+	for roleId := range newRoles {
+		roleIds = append(roleIds, roleId)
+	}
+	audit(AuditRolesSaved, "", actor, err, map[string]string{"roles": joinRoles(roleIds)})
+	return err
+}
+
+// saveRoles checks and saves new roles (without audit event)
+func saveRoles(newRoles RoleCacheMap) error {
+	// check
+	err := newRoles.checkConsistency()
+	if err != nil {
+		return err
+	}
 	// save
-	err := Db.saveRoles(newRoles)
+	err = Db.saveRoles(newRoles)
 	if err != nil {
 		return err
 	}
 	//update cache
+	roleMutex.Lock()
 	roleCache = newRoles
+	roleMutex.Unlock()
+	updateAuthorizationCache()
 	return nil
 }
 
-// SaveDefaultRoles saves the default roles to Db -- ToDo: Required???
+// SaveDefaultRoles saves the default roles to Db, all default roles must exist
 func SaveDefaultRoles(newDefaultRoles []RoleIdType) error {
+	return SaveDefaultRolesBy(Actor{}, newDefaultRoles)
+}
+
+// SaveDefaultRolesBy saves the default roles like SaveDefaultRoles, actor is recorded in the audit event
+func SaveDefaultRolesBy(actor Actor, newDefaultRoles []RoleIdType) error {
+	err := saveDefaultRoles(newDefaultRoles)
+	audit(AuditDefaultRolesSaved, "", actor, err, map[string]string{"defaultRoles": joinRoles(newDefaultRoles)})
+	return err
+}
+
+// saveDefaultRoles checks and saves the default roles (without audit event)
+func saveDefaultRoles(newDefaultRoles []RoleIdType) error {
+	// check
+	err := checkRolesExist(newDefaultRoles)
+	if err != nil {
+		return err
+	}
 	// save
-	err := Db.saveDefaultRoles(newDefaultRoles)
+	err = Db.saveDefaultRoles(newDefaultRoles)
 	if err != nil {
 		return err
 	}
 	// update cache
+	roleMutex.Lock()
 	defaultRoles = newDefaultRoles
+	roleMutex.Unlock()
+	return nil
+}
+
+// GetRoles returns all available roles
+func GetRoles() RoleCacheMap {
+	roleMutex.RLock()
+	defer roleMutex.RUnlock()
+	roles := make(RoleCacheMap, len(roleCache))
+	for roleId, roleBody := range roleCache {
+		roles[roleId] = roleBody
+	}
+	return roles
+}
+
+// GetDefaultRoles returns the roles, that are assigned to new entities
+func GetDefaultRoles() []RoleIdType {
+	roleMutex.RLock()
+	defer roleMutex.RUnlock()
+	return append([]RoleIdType{}, defaultRoles...)
+}
+
+// joinRoles returns the sorted role ids separated by comma, e.g. for audit events
+func joinRoles(roleIds []RoleIdType) string {
+	roles := make([]string, 0, len(roleIds))
+	for _, roleId := range roleIds {
+		roles = append(roles, string(roleId))
+	}
+	sort.Strings(roles)
+	return strings.Join(roles, ",")
+}
+
+// checkRolesExist returns an error if one of roleIds is not an available role
+func checkRolesExist(roleIds []RoleIdType) error {
+	roleMutex.RLock()
+	defer roleMutex.RUnlock()
+	for _, roleId := range roleIds {
+		if _, ok := roleCache[roleId]; !ok {
+			return &RoleError{RoleId: roleId, Err: ErrRoleNotFound}
+		}
+	}
 	return nil
 }
 
@@ -200,13 +297,13 @@ func (r RoleCacheMap) checkConsistency() error {
 		// check referencial integrity of contained roles
 		for _, containedRoleId := range roleBody.ContainedRole {
 			if _, ok := r[containedRoleId]; !ok {
-				return fmt.Errorf("role %s contains undefined role %s", roleId, containedRoleId)
+				return &RoleError{RoleId: roleId, ContainedRoleId: containedRoleId, Err: ErrRoleNotFound}
 			}
 		}
 		// check current role for cycle
 		path := new([]RoleIdType)
 		if r.hasRoleCycle(roleId, &cycleFreeRoles, path) {
-			return fmt.Errorf("role %s leads to cycle", roleId)
+			return &RoleError{RoleId: roleId, Err: ErrRoleCycle}
 		}
 	}
 	return nil
@@ -251,7 +348,7 @@ func (r RoleCacheMap) hasRoleCycle(roleId RoleIdType, cycleFreeRoles *map[RoleId
 func (r RoleCacheMap) getAuthorizationsFromRole(roleId RoleIdType) ([]AuthorizationStruct, error) {
 	roleBody, ok := r[roleId]
 	if !ok {
-		return nil, fmt.Errorf("role '%s' doesn't exists", roleId)
+		return nil, &RoleError{RoleId: roleId, Err: ErrRoleNotFound}
 	}
 	// collect direct authorizations from role
 	authorizations := []AuthorizationStruct{}
@@ -304,29 +401,82 @@ type (
 	AuthorizationCacheMap map[string][]AuthorizationStruct
 )
 
-var authorizationCache AuthorizationCacheMap // authorizations of a nick
+var (
+	authorizationCache      AuthorizationCacheMap // authorizations of a nick
+	authorizationCacheMutex sync.RWMutex          // authorizationCache is used by concurrent requests
+)
+
 // ToDo: Add livetime managemnt - don't keep data of nick for ever
 
 // AddNicksAuthorizationsToCache adds the authorizations of a nick to the authorization cache
 func AddNicksAuthorizationsToCache(entity *Entity) error {
+	roleMutex.RLock()
 	authorizations, err := roleCache.getAuthorizationsForEntity(entity)
+	roleMutex.RUnlock()
 	if err != nil {
 		return err
 	}
+	authorizationCacheMutex.Lock()
 	authorizationCache[entity.Nick] = authorizations
+	authorizationCacheMutex.Unlock()
 	return nil
 }
 
+// updateNicksAuthorizationsInCache updates the authorizations of a nick, if they are in the authorization cache
+func updateNicksAuthorizationsInCache(entity *Entity) error {
+	authorizationCacheMutex.RLock()
+	_, ok := authorizationCache[entity.Nick]
+	authorizationCacheMutex.RUnlock()
+	if !ok {
+		return nil
+	}
+	return AddNicksAuthorizationsToCache(entity)
+}
+
+// updateAuthorizationCache determines the authorizations of all nicks in the cache newly, e.g. after the roles changed
+// nicks, whose authorizations can't be determined anymore, are removed from the cache
+func updateAuthorizationCache() {
+	authorizationCacheMutex.RLock()
+	nicks := make([]string, 0, len(authorizationCache))
+	for nick := range authorizationCache {
+		nicks = append(nicks, nick)
+	}
+	authorizationCacheMutex.RUnlock()
+
+	for _, nick := range nicks {
+		entity, err := Db.ReadEntityByNick(nick)
+		if err == nil {
+			err = AddNicksAuthorizationsToCache(entity)
+		}
+		if err != nil {
+			authorizationCacheMutex.Lock()
+			delete(authorizationCache, nick)
+			authorizationCacheMutex.Unlock()
+		}
+	}
+}
+
 // IsAuthorized checks if the entity, provided through token, is authorizied for action on ressource
+// every entity is authorized to change its password (RessourcePassword, ActionChangePassword), a restricted
+// identity token (see Entity.MustChangePassword) is only authorized for that
 func IsAuthorized(identityToken string, ressourceString string, actionString string) bool {
 	// get nick from token
-	nick := identityTokenCache.getNick(identityToken)
-	if nick == "" {
+	item, ok := identityTokenCache.get(identityToken)
+	if !ok || item.Nick == "" {
 		return false // invalid token
 	}
+	nick := item.Nick
+	if ressourceString == RessourcePassword && actionString == ActionChangePassword {
+		return true
+	}
+	if item.Restricted {
+		return false // password must be changed first
+	}
 
 	// get all authorizations of nick
+	authorizationCacheMutex.RLock()
 	nickAuths, ok := authorizationCache[nick]
+	authorizationCacheMutex.RUnlock()
 	if !ok {
 		return false
 	}
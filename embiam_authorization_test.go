@@ -98,8 +98,8 @@ func TestAuth(t *testing.T) {
 	// generate example entity with role embiam.reader
 	entity1 := Entity{
 		Nick:                 fmt.Sprintf(nickPattern, 1),
-		PasswordHash:         Hash(testPassword),
-		SecretHash:           Hash(`SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
+		PasswordHash:         testHash(t, testPassword),
+		SecretHash:           testHash(t, `SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
 		Active:               true,
 		WrongPasswordCounter: 0,
 		LastSignInAttempt:    time.Time{},
@@ -115,8 +115,8 @@ func TestAuth(t *testing.T) {
 
 	entity2 := Entity{
 		Nick:                 fmt.Sprintf(nickPattern, 2),
-		PasswordHash:         Hash(testPassword),
-		SecretHash:           Hash(`SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
+		PasswordHash:         testHash(t, testPassword),
+		SecretHash:           testHash(t, `SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
 		Active:               true,
 		WrongPasswordCounter: 0,
 		LastSignInAttempt:    time.Time{},
@@ -132,8 +132,8 @@ func TestAuth(t *testing.T) {
 
 	entity3 := Entity{
 		Nick:                 fmt.Sprintf(nickPattern, 3),
-		PasswordHash:         Hash(testPassword),
-		SecretHash:           Hash(`SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
+		PasswordHash:         testHash(t, testPassword),
+		SecretHash:           testHash(t, `SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
 		Active:               true,
 		WrongPasswordCounter: 0,
 		LastSignInAttempt:    time.Time{},
@@ -237,8 +237,8 @@ func TestAuth(t *testing.T) {
 	// create new Entity 4 with a.rw
 	entity4 := Entity{
 		Nick:                 fmt.Sprintf(nickPattern, 3),
-		PasswordHash:         Hash(testPassword),
-		SecretHash:           Hash(`SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
+		PasswordHash:         testHash(t, testPassword),
+		SecretHash:           testHash(t, `SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
 		Active:               true,
 		WrongPasswordCounter: 0,
 		LastSignInAttempt:    time.Time{},
@@ -416,6 +416,7 @@ func TestAuthNewEntity(t *testing.T) {
 	// initialize embiam
 	db := new(DbFile)
 	Initialize(db)
+	defer db.Close()
 
 	/*
 	   GENERATE ENTITY (users)
@@ -0,0 +1,267 @@
+package embiam
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/********************************************************************
+	CONFIGURATION
+	LoadConfiguration reads the configuration from a json file
+	(e.g. conf.json) and overrides it with environment variables.
+	The name of the environment variable is derived from the json
+	name of the field, e.g. maxSignInAttempts is overridden by
+	EMBIAM_MAX_SIGN_IN_ATTEMPTS. Fields missing in the file keep
+	the values of DefaultConfiguration.
+
+	If neither the file nor the environment contains a ServerId
+	(or a TOTP encryption key), a new one is generated and saved
+	to the file, so that it is stable across restarts.
+
+		config, err := embiam.LoadConfiguration("conf.json")
+		...
+		err = embiam.InitializeWithConfiguration(new(embiam.DbFile), config)
+********************************************************************/
+
+const configurationEnvironmentPrefix = "EMBIAM_"
+
+// LoadConfiguration reads the configuration from the json file path and from environment variables EMBIAM_*
+// a missing file is created with the default configuration and a generated ServerId
+func LoadConfiguration(path string) (ConfigurationStruct, error) {
+	// read file (on top of the default configuration)
+	config := DefaultConfiguration()
+	jsonBytes, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return ConfigurationStruct{}, fmt.Errorf("error reading configuration file '%s': %w", path, err)
+	}
+	fileExists := err == nil
+	if fileExists {
+		err = json.Unmarshal(jsonBytes, &config)
+		if err != nil {
+			return ConfigurationStruct{}, fmt.Errorf("%w: error unmarshalling configuration file '%s': %s", ErrInvalidConfiguration, path, err)
+		}
+	}
+
+	// persist a new ServerId and TOTP encryption key (if they aren't provided by environment variables)
+	generated := map[string]string{}
+	if config.ServerId == "" && os.Getenv(configurationEnvironmentName("serverId")) == "" {
+		sid := ServerId{}
+		sid.New()
+		config.ServerId = sid.String()
+		generated["serverId"] = config.ServerId
+	}
+	if config.TOTPEncryptionKey == "" && os.Getenv(configurationEnvironmentName("totpEncryptionKey")) == "" {
+		config.TOTPEncryptionKey = generateEncryptionKey()
+		generated["totpEncryptionKey"] = config.TOTPEncryptionKey
+	}
+	if len(generated) > 0 {
+		err = saveGeneratedValues(path, config, jsonBytes, fileExists, generated)
+		if err != nil {
+			return ConfigurationStruct{}, err
+		}
+	}
+
+	// override with environment variables
+	err = config.readEnvironment()
+	if err != nil {
+		return ConfigurationStruct{}, err
+	}
+
+	// check
+	err = config.Validate()
+	if err != nil {
+		return ConfigurationStruct{}, err
+	}
+	return config, nil
+}
+
+// Validate checks the ranges of the configuration values
+func (c ConfigurationStruct) Validate() error {
+	port, err := strconv.Atoi(c.Port)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("%w: port '%s' is not a port number", ErrInvalidConfiguration, c.Port)
+	}
+	type valueStruct struct {
+		name  string
+		value int
+	}
+	positive := []valueStruct{
+		{"entityTokenValidityHours", c.EntityTokenValidityHours},
+		{"identityTokenValiditySeconds", c.IdentityTokenValiditySeconds},
+		{"identityTokenCacheMaxSize", c.IdentityTokenCacheMaxSize},
+		{"identityTokenSweepSeconds", c.IdentityTokenSweepSeconds},
+		{"argon2Time", c.Argon2Time},
+		{"argon2Memory", c.Argon2Memory},
+		{"argon2Threads", c.Argon2Threads},
+	}
+	for _, v := range positive {
+		if v.value <= 0 {
+			return fmt.Errorf("%w: %s is %d, it must be greater than 0", ErrInvalidConfiguration, v.name, v.value)
+		}
+	}
+	nonNegative := []valueStruct{
+		{"maxSignInAttempts", c.MaxSignInAttempts},
+		{"lockoutSeconds", c.LockoutSeconds},
+		{"lockoutMaxSeconds", c.LockoutMaxSeconds},
+		{"signInRateLimitPerMinute", c.SignInRateLimitPerMinute},
+		{"signInRateLimitBurst", c.SignInRateLimitBurst},
+		{"signInRateLimitMaxKeys", c.SignInRateLimitMaxKeys},
+		{"totpDriftSteps", c.TOTPDriftSteps},
+		{"refreshTokenValidityHours", c.RefreshTokenValidityHours},
+		{"sessionLifetimeHours", c.SessionLifetimeHours},
+		{"passwordPolicy.minLength", c.PasswordPolicy.MinLength},
+		{"passwordPolicy.minCharacterClasses", c.PasswordPolicy.MinCharacterClasses},
+		{"passwordPolicy.minEntropyBits", c.PasswordPolicy.MinEntropyBits},
+		{"passwordMaxAgeDays", c.PasswordMaxAgeDays},
+		{"passwordHistoryDepth", c.PasswordHistoryDepth},
+	}
+	for _, v := range nonNegative {
+		if v.value < 0 {
+			return fmt.Errorf("%w: %s is %d, it must not be negative", ErrInvalidConfiguration, v.name, v.value)
+		}
+	}
+	if c.LockoutMaxSeconds < c.LockoutSeconds {
+		return fmt.Errorf("%w: lockoutMaxSeconds %d is less than lockoutSeconds %d", ErrInvalidConfiguration, c.LockoutMaxSeconds, c.LockoutSeconds)
+	}
+	if c.PasswordHashAlgorithm != PasswordHashBcrypt && c.PasswordHashAlgorithm != PasswordHashArgon2id {
+		return fmt.Errorf("%w: passwordHashAlgorithm '%s' is unknown, use %s or %s", ErrInvalidConfiguration, c.PasswordHashAlgorithm, PasswordHashBcrypt, PasswordHashArgon2id)
+	}
+	if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("%w: bcryptCost is %d, it must be between %d and %d", ErrInvalidConfiguration, c.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if c.Argon2Threads > 255 {
+		return fmt.Errorf("%w: argon2Threads is %d, it must not be greater than 255", ErrInvalidConfiguration, c.Argon2Threads)
+	}
+	if c.TOTPEncryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(c.TOTPEncryptionKey)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("%w: totpEncryptionKey must be 32 bytes, base64-encoded", ErrInvalidConfiguration)
+		}
+	}
+	if c.PasswordPolicy.MinCharacterClasses > 4 {
+		return fmt.Errorf("%w: passwordPolicy.minCharacterClasses is %d, there are only 4 character classes", ErrInvalidConfiguration, c.PasswordPolicy.MinCharacterClasses)
+	}
+	if c.RefreshTokenValidityHours > 0 && c.SessionLifetimeHours < 1 {
+		// the identity tokens are not valid longer than the session, so they would expire immediately
+		return fmt.Errorf("%w: sessionLifetimeHours must be at least 1, if refreshTokenValidityHours is set", ErrInvalidConfiguration)
+	}
+	if c.SignInRateLimitPerMinute > 0 && c.SignInRateLimitBurst < 1 {
+		return fmt.Errorf("%w: signInRateLimitBurst must be at least 1, if signInRateLimitPerMinute is set", ErrInvalidConfiguration)
+	}
+	return nil
+}
+
+// readEnvironment overrides the fields of the configuration with the environment variables EMBIAM_*
+func (c *ConfigurationStruct) readEnvironment() error {
+	return readEnvironmentFields(reflect.ValueOf(c).Elem(), "")
+}
+
+// readEnvironmentFields overrides the fields of the struct value with the environment variables EMBIAM_*
+// the fields of nested structs are prefixed with the name of the struct, e.g. EMBIAM_PASSWORD_POLICY_MIN_LENGTH
+func readEnvironmentFields(value reflect.Value, prefix string) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + strings.ToUpper(name[:1]) + name[1:]
+		}
+		if field.Type.Kind() == reflect.Struct {
+			err := readEnvironmentFields(value.Field(i), name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		environmentName := configurationEnvironmentName(name)
+		environmentValue, ok := os.LookupEnv(environmentName)
+		if !ok {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String:
+			value.Field(i).SetString(environmentValue)
+		case reflect.Int:
+			intValue, err := strconv.Atoi(environmentValue)
+			if err != nil {
+				return fmt.Errorf("%w: %s='%s' is not an integer", ErrInvalidConfiguration, environmentName, environmentValue)
+			}
+			value.Field(i).SetInt(int64(intValue))
+		case reflect.Bool:
+			boolValue, err := strconv.ParseBool(environmentValue)
+			if err != nil {
+				return fmt.Errorf("%w: %s='%s' is not a boolean", ErrInvalidConfiguration, environmentName, environmentValue)
+			}
+			value.Field(i).SetBool(boolValue)
+		case reflect.Slice:
+			if field.Type.Elem().Kind() != reflect.String {
+				return fmt.Errorf("%w: %s can't be set by an environment variable", ErrInvalidConfiguration, environmentName)
+			}
+			// comma-separated list, e.g. EMBIAM_PASSWORD_POLICY_FORBIDDEN_SUBSTRINGS=password,secret
+			list := []string{}
+			for _, item := range strings.Split(environmentValue, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			value.Field(i).Set(reflect.ValueOf(list))
+		default:
+			return fmt.Errorf("%w: %s can't be set by an environment variable", ErrInvalidConfiguration, environmentName)
+		}
+	}
+	return nil
+}
+
+// configurationEnvironmentName converts the json name of a field to the name of the environment variable
+// e.g. maxSignInAttempts --> EMBIAM_MAX_SIGN_IN_ATTEMPTS
+func configurationEnvironmentName(jsonName string) string {
+	var name strings.Builder
+	name.WriteString(configurationEnvironmentPrefix)
+	for i, c := range jsonName {
+		if unicode.IsUpper(c) && i > 0 {
+			name.WriteRune('_')
+		}
+		name.WriteRune(unicode.ToUpper(c))
+	}
+	return name.String()
+}
+
+// saveGeneratedValues adds the generated values (e.g. the ServerId) to the configuration file path (other fields are kept as they are)
+// if the file doesn't exist, it's created with config
+func saveGeneratedValues(path string, config ConfigurationStruct, jsonBytes []byte, fileExists bool, generated map[string]string) error {
+	var err error
+	if fileExists {
+		fields := map[string]json.RawMessage{}
+		err = json.Unmarshal(jsonBytes, &fields)
+		if err != nil {
+			return fmt.Errorf("%w: error unmarshalling configuration file '%s': %s", ErrInvalidConfiguration, path, err)
+		}
+		for name, value := range generated {
+			fields[name], _ = json.Marshal(value)
+		}
+		jsonBytes, err = json.MarshalIndent(fields, "", "\t")
+	} else {
+		jsonBytes, err = json.MarshalIndent(config, "", "\t")
+	}
+	if err != nil {
+		return err
+	}
+	// the file contains the TOTP encryption key, so it's only readable by the owner
+	// (a new file replaces the old one, so the mode of an existing file doesn't matter and a crash doesn't truncate it)
+	err = writeFileAtomic(path, jsonBytes, 0600)
+	if err != nil {
+		return fmt.Errorf("error saving generated values to configuration file '%s': %w", path, err)
+	}
+	return nil
+}
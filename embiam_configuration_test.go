@@ -0,0 +1,110 @@
+package embiam
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embiam")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() returned error %s; want temporary directory\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "conf.json")
+
+	// missing file: default configuration with new ServerId, that is saved
+	config1, err := LoadConfiguration(path)
+	if err != nil {
+		t.Errorf("LoadConfiguration(path) returned error %s; want default configuration\n", err)
+	}
+	if config1.ServerId == "" || config1.Port != DefaultConfiguration().Port {
+		t.Errorf("LoadConfiguration(path) returned %v; want default configuration with ServerId\n", config1)
+	}
+	config2, _ := LoadConfiguration(path)
+	if config2.ServerId != config1.ServerId {
+		t.Errorf("LoadConfiguration(path) returned ServerId %s after restart; want %s\n", config2.ServerId, config1.ServerId)
+	}
+	if config1.TOTPEncryptionKey == "" || config2.TOTPEncryptionKey != config1.TOTPEncryptionKey {
+		t.Errorf("LoadConfiguration(path) returned TOTP encryption key %s after restart; want generated key %s\n", config2.TOTPEncryptionKey, config1.TOTPEncryptionKey)
+	}
+
+	// file with some fields: ServerId is added, other fields are kept
+	os.Remove(path)
+	ioutil.WriteFile(path, []byte(`{"port":"9000","maxSignInAttempts":3}`), 0644)
+	config3, err := LoadConfiguration(path)
+	if err != nil {
+		t.Errorf("LoadConfiguration(path) returned error %s; want configuration\n", err)
+	}
+	// the generated TOTP encryption key is only readable by the owner
+	fileinfo, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("os.Stat(path) returned error %s; want configuration file\n", err)
+	}
+	if fileinfo.Mode().Perm() != 0600 {
+		t.Errorf("LoadConfiguration(path) saved file with mode %v; want %v\n", fileinfo.Mode().Perm(), os.FileMode(0600))
+	}
+	if config3.Port != "9000" || config3.MaxSignInAttempts != 3 || config3.EntityTokenValidityHours != DefaultConfiguration().EntityTokenValidityHours {
+		t.Errorf("LoadConfiguration(path) returned %v; want values from file and defaults\n", config3)
+	}
+	config4, _ := LoadConfiguration(path)
+	if config4.ServerId != config3.ServerId || config4.Port != "9000" {
+		t.Errorf("LoadConfiguration(path) returned %v after restart; want same ServerId and values from file\n", config4)
+	}
+
+	// environment variables override the file
+	os.Setenv("EMBIAM_MAX_SIGN_IN_ATTEMPTS", "7")
+	os.Setenv("EMBIAM_SIGNED_IDENTITY_TOKENS", "true")
+	os.Setenv("EMBIAM_SERVER_ID", "server1")
+	config5, err := LoadConfiguration(path)
+	if err != nil {
+		t.Errorf("LoadConfiguration(path) returned error %s; want configuration\n", err)
+	}
+	if config5.MaxSignInAttempts != 7 || !config5.SignedIdentityTokens || config5.ServerId != "server1" {
+		t.Errorf("LoadConfiguration(path) returned %v; want values from environment\n", config5)
+	}
+	os.Unsetenv("EMBIAM_SIGNED_IDENTITY_TOKENS")
+	os.Unsetenv("EMBIAM_SERVER_ID")
+
+	// invalid values
+	os.Setenv("EMBIAM_MAX_SIGN_IN_ATTEMPTS", "many")
+	_, err = LoadConfiguration(path)
+	if err == nil {
+		t.Errorf("LoadConfiguration(path) returned NO error for EMBIAM_MAX_SIGN_IN_ATTEMPTS=many; want error\n")
+	}
+	os.Setenv("EMBIAM_MAX_SIGN_IN_ATTEMPTS", "-1")
+	_, err = LoadConfiguration(path)
+	if err == nil {
+		t.Errorf("LoadConfiguration(path) returned NO error for negative maxSignInAttempts; want error\n")
+	}
+	os.Unsetenv("EMBIAM_MAX_SIGN_IN_ATTEMPTS")
+	os.Setenv("EMBIAM_SESSION_LIFETIME_HOURS", "0")
+	_, err = LoadConfiguration(path)
+	if err == nil {
+		t.Errorf("LoadConfiguration(path) returned NO error for sessionLifetimeHours 0 with refresh tokens; want error\n")
+	}
+	os.Setenv("EMBIAM_REFRESH_TOKEN_VALIDITY_HOURS", "0")
+	config7, err := LoadConfiguration(path)
+	if err != nil || config7.SessionLifetimeHours != 0 {
+		t.Errorf("LoadConfiguration(path) returned %v for sessionLifetimeHours 0 without refresh tokens; want no error\n", err)
+	}
+	os.Unsetenv("EMBIAM_SESSION_LIFETIME_HOURS")
+	os.Unsetenv("EMBIAM_REFRESH_TOKEN_VALIDITY_HOURS")
+
+	// initialize with configuration
+	config6, _ := LoadConfiguration(path)
+	err = InitializeWithConfiguration(new(DbTransient), config6)
+	if err != nil {
+		t.Errorf("InitializeWithConfiguration(...) returned error %s; want no error\n", err)
+	}
+	if Configuration.ServerId != config3.ServerId || Configuration.Port != "9000" {
+		t.Errorf("Configuration is %v; want loaded configuration\n", Configuration)
+	}
+	config6.IdentityTokenValiditySeconds = 0
+	err = InitializeWithConfiguration(new(DbTransient), config6)
+	if err == nil {
+		t.Errorf("InitializeWithConfiguration(...) returned NO error for invalid configuration; want error\n")
+	}
+}
@@ -0,0 +1,478 @@
+package embiam
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/********************************************************************
+	DbBolt
+	DbBolt stores entities, entity tokens, roles, default roles and
+	identity tokens (and the keys to sign them) in one file, using
+	the embedded key-value store bbolt. Every kind of data has its
+	own bucket, e.g. entity with the nick as key and the JSON of
+	the entity as value. Every change is an ACID transaction.
+
+		embiam.Initialize(&embiam.DbBolt{Path: "embiam.db"})
+
+	The bucket entityByRole is an index of the entities by role,
+	see ReadEntityListByRole. It's updated in the transaction of
+	SaveEntity and DeleteEntity.
+	Backup writes a consistent copy of the database while embiam
+	is running.
+********************************************************************/
+
+// DbBolt is a DbInterface (and TokenStore and SigningKeyStore) for a bbolt database
+type DbBolt struct {
+	Path    string        // file of the database, default embiamDb/embiam.db in the directory of the executable
+	Timeout time.Duration // waiting time for the file lock of other processes, default 1 second
+	db      *bolt.DB
+}
+
+// Buckets of DbBolt
+var (
+	boltBucketEntity        = []byte("entity")
+	boltBucketEntityByRole  = []byte("entityByRole") // nested bucket per role with the nicks as keys
+	boltBucketEntityToken   = []byte("entityToken")
+	boltBucketRole          = []byte("role")
+	boltBucketDefaultRole   = []byte("defaultRole")
+	boltBucketIdentityToken = []byte("identityToken")
+	boltBucketSigningKey    = []byte("signingKey")
+	boltKeyDefaultRoles     = []byte("default")
+)
+
+// Initialize opens the database, errors are fatal (see Open)
+func (m *DbBolt) Initialize() {
+	err := m.Open()
+	if err != nil {
+		log.Fatalf("Error %s\n", err)
+	}
+}
+
+// Open opens the database and creates the buckets, a database opened before is closed
+// call Open before Initialize to handle errors instead of stopping the program
+func (m *DbBolt) Open() error {
+	if m.db != nil {
+		m.Close()
+	}
+	if m.Path == "" {
+		executableDirectory, err := filepath.Abs(filepath.Dir(os.Args[0]))
+		if err != nil {
+			return newDbError("open database", "", err, nil)
+		}
+		m.Path = executableDirectory + `/embiamDb/embiam.db`
+	}
+	err := InitializeDirectory(filepath.Dir(m.Path))
+	if err != nil {
+		return newDbError("open database", m.Path, err, nil)
+	}
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	db, err := bolt.Open(m.Path, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return newDbError("open database", m.Path, err, nil)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		buckets := [][]byte{boltBucketEntity, boltBucketEntityByRole, boltBucketEntityToken, boltBucketRole, boltBucketDefaultRole, boltBucketIdentityToken, boltBucketSigningKey}
+		for _, bucket := range buckets {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return newDbError("create buckets", m.Path, err, nil)
+	}
+	m.db = db
+	return nil
+}
+
+// Close closes the database (and releases the file lock)
+func (m *DbBolt) Close() error {
+	if m.db == nil {
+		return nil
+	}
+	err := m.db.Close()
+	m.db = nil
+	return err
+}
+
+// Backup writes a consistent copy of the database to w, the database can be used (and changed) in the meantime
+func (m *DbBolt) Backup(w io.Writer) error {
+	if m.db == nil {
+		return &DbError{Operation: "backup", Key: m.Path, Err: bolt.ErrDatabaseNotOpen}
+	}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return newDbError("backup", m.Path, err, nil)
+	}
+	return nil
+}
+
+func (m *DbBolt) ReadEntityList() (nicklist []string, e error) {
+	nicklist = []string{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketEntity).ForEach(func(nick, _ []byte) error {
+			nicklist = append(nicklist, string(nick))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, newDbError("read entity list", "", err, nil)
+	}
+	return nicklist, nil
+}
+
+// ReadEntityListByRole returns the nicks of the entities with role (assigned directly, not as contained role)
+func (m *DbBolt) ReadEntityListByRole(role RoleIdType) ([]string, error) {
+	nicklist := []string{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		roleBucket := tx.Bucket(boltBucketEntityByRole).Bucket([]byte(role))
+		if roleBucket == nil {
+			return nil
+		}
+		return roleBucket.ForEach(func(nick, _ []byte) error {
+			nicklist = append(nicklist, string(nick))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, newDbError("read entity list by role", string(role), err, nil)
+	}
+	return nicklist, nil
+}
+
+func (m *DbBolt) ReadEntityByNick(nick string) (*Entity, error) {
+	entity := Entity{}
+	err := m.readJSON("read entity", boltBucketEntity, nick, ErrEntityNotFound, &entity)
+	if err != nil {
+		return nil, err
+	}
+	return &entity, nil
+}
+
+func (m *DbBolt) ReadPublicEntityByNick(nick string) (*PublicEntity, error) {
+	entity, err := m.ReadEntityByNick(nick)
+	if err != nil {
+		return nil, err
+	}
+	publicEntity := entity.toPublicEntity()
+	return &publicEntity, nil
+}
+
+func (m *DbBolt) EntityExists(nick string) bool {
+	exists := false
+	m.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(boltBucketEntity).Get([]byte(nick)) != nil
+		return nil
+	})
+	return exists
+}
+
+// SaveEntity saves the entity and updates the index of its roles in one transaction
+func (m *DbBolt) SaveEntity(e *Entity) error {
+	jsonbytes, err := json.Marshal(e)
+	if err != nil {
+		return newDbError("marshal entity", e.Nick, err, nil)
+	}
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		_, err := m.removeFromRoleIndex(tx, e.Nick)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(boltBucketEntity).Put([]byte(e.Nick), jsonbytes)
+		if err != nil {
+			return err
+		}
+		for _, role := range e.Roles {
+			if role == "" {
+				continue // bbolt doesn't allow buckets without name
+			}
+			roleBucket, err := tx.Bucket(boltBucketEntityByRole).CreateBucketIfNotExists([]byte(role))
+			if err != nil {
+				return err
+			}
+			err = roleBucket.Put([]byte(e.Nick), []byte{})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return newDbError("save entity", e.Nick, err, nil)
+	}
+	return nil
+}
+
+func (m *DbBolt) DeleteEntity(nick string) error {
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		found, err := m.removeFromRoleIndex(tx, nick)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrEntityNotFound
+		}
+		return tx.Bucket(boltBucketEntity).Delete([]byte(nick))
+	})
+	if err != nil {
+		return newDbError("delete entity", nick, err, nil)
+	}
+	return nil
+}
+
+// removeFromRoleIndex removes the saved entity of nick from the index of roles, found reports if the entity exists
+func (m *DbBolt) removeFromRoleIndex(tx *bolt.Tx, nick string) (found bool, err error) {
+	jsonbytes := tx.Bucket(boltBucketEntity).Get([]byte(nick))
+	if jsonbytes == nil {
+		return false, nil
+	}
+	entity := Entity{}
+	err = json.Unmarshal(jsonbytes, &entity)
+	if err != nil {
+		return true, err
+	}
+	index := tx.Bucket(boltBucketEntityByRole)
+	for _, role := range entity.Roles {
+		roleBucket := index.Bucket([]byte(role))
+		if role == "" || roleBucket == nil {
+			continue
+		}
+		err = roleBucket.Delete([]byte(nick))
+		if err != nil {
+			return true, err
+		}
+		// remove empty buckets of roles
+		if key, _ := roleBucket.Cursor().First(); key == nil {
+			err = index.DeleteBucket([]byte(role))
+			if err != nil {
+				return true, err
+			}
+		}
+	}
+	return true, nil
+}
+
+func (m *DbBolt) saveEntityToken(et *EntityToken) error {
+	return m.saveJSON("save entity token", boltBucketEntityToken, et.Token, et)
+}
+
+func (m *DbBolt) readEntityToken(token string) (*EntityToken, error) {
+	et := EntityToken{}
+	err := m.readJSON("read entity token", boltBucketEntityToken, token, ErrEntityTokenNotFound, &et)
+	if err != nil {
+		return nil, err
+	}
+	return &et, nil
+}
+
+func (m *DbBolt) readEntityTokenList() ([]EntityToken, error) {
+	entityTokens := []EntityToken{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketEntityToken).ForEach(func(_, jsonbytes []byte) error {
+			et := EntityToken{}
+			err := json.Unmarshal(jsonbytes, &et)
+			entityTokens = append(entityTokens, et)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, newDbError("read entity token list", "", err, nil)
+	}
+	return entityTokens, nil
+}
+
+func (m *DbBolt) deleteEntityToken(token string) error {
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucketEntityToken)
+		if bucket.Get([]byte(token)) == nil {
+			return ErrEntityTokenNotFound
+		}
+		return bucket.Delete([]byte(token))
+	})
+	if err != nil {
+		return newDbError("delete entity token", token, err, nil)
+	}
+	return nil
+}
+
+func (m *DbBolt) readRoles() (roleMap RoleCacheMap, err error) {
+	roleMap = make(RoleCacheMap)
+	err = m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketRole).ForEach(func(role, jsonbytes []byte) error {
+			roleBody := RoleBodyStruct{}
+			err := json.Unmarshal(jsonbytes, &roleBody)
+			roleMap[RoleIdType(role)] = roleBody
+			return err
+		})
+	})
+	if err != nil {
+		return roleMap, newDbError("read roles", "", err, nil)
+	}
+	return roleMap, nil
+}
+
+func (m *DbBolt) readDefaultRoles() (defaultRoles []RoleIdType, err error) {
+	defaultRoles = []RoleIdType{}
+	err = m.readJSON("read default roles", boltBucketDefaultRole, string(boltKeyDefaultRoles), nil, &defaultRoles)
+	return defaultRoles, err
+}
+
+// saveRoles replaces all roles in one transaction
+func (m *DbBolt) saveRoles(roleMap RoleCacheMap) error {
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(boltBucketRole)
+		if err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket(boltBucketRole)
+		if err != nil {
+			return err
+		}
+		for role, roleBody := range roleMap {
+			jsonbytes, err := json.Marshal(roleBody)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte(role), jsonbytes)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return newDbError("save roles", "", err, nil)
+	}
+	return nil
+}
+
+func (m *DbBolt) saveDefaultRoles(defaultRoles []RoleIdType) error {
+	return m.saveJSON("save default roles", boltBucketDefaultRole, string(boltKeyDefaultRoles), defaultRoles)
+}
+
+func (m *DbBolt) SaveIdentityToken(tokenHash string, identityToken StoredIdentityToken) error {
+	return m.saveJSON("save identity token", boltBucketIdentityToken, tokenHash, identityToken)
+}
+
+func (m *DbBolt) DeleteIdentityToken(tokenHash string) error {
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketIdentityToken).Delete([]byte(tokenHash))
+	})
+	if err != nil {
+		return newDbError("delete identity token", tokenHash, err, nil)
+	}
+	return nil
+}
+
+func (m *DbBolt) ReadIdentityTokens() (map[string]StoredIdentityToken, error) {
+	tokens := make(map[string]StoredIdentityToken)
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketIdentityToken).ForEach(func(tokenHash, jsonbytes []byte) error {
+			identityToken := StoredIdentityToken{}
+			err := json.Unmarshal(jsonbytes, &identityToken)
+			tokens[string(tokenHash)] = identityToken
+			return err
+		})
+	})
+	if err != nil {
+		return nil, newDbError("read identity tokens", "", err, nil)
+	}
+	return tokens, nil
+}
+
+// SaveSigningKeys replaces all signing keys in one transaction
+func (m *DbBolt) SaveSigningKeys(keys []StoredSigningKey) error {
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(boltBucketSigningKey)
+		if err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket(boltBucketSigningKey)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			jsonbytes, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte(key.KeyId), jsonbytes)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return newDbError("save signing keys", "", err, nil)
+	}
+	return nil
+}
+
+func (m *DbBolt) ReadSigningKeys() ([]StoredSigningKey, error) {
+	keys := []StoredSigningKey{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketSigningKey).ForEach(func(_, jsonbytes []byte) error {
+			key := StoredSigningKey{}
+			err := json.Unmarshal(jsonbytes, &key)
+			keys = append(keys, key)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, newDbError("read signing keys", "", err, nil)
+	}
+	return keys, nil
+}
+
+// saveJSON puts the JSON of v with key into bucket
+func (m *DbBolt) saveJSON(operation string, bucket []byte, key string, v interface{}) error {
+	jsonbytes, err := json.Marshal(v)
+	if err == nil {
+		err = m.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucket).Put([]byte(key), jsonbytes)
+		})
+	}
+	if err != nil {
+		return newDbError(operation, key, err, nil)
+	}
+	return nil
+}
+
+// readJSON gets the value of key from bucket and unmarshals it into v
+// notFound is returned, if the key doesn't exist; if notFound is nil, v is kept
+func (m *DbBolt) readJSON(operation string, bucket []byte, key string, notFound error, v interface{}) error {
+	var jsonbytes []byte
+	m.db.View(func(tx *bolt.Tx) error {
+		// the value is only valid during the transaction
+		jsonbytes = append(jsonbytes, tx.Bucket(bucket).Get([]byte(key))...)
+		return nil
+	})
+	if len(jsonbytes) == 0 {
+		if notFound == nil {
+			return nil
+		}
+		return &DbError{Operation: operation, Key: key, Err: notFound}
+	}
+	err := json.Unmarshal(jsonbytes, v)
+	if err != nil {
+		return newDbError(operation, key, err, nil)
+	}
+	return nil
+}
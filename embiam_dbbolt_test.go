@@ -0,0 +1,204 @@
+package embiam
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestBoltPath returns the path of a new bbolt database in a temporary directory
+func newTestBoltPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "embiam")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...) returned error %s; want temporary directory\n", err)
+	}
+	return filepath.Join(dir, "embiam.db")
+}
+
+func TestDbBolt(t *testing.T) {
+	path := newTestBoltPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	m := &DbBolt{Path: path}
+	m.Initialize()
+	defer m.Close()
+
+	// entities
+	e := Entity{Nick: `N1CK0001`, PasswordHash: `$2a$04$hash`, Active: true, Roles: []RoleIdType{`application`, `embiam.reader`}}
+	err := m.SaveEntity(&e)
+	if err != nil {
+		t.Errorf("m.SaveEntity(&e) returned error %s; want nil\n", err)
+	}
+	m.SaveEntity(&Entity{Nick: `N1CK0002`, Roles: []RoleIdType{`application`, `application`}})
+	readEntity, err := m.ReadEntityByNick(`N1CK0001`)
+	if err != nil || readEntity.PasswordHash != e.PasswordHash || len(readEntity.Roles) != 2 {
+		t.Errorf("m.ReadEntityByNick(N1CK0001) returned %v, %v; want saved entity\n", readEntity, err)
+	}
+	_, err = m.ReadEntityByNick(`UNKNOWN`)
+	dbError := &DbError{}
+	if !errors.Is(err, ErrEntityNotFound) || !errors.As(err, &dbError) || dbError.Key != `UNKNOWN` {
+		t.Errorf("m.ReadEntityByNick(UNKNOWN) returned %v; want DbError with ErrEntityNotFound\n", err)
+	}
+	if !m.EntityExists(`N1CK0001`) || m.EntityExists(`UNKNOWN`) {
+		t.Errorf("m.EntityExists(...) returned wrong result; want true for N1CK0001 and false for UNKNOWN\n")
+	}
+	nicks, err := m.ReadEntityList()
+	if err != nil || len(nicks) != 2 || nicks[0] != `N1CK0001` {
+		t.Errorf("m.ReadEntityList() returned %v, %v; want [N1CK0001 N1CK0002]\n", nicks, err)
+	}
+	nicks, _ = m.ReadEntityListByRole(`application`)
+	if len(nicks) != 2 {
+		t.Errorf("m.ReadEntityListByRole(application) returned %v; want [N1CK0001 N1CK0002]\n", nicks)
+	}
+	// saving replaces the roles in the index
+	e.Roles = []RoleIdType{`application`}
+	m.SaveEntity(&e)
+	nicks, _ = m.ReadEntityListByRole(`embiam.reader`)
+	if len(nicks) != 0 {
+		t.Errorf("m.ReadEntityListByRole(embiam.reader) returned %v after role was removed; want []\n", nicks)
+	}
+	publicEntity, err := m.ReadPublicEntityByNick(`N1CK0001`)
+	if err != nil || !publicEntity.Active || len(publicEntity.Roles) != 1 {
+		t.Errorf("m.ReadPublicEntityByNick(N1CK0001) returned %v, %v; want active entity with 1 role\n", publicEntity, err)
+	}
+	err = m.DeleteEntity(`N1CK0002`)
+	if err != nil || m.EntityExists(`N1CK0002`) {
+		t.Errorf("m.DeleteEntity(N1CK0002) returned %v; want deleted entity\n", err)
+	}
+	nicks, _ = m.ReadEntityListByRole(`application`)
+	if len(nicks) != 1 {
+		t.Errorf("m.ReadEntityListByRole(application) returned %v after delete; want [N1CK0001]\n", nicks)
+	}
+	err = m.DeleteEntity(`N1CK0002`)
+	if !errors.Is(err, ErrEntityNotFound) {
+		t.Errorf("m.DeleteEntity(N1CK0002) returned %v for deleted entity; want ErrEntityNotFound\n", err)
+	}
+
+	// entity tokens
+	et := EntityToken{Token: `T0KEN`, Pin: `1234`, ValidUntil: time.Now().UTC().Add(time.Hour).Truncate(time.Second)}
+	err = m.saveEntityToken(&et)
+	if err != nil {
+		t.Errorf("m.saveEntityToken(&et) returned error %s; want nil\n", err)
+	}
+	readEntityToken, err := m.readEntityToken(`T0KEN`)
+	if err != nil || readEntityToken.Pin != et.Pin || !readEntityToken.ValidUntil.Equal(et.ValidUntil) {
+		t.Errorf("m.readEntityToken(T0KEN) returned %v, %v; want saved entity token\n", readEntityToken, err)
+	}
+	entityTokens, _ := m.readEntityTokenList()
+	if len(entityTokens) != 1 {
+		t.Errorf("m.readEntityTokenList() returned %v; want 1 entity token\n", entityTokens)
+	}
+	m.deleteEntityToken(`T0KEN`)
+	_, err = m.readEntityToken(`T0KEN`)
+	if !errors.Is(err, ErrEntityTokenNotFound) {
+		t.Errorf("m.readEntityToken(T0KEN) returned %v after delete; want ErrEntityTokenNotFound\n", err)
+	}
+	err = m.deleteEntityToken(`T0KEN`)
+	if !errors.Is(err, ErrEntityTokenNotFound) {
+		t.Errorf("m.deleteEntityToken(T0KEN) returned %v for deleted token; want ErrEntityTokenNotFound\n", err)
+	}
+
+	// roles and default roles
+	roles := RoleCacheMap{
+		`application`: {Authorization: []AuthorizationStruct{{Ressource: `application`, Action: ActionMap{`use`: {}}}}},
+		`admin`:       {ContainedRole: []RoleIdType{`application`}},
+	}
+	err = m.saveRoles(roles)
+	if err != nil {
+		t.Errorf("m.saveRoles(roles) returned error %s; want nil\n", err)
+	}
+	delete(roles, `admin`)
+	m.saveRoles(roles)
+	readRoles, err := m.readRoles()
+	if err != nil || len(readRoles) != 1 || len(readRoles[`application`].Authorization) != 1 {
+		t.Errorf("m.readRoles() returned %v, %v; want role application\n", readRoles, err)
+	}
+	m.saveDefaultRoles([]RoleIdType{`b`, `a`, `c`})
+	defaultRoles, err := m.readDefaultRoles()
+	if err != nil || len(defaultRoles) != 3 || defaultRoles[0] != `b` || defaultRoles[2] != `c` {
+		t.Errorf("m.readDefaultRoles() returned %v, %v; want [b a c]\n", defaultRoles, err)
+	}
+
+	// identity tokens
+	m.SaveIdentityToken(`hash1`, StoredIdentityToken{Nick: `N1CK0001`, ValidFor: testHost, Restricted: true})
+	m.SaveIdentityToken(`hash2`, StoredIdentityToken{Nick: `N1CK0002`})
+	m.DeleteIdentityToken(`hash2`)
+	tokens, err := m.ReadIdentityTokens()
+	if err != nil || len(tokens) != 1 || tokens[`hash1`].Nick != `N1CK0001` || !tokens[`hash1`].Restricted {
+		t.Errorf("m.ReadIdentityTokens() returned %v, %v; want token hash1\n", tokens, err)
+	}
+
+	// signing keys
+	m.SaveSigningKeys([]StoredSigningKey{{KeyId: `key1`}, {KeyId: `key2`}})
+	m.SaveSigningKeys([]StoredSigningKey{{KeyId: `key2`, PrivateKey: []byte{1, 2}}})
+	storedKeys, err := m.ReadSigningKeys()
+	if err != nil || len(storedKeys) != 1 || storedKeys[0].KeyId != `key2` || len(storedKeys[0].PrivateKey) != 2 {
+		t.Errorf("m.ReadSigningKeys() returned %v, %v; want key2\n", storedKeys, err)
+	}
+
+	// backup while the database is open
+	var backup bytes.Buffer
+	err = m.Backup(&backup)
+	if err != nil {
+		t.Errorf("m.Backup(&backup) returned error %s; want nil\n", err)
+	}
+	backupPath := filepath.Join(filepath.Dir(path), "backup.db")
+	ioutil.WriteFile(backupPath, backup.Bytes(), 0600)
+	restored := &DbBolt{Path: backupPath}
+	err = restored.Open()
+	if err != nil {
+		t.Fatalf("restored.Open() returned error %s; want nil\n", err)
+	}
+	defer restored.Close()
+	nicks, _ = restored.ReadEntityListByRole(`application`)
+	if len(nicks) != 1 || nicks[0] != `N1CK0001` {
+		t.Errorf("restored.ReadEntityListByRole(application) returned %v; want [N1CK0001]\n", nicks)
+	}
+
+	// backup of a closed database
+	restored.Close()
+	err = restored.Backup(&backup)
+	dbError = &DbError{}
+	if !errors.As(err, &dbError) || dbError.Operation != "backup" {
+		t.Errorf("restored.Backup(&backup) returned %v for closed database; want DbError\n", err)
+	}
+}
+
+func TestDbBoltWithEmbiam(t *testing.T) {
+	path := newTestBoltPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	m := &DbBolt{Path: path}
+	Initialize(m)
+	ne, err := CreateEntity(``, []RoleIdType{`application`})
+	if err != nil {
+		t.Errorf("CreateEntity(...) returned error %s; want new entity\n", err)
+	}
+	newPassword := `Tr0ub4dor&3horse`
+	err = ChangePassword(ne.Nick, ne.Password, newPassword, testHost)
+	if err != nil {
+		t.Errorf("ChangePassword(...) returned error %s; want nil\n", err)
+	}
+	identityToken, err := CheckIdentity(ne.Nick, newPassword, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(...) returned error %s; want identity token\n", err)
+	}
+	m.Close()
+
+	// restart with the same database: entities and identity tokens are kept
+	m = &DbBolt{Path: path}
+	Initialize(m)
+	defer m.Close()
+	if !IsIdentityTokenValid(identityToken.Token, testHost) {
+		t.Errorf("IsIdentityTokenValid(identityToken) returned false after restart; want true\n")
+	}
+	if !IsAuthorized(identityToken.Token, `application`, `use`) {
+		t.Errorf("IsAuthorized(identityToken, application, use) returned false after restart; want true\n")
+	}
+	_, err = CheckIdentity(ne.Nick, newPassword, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(...) returned error %s after restart; want identity token\n", err)
+	}
+}
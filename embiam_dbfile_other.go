@@ -0,0 +1,23 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package embiam
+
+import "os"
+
+// advisory locks are only supported on unix-like systems,
+// elsewhere the lock file is created but not locked
+const fileLockSupported = false
+
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
+
+// directories can't be opened for syncing on all systems (e.g. windows)
+func syncDirectory(dir string) error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package embiam
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embiam")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...) returned error %s; want temporary directory\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "N1CK0001")
+	writeFileAtomic(filename, []byte(`old`), 0644)
+	err = writeFileAtomic(filename, []byte(`new`), 0600)
+	if err != nil {
+		t.Errorf("writeFileAtomic(...) returned error %s; want nil\n", err)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	if string(data) != `new` {
+		t.Errorf("writeFileAtomic(...) wrote %q; want %q\n", data, `new`)
+	}
+	fileinfo, _ := os.Stat(filename)
+	if fileinfo.Mode().Perm() != 0600 {
+		t.Errorf("writeFileAtomic(...) created file with mode %v; want %v\n", fileinfo.Mode().Perm(), os.FileMode(0600))
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("writeFileAtomic(...) left %d files in directory; want 1\n", len(files))
+	}
+
+	// temporary files of an interrupted write are removed, other files are kept
+	ioutil.WriteFile(filepath.Join(dir, tempFilePrefix+"N1CK0001-123"), []byte(`{"nick":`), 0644)
+	err = removeTempFiles(dir)
+	if err != nil {
+		t.Errorf("removeTempFiles(dir) returned error %s; want nil\n", err)
+	}
+	files, _ = ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != "N1CK0001" {
+		t.Errorf("removeTempFiles(dir) left %v; want only N1CK0001\n", files)
+	}
+}
+
+func TestDbFileRecoveryAndLock(t *testing.T) {
+	db := new(DbFile)
+	Initialize(db)
+	defer func() { db.Close() }()
+	db.DeleteContentsFromDirectory(db.EntityTokenFilePath)
+
+	// stray temporary files are removed and not listed
+	tempFile := db.EntityTokenFilePath + tempFilePrefix + "T0KEN-123"
+	ioutil.WriteFile(tempFile, []byte(`{"token":`), 0644)
+	entityTokens, err := db.readEntityTokenList()
+	if err != nil || len(entityTokens) != 0 {
+		t.Errorf("db.readEntityTokenList() returned %v, %v with temporary file; want no entity tokens\n", entityTokens, err)
+	}
+	auditTempFile := db.AuditPath + tempFilePrefix + "head.json-123"
+	ioutil.WriteFile(auditTempFile, []byte(`{"seq":`), 0644)
+	// Initialize of the same DbFile keeps them, they might belong to writes in progress
+	Initialize(db)
+	if _, err := os.Stat(tempFile); err != nil {
+		t.Errorf("Initialize(db) removed temporary file %s of the open DbFile; want it kept\n", tempFile)
+	}
+	db.Close()
+	db = new(DbFile)
+	Initialize(db)
+	for _, path := range []string{tempFile, auditTempFile} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Initialize(...) kept temporary file %s; want it removed\n", path)
+		}
+	}
+
+	// another DbFile can't open the directory, and its Close doesn't release the lock
+	otherDb := new(DbFile)
+	err = otherDb.Open()
+	if !errors.Is(err, ErrDbLocked) {
+		t.Errorf("otherDb.Open() returned %v for directory of open DbFile; want ErrDbLocked\n", err)
+	}
+	otherDb.Close()
+	err = new(DbFile).Open()
+	if !errors.Is(err, ErrDbLocked) {
+		t.Errorf("new(DbFile).Open() returned %v after otherDb.Close(); want ErrDbLocked\n", err)
+	}
+
+	// saving roles replaces the file
+	roles := RoleCacheMap{`application`: {Authorization: []AuthorizationStruct{{Ressource: `application`, Action: ActionMap{`use`: {}}}}}}
+	err = db.saveRoles(roles)
+	if err != nil {
+		t.Errorf("db.saveRoles(roles) returned error %s; want nil\n", err)
+	}
+	readRoles, err := db.readRoles()
+	if err != nil || len(readRoles) != 1 {
+		t.Errorf("db.readRoles() returned %v, %v; want saved roles\n", readRoles, err)
+	}
+
+	if !fileLockSupported {
+		return
+	}
+	// another process can't lock the directory (a second open file has its own lock)
+	f, err := os.OpenFile(db.DBPath+".lock", os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("os.OpenFile(.lock) returned error %s; want lock file\n", err)
+	}
+	defer f.Close()
+	err = lockFile(f)
+	if !errors.Is(err, ErrDbLocked) {
+		t.Errorf("lockFile(f) returned %v for locked database; want ErrDbLocked\n", err)
+	}
+	// after Close, the directory can be locked again
+	db.Close()
+	err = lockFile(f)
+	if err != nil {
+		t.Errorf("lockFile(f) returned error %s after db.Close(); want nil\n", err)
+	}
+	// now the database is locked by another process
+	err = db.Open()
+	if !errors.Is(err, ErrDbLocked) {
+		t.Errorf("db.Open() returned %v for locked database; want ErrDbLocked\n", err)
+	}
+	unlockFile(f)
+}
@@ -0,0 +1,490 @@
+package embiam
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/********************************************************************
+	DbSQL
+	DbSQL stores entities, entity tokens, roles, default roles and
+	identity tokens (and the keys to sign them) in a SQL database,
+	using database/sql. The driver is chosen by the application,
+	e.g. SQLite:
+
+		db, err := sql.Open("sqlite", "embiam.db")
+		...
+		embiam.Initialize(&embiam.DbSQL{DB: db})
+
+	Entities are saved as JSON (like DbFile) with an additional
+	table of their roles, see ReadEntityListByRole. SaveEntity,
+	DeleteEntity, saveRoles and saveDefaultRoles use transactions.
+
+	Initialize creates the tables and applies new migrations (see
+	sqlMigrations). The applied versions are kept in the table
+	embiam_migration, so every migration is applied once.
+********************************************************************/
+
+// Dialects of DbSQL, they differ in the placeholders of the parameters
+const (
+	SQLDialectSQLite   = "sqlite"   // placeholder ?, default
+	SQLDialectMySQL    = "mysql"    // placeholder ?
+	SQLDialectPostgres = "postgres" // placeholders $1, $2, ...
+)
+
+// DbSQL is a DbInterface (and TokenStore and SigningKeyStore) for SQL databases
+type DbSQL struct {
+	DB      *sql.DB
+	Dialect string // SQLDialectSQLite, SQLDialectMySQL or SQLDialectPostgres
+}
+
+// sqlMigrations are the statements of the migrations of the schema, the version of a migration is its index + 1
+// migrations are never changed after a release, changes of the schema are added as new migration
+var sqlMigrations = [][]string{
+	// 1: entities, entity tokens, roles and default roles
+	{
+		`CREATE TABLE embiam_entity (nick VARCHAR(64) NOT NULL PRIMARY KEY, data TEXT NOT NULL)`,
+		`CREATE TABLE embiam_entity_role (nick VARCHAR(64) NOT NULL, role VARCHAR(255) NOT NULL, PRIMARY KEY (nick, role))`,
+		`CREATE INDEX embiam_entity_role_role ON embiam_entity_role (role)`,
+		`CREATE TABLE embiam_entity_token (token VARCHAR(255) NOT NULL PRIMARY KEY, data TEXT NOT NULL)`,
+		`CREATE TABLE embiam_role (role VARCHAR(255) NOT NULL PRIMARY KEY, data TEXT NOT NULL)`,
+		`CREATE TABLE embiam_default_role (position INTEGER NOT NULL PRIMARY KEY, role VARCHAR(255) NOT NULL)`,
+	},
+	// 2: identity tokens (TokenStore)
+	{
+		`CREATE TABLE embiam_identity_token (token_hash VARCHAR(255) NOT NULL PRIMARY KEY, data TEXT NOT NULL)`,
+	},
+	// 3: keys to sign identity tokens (SigningKeyStore)
+	{
+		`CREATE TABLE embiam_signing_key (key_id VARCHAR(255) NOT NULL PRIMARY KEY, data TEXT NOT NULL)`,
+	},
+}
+
+// Initialize creates the tables and applies the migrations, errors are fatal (see Migrate)
+func (m *DbSQL) Initialize() {
+	if m.Dialect == "" {
+		m.Dialect = SQLDialectSQLite
+	}
+	err := m.Migrate()
+	if err != nil {
+		log.Fatalf("Error %s\n", err)
+	}
+}
+
+// Migrate applies all migrations, that are not applied yet, every migration runs in its own transaction
+// call Migrate before Initialize to handle errors instead of stopping the program
+func (m *DbSQL) Migrate() error {
+	_, err := m.DB.Exec(`CREATE TABLE IF NOT EXISTS embiam_migration (version INTEGER NOT NULL PRIMARY KEY, applied VARCHAR(64) NOT NULL)`)
+	if err != nil {
+		return newDbError("create migration table", "", err, nil)
+	}
+	version, err := m.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(sqlMigrations) {
+		return newDbError("migrate", strconv.Itoa(version), fmt.Errorf("schema version %d is newer than the version %d of embiam", version, len(sqlMigrations)), nil)
+	}
+	for i := version; i < len(sqlMigrations); i++ {
+		err = m.transaction("migrate", strconv.Itoa(i+1), func(tx *sql.Tx) error {
+			for _, statement := range sqlMigrations[i] {
+				_, err := tx.Exec(statement)
+				if err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(m.rebind(`INSERT INTO embiam_migration (version, applied) VALUES (?, ?)`), i+1, time.Now().UTC().Format(time.RFC3339))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the last applied migration (0 for an empty database)
+func (m *DbSQL) SchemaVersion() (int, error) {
+	var version sql.NullInt64
+	err := m.DB.QueryRow(`SELECT MAX(version) FROM embiam_migration`).Scan(&version)
+	if err != nil {
+		return 0, newDbError("read schema version", "", err, nil)
+	}
+	return int(version.Int64), nil
+}
+
+// Close closes the database
+func (m *DbSQL) Close() error {
+	return m.DB.Close()
+}
+
+func (m *DbSQL) ReadEntityList() (nicklist []string, e error) {
+	return m.readColumn("read entity list", "", `SELECT nick FROM embiam_entity ORDER BY nick`)
+}
+
+// ReadEntityListByRole returns the nicks of the entities with role (assigned directly, not as contained role)
+func (m *DbSQL) ReadEntityListByRole(role RoleIdType) ([]string, error) {
+	return m.readColumn("read entity list by role", string(role), `SELECT nick FROM embiam_entity_role WHERE role = ? ORDER BY nick`, string(role))
+}
+
+func (m *DbSQL) ReadEntityByNick(nick string) (*Entity, error) {
+	entity := Entity{}
+	err := m.readJSON("read entity", nick, ErrEntityNotFound, &entity, `SELECT data FROM embiam_entity WHERE nick = ?`, nick)
+	if err != nil {
+		return nil, err
+	}
+	return &entity, nil
+}
+
+func (m *DbSQL) ReadPublicEntityByNick(nick string) (*PublicEntity, error) {
+	entity, err := m.ReadEntityByNick(nick)
+	if err != nil {
+		return nil, err
+	}
+	publicEntity := entity.toPublicEntity()
+	return &publicEntity, nil
+}
+
+func (m *DbSQL) EntityExists(nick string) bool {
+	var one int
+	err := m.DB.QueryRow(m.rebind(`SELECT 1 FROM embiam_entity WHERE nick = ?`), nick).Scan(&one)
+	return err == nil
+}
+
+// SaveEntity replaces the entity and its roles in one transaction
+func (m *DbSQL) SaveEntity(e *Entity) error {
+	jsonbytes, err := json.Marshal(e)
+	if err != nil {
+		return newDbError("marshal entity", e.Nick, err, nil)
+	}
+	return m.transaction("save entity", e.Nick, func(tx *sql.Tx) error {
+		_, err := m.deleteEntity(tx, e.Nick)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(m.rebind(`INSERT INTO embiam_entity (nick, data) VALUES (?, ?)`), e.Nick, string(jsonbytes))
+		if err != nil {
+			return err
+		}
+		inserted := map[RoleIdType]struct{}{}
+		for _, role := range e.Roles {
+			if _, ok := inserted[role]; ok {
+				continue
+			}
+			inserted[role] = struct{}{}
+			_, err = tx.Exec(m.rebind(`INSERT INTO embiam_entity_role (nick, role) VALUES (?, ?)`), e.Nick, string(role))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *DbSQL) DeleteEntity(nick string) error {
+	return m.transaction("delete entity", nick, func(tx *sql.Tx) error {
+		found, err := m.deleteEntity(tx, nick)
+		if err == nil && !found {
+			err = ErrEntityNotFound
+		}
+		return err
+	})
+}
+
+// deleteEntity deletes the entity and its roles in the transaction tx, found reports if the entity existed
+func (m *DbSQL) deleteEntity(tx *sql.Tx, nick string) (found bool, err error) {
+	_, err = tx.Exec(m.rebind(`DELETE FROM embiam_entity_role WHERE nick = ?`), nick)
+	if err != nil {
+		return false, err
+	}
+	result, err := tx.Exec(m.rebind(`DELETE FROM embiam_entity WHERE nick = ?`), nick)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (m *DbSQL) saveEntityToken(et *EntityToken) error {
+	return m.saveJSON("save entity token", et.Token, `embiam_entity_token`, `token`, et.Token, et)
+}
+
+func (m *DbSQL) readEntityToken(token string) (*EntityToken, error) {
+	et := EntityToken{}
+	err := m.readJSON("read entity token", token, ErrEntityTokenNotFound, &et, `SELECT data FROM embiam_entity_token WHERE token = ?`, token)
+	if err != nil {
+		return nil, err
+	}
+	return &et, nil
+}
+
+func (m *DbSQL) readEntityTokenList() ([]EntityToken, error) {
+	entityTokens := []EntityToken{}
+	err := m.readJSONRows("read entity token list", `SELECT token, data FROM embiam_entity_token ORDER BY token`, func(token string, data []byte) error {
+		et := EntityToken{}
+		err := json.Unmarshal(data, &et)
+		entityTokens = append(entityTokens, et)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entityTokens, nil
+}
+
+func (m *DbSQL) deleteEntityToken(token string) error {
+	result, err := m.DB.Exec(m.rebind(`DELETE FROM embiam_entity_token WHERE token = ?`), token)
+	if err == nil {
+		var rows int64
+		rows, err = result.RowsAffected()
+		if err == nil && rows == 0 {
+			err = ErrEntityTokenNotFound
+		}
+	}
+	if err != nil {
+		return newDbError("delete entity token", token, err, nil)
+	}
+	return nil
+}
+
+func (m *DbSQL) readRoles() (roleMap RoleCacheMap, err error) {
+	roleMap = make(RoleCacheMap)
+	err = m.readJSONRows("read roles", `SELECT role, data FROM embiam_role`, func(role string, data []byte) error {
+		roleBody := RoleBodyStruct{}
+		err := json.Unmarshal(data, &roleBody)
+		roleMap[RoleIdType(role)] = roleBody
+		return err
+	})
+	return roleMap, err
+}
+
+func (m *DbSQL) readDefaultRoles() (defaultRoles []RoleIdType, err error) {
+	defaultRoles = []RoleIdType{}
+	roles, err := m.readColumn("read default roles", "", `SELECT role FROM embiam_default_role ORDER BY position`)
+	for _, role := range roles {
+		defaultRoles = append(defaultRoles, RoleIdType(role))
+	}
+	return defaultRoles, err
+}
+
+// saveRoles replaces all roles in one transaction
+func (m *DbSQL) saveRoles(roleMap RoleCacheMap) error {
+	return m.transaction("save roles", "", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM embiam_role`)
+		if err != nil {
+			return err
+		}
+		for role, roleBody := range roleMap {
+			jsonbytes, err := json.Marshal(roleBody)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(m.rebind(`INSERT INTO embiam_role (role, data) VALUES (?, ?)`), string(role), string(jsonbytes))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// saveDefaultRoles replaces the default roles in one transaction
+func (m *DbSQL) saveDefaultRoles(defaultRoles []RoleIdType) error {
+	return m.transaction("save default roles", "", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM embiam_default_role`)
+		if err != nil {
+			return err
+		}
+		for position, role := range defaultRoles {
+			_, err = tx.Exec(m.rebind(`INSERT INTO embiam_default_role (position, role) VALUES (?, ?)`), position, string(role))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *DbSQL) SaveIdentityToken(tokenHash string, identityToken StoredIdentityToken) error {
+	return m.saveJSON("save identity token", tokenHash, `embiam_identity_token`, `token_hash`, tokenHash, identityToken)
+}
+
+func (m *DbSQL) DeleteIdentityToken(tokenHash string) error {
+	_, err := m.DB.Exec(m.rebind(`DELETE FROM embiam_identity_token WHERE token_hash = ?`), tokenHash)
+	if err != nil {
+		return newDbError("delete identity token", tokenHash, err, nil)
+	}
+	return nil
+}
+
+func (m *DbSQL) ReadIdentityTokens() (map[string]StoredIdentityToken, error) {
+	tokens := make(map[string]StoredIdentityToken)
+	err := m.readJSONRows("read identity tokens", `SELECT token_hash, data FROM embiam_identity_token`, func(tokenHash string, data []byte) error {
+		identityToken := StoredIdentityToken{}
+		err := json.Unmarshal(data, &identityToken)
+		tokens[tokenHash] = identityToken
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// SaveSigningKeys replaces all signing keys in one transaction
+func (m *DbSQL) SaveSigningKeys(keys []StoredSigningKey) error {
+	return m.transaction("save signing keys", "", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM embiam_signing_key`)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			jsonbytes, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(m.rebind(`INSERT INTO embiam_signing_key (key_id, data) VALUES (?, ?)`), key.KeyId, string(jsonbytes))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *DbSQL) ReadSigningKeys() ([]StoredSigningKey, error) {
+	keys := []StoredSigningKey{}
+	err := m.readJSONRows("read signing keys", `SELECT key_id, data FROM embiam_signing_key`, func(_ string, data []byte) error {
+		key := StoredSigningKey{}
+		err := json.Unmarshal(data, &key)
+		keys = append(keys, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// transaction calls f within a transaction, that is committed if f returns nil and rolled back otherwise
+// errors are returned as DbError with operation and key
+func (m *DbSQL) transaction(operation, key string, f func(tx *sql.Tx) error) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return newDbError(operation, key, err, nil)
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return newDbError(operation, key, err, nil)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return newDbError(operation, key, err, nil)
+	}
+	return nil
+}
+
+// saveJSON replaces the row with the key value in table with the JSON of v
+func (m *DbSQL) saveJSON(operation, key, table, keyColumn, keyValue string, v interface{}) error {
+	jsonbytes, err := json.Marshal(v)
+	if err != nil {
+		return newDbError(operation, key, err, nil)
+	}
+	return m.transaction(operation, key, func(tx *sql.Tx) error {
+		_, err := tx.Exec(m.rebind(`DELETE FROM `+table+` WHERE `+keyColumn+` = ?`), keyValue)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(m.rebind(`INSERT INTO `+table+` (`+keyColumn+`, data) VALUES (?, ?)`), keyValue, string(jsonbytes))
+		return err
+	})
+}
+
+// readJSON reads the column data of one row and unmarshals it into v, notFound is returned, if there is no row
+func (m *DbSQL) readJSON(operation, key string, notFound error, v interface{}, query string, args ...interface{}) error {
+	var data string
+	err := m.DB.QueryRow(m.rebind(query), args...).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &DbError{Operation: operation, Key: key, Err: notFound}
+	}
+	if err != nil {
+		return newDbError(operation, key, err, nil)
+	}
+	err = json.Unmarshal([]byte(data), v)
+	if err != nil {
+		return newDbError(operation, key, err, nil)
+	}
+	return nil
+}
+
+// readJSONRows calls f for the key and the data of every row of query
+func (m *DbSQL) readJSONRows(operation, query string, f func(key string, data []byte) error) error {
+	rows, err := m.DB.Query(query)
+	if err != nil {
+		return newDbError(operation, "", err, nil)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, data string
+		err = rows.Scan(&key, &data)
+		if err == nil {
+			err = f(key, []byte(data))
+		}
+		if err != nil {
+			return newDbError(operation, key, err, nil)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return newDbError(operation, "", err, nil)
+	}
+	return nil
+}
+
+// readColumn returns the values of the first column of all rows of query (e.g. nicks)
+func (m *DbSQL) readColumn(operation, key, query string, args ...interface{}) ([]string, error) {
+	rows, err := m.DB.Query(m.rebind(query), args...)
+	if err != nil {
+		return nil, newDbError(operation, key, err, nil)
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			return nil, newDbError(operation, key, err, nil)
+		}
+		values = append(values, value)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, newDbError(operation, key, err, nil)
+	}
+	return values, nil
+}
+
+// rebind replaces the placeholders ? by $1, $2, ... for Postgres
+func (m *DbSQL) rebind(query string) string {
+	if m.Dialect != SQLDialectPostgres {
+		return query
+	}
+	var result strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			result.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		result.WriteRune(c)
+	}
+	return result.String()
+}
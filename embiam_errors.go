@@ -0,0 +1,148 @@
+package embiam
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+/********************************************************************
+	ERRORS
+	The functions of embiam return the errors below (or errors
+	wrapping them), so that callers can check them with errors.Is
+	and errors.As, e.g. to map them to HTTP status codes.
+
+		_, err := embiam.CheckIdentity(nick, password, validFor)
+		if errors.Is(err, embiam.ErrInvalidCredentials) {
+			...
+		}
+
+	Errors of Db implementations are wrapped in DbError, that
+	contains the operation and the key (e.g. the nick).
+********************************************************************/
+
+var (
+	// entity
+	ErrEntityNotFound      = errors.New("entity not found")
+	ErrEntityExists        = errors.New("entity already exists")
+	ErrEntityInactive      = errors.New("entity is not active")
+	ErrEntityLocked        = errors.New("entity is temporarily locked")
+	ErrInvalidNick         = errors.New("invalid nick")
+	ErrInvalidCredentials  = errors.New("invalid credentials")
+	ErrInvalidAuthValue    = errors.New("invalid authorization")
+	ErrInvalidSecret       = fmt.Errorf("%w (secret)", ErrInvalidCredentials)        // wraps ErrInvalidCredentials
+	ErrInvalidRecoveryCode = fmt.Errorf("%w (recovery code)", ErrInvalidCredentials) // wraps ErrInvalidCredentials
+	ErrRateLimited         = errors.New("too many sign in attempts")
+	ErrPasswordPolicy      = errors.New("password violates policy")
+	ErrPasswordExpired     = errors.New("password expired, change required")
+
+	// password hash
+	ErrUnknownHash = errors.New("unknown hash algorithm") // no PasswordHasher handles the hash
+
+	// one-time password (TOTP)
+	ErrOTPRequired     = errors.New("one-time password required")
+	ErrInvalidOTP      = errors.New("invalid one-time password")
+	ErrTOTPNotEnrolled = errors.New("TOTP is not enrolled")
+	ErrTOTPEnabled     = errors.New("TOTP is already enabled")
+
+	// entity token
+	ErrEntityTokenNotFound = errors.New("entity token not found")
+	ErrEntityTokenExpired  = errors.New("validity of entity token expired")
+	ErrInvalidPIN          = errors.New("invalid PIN")
+
+	// identity token and refresh token
+	ErrInvalidIdentityToken    = errors.New("invalid identity token")
+	ErrIdentityTokenExpired    = errors.New("validity of identity token expired")
+	ErrIdentityTokenCacheFull  = errors.New("identity token cache is full")
+	ErrUnknownSigningKey       = errors.New("unknown signing key")
+	ErrIdentityTokenRestricted = errors.New("identity token is restricted to the password change")
+	ErrInvalidRefreshToken     = errors.New("invalid refresh token")
+	ErrRefreshTokenReused      = errors.New("refresh token was already used, session revoked")
+	ErrRefreshTokenExpired     = errors.New("validity of refresh token expired")
+	ErrSessionExpired          = errors.New("session expired")
+	ErrSessionRevoked          = errors.New("session was revoked")
+
+	// role
+	ErrRoleNotFound = errors.New("role doesn't exist")
+	ErrRoleCycle    = errors.New("role leads to cycle")
+
+	// configuration
+	ErrInvalidConfiguration = errors.New("invalid configuration")
+
+	// database
+	ErrDbLocked = errors.New("database is locked by another process")
+)
+
+// DbError is returned by the Db implementations, Err is the cause (e.g. ErrEntityNotFound)
+type DbError struct {
+	Operation string // e.g. "read entity"
+	Key       string // e.g. the nick
+	Err       error
+}
+
+func (e *DbError) Error() string {
+	if e.Key == "" {
+		return e.Operation + ": " + e.Err.Error()
+	}
+	return e.Operation + " " + e.Key + ": " + e.Err.Error()
+}
+
+func (e *DbError) Unwrap() error {
+	return e.Err
+}
+
+// newDbError wraps err of a Db operation, if the file doesn't exist notFound is the cause instead of err
+func newDbError(operation, key string, err error, notFound error) error {
+	if notFound != nil && os.IsNotExist(err) {
+		err = notFound
+	}
+	return &DbError{Operation: operation, Key: key, Err: err}
+}
+
+// LockedError is returned by CheckIdentity during the lock after too many wrong passwords, Until is the end of the lock
+type LockedError struct {
+	Until time.Time
+}
+
+func (e *LockedError) Error() string {
+	return ErrEntityLocked.Error() + " until " + e.Until.Format(time.RFC3339)
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrEntityLocked
+}
+
+// RateLimitError is returned by CheckIdentity, if the client or the nick exceeded the rate limit of sign in attempts
+type RateLimitError struct {
+	RetryAfter time.Duration // time until the next sign in attempt is accepted
+}
+
+func (e *RateLimitError) Error() string {
+	return ErrRateLimited.Error() + ", retry after " + e.RetryAfter.String()
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// RoleError is returned for inconsistent roles, Err is ErrRoleNotFound or ErrRoleCycle
+type RoleError struct {
+	RoleId          RoleIdType
+	ContainedRoleId RoleIdType // undefined role contained in RoleId
+	Err             error
+}
+
+func (e *RoleError) Error() string {
+	if e.ContainedRoleId != "" {
+		return fmt.Sprintf("role %s contains undefined role %s", e.RoleId, e.ContainedRoleId)
+	}
+	if e.Err == ErrRoleCycle {
+		return fmt.Sprintf("role %s leads to cycle", e.RoleId)
+	}
+	return fmt.Sprintf("role '%s' doesn't exist", e.RoleId)
+}
+
+func (e *RoleError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,79 @@
+package embiam
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestErrors(t *testing.T) {
+	const testNick = `N1CK0001`
+
+	// initialize embiam
+	Initialize(new(DbTransient))
+	e := Entity{
+		Nick:         testNick,
+		PasswordHash: testHash(t, testPassword),
+		Active:       true,
+		Roles:        []RoleIdType{`application`},
+	}
+	Db.SaveEntity(&e)
+
+	// identity
+	_, err := CheckIdentity(`UNKNOWN`, testPassword, testHost)
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("CheckIdentity(UNKNOWN, ...) returned error %v; want ErrInvalidCredentials\n", err)
+	}
+	_, err = CheckIdentity(testNick, `wrong`, testHost)
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("CheckIdentity(testNick, wrong, testHost) returned error %v; want ErrInvalidCredentials\n", err)
+	}
+	_, _, err = CheckAuthIdentity(`basic xyz`, testHost)
+	if !errors.Is(err, ErrInvalidAuthValue) {
+		t.Errorf("CheckAuthIdentity(basic xyz, testHost) returned error %v; want ErrInvalidAuthValue\n", err)
+	}
+	DeactivateEntity(testNick)
+	_, err = CheckIdentity(testNick, testPassword, testHost)
+	if !errors.Is(err, ErrEntityInactive) {
+		t.Errorf("CheckIdentity(...) for inactive entity returned error %v; want ErrEntityInactive\n", err)
+	}
+
+	// Db errors are wrapped in DbError
+	_, err = Db.ReadEntityByNick(`UNKNOWN`)
+	dbError := &DbError{}
+	if !errors.Is(err, ErrEntityNotFound) || !errors.As(err, &dbError) || dbError.Key != `UNKNOWN` {
+		t.Errorf("Db.ReadEntityByNick(UNKNOWN) returned error %v; want DbError with ErrEntityNotFound\n", err)
+	}
+
+	// entity token
+	_, err = NewEntity(`unknown`, `123456`)
+	if !errors.Is(err, ErrEntityTokenNotFound) {
+		t.Errorf("NewEntity(unknown, ...) returned error %v; want ErrEntityTokenNotFound\n", err)
+	}
+	entityToken, _ := NewEntityToken()
+	_, err = NewEntity(entityToken.Token, `wrong`)
+	if !errors.Is(err, ErrInvalidPIN) {
+		t.Errorf("NewEntity(..., wrong) returned error %v; want ErrInvalidPIN\n", err)
+	}
+	entityToken.ValidUntil = time.Now().UTC().Add(-time.Second)
+	Db.saveEntityToken(&entityToken)
+	_, err = NewEntity(entityToken.Token, entityToken.Pin)
+	if !errors.Is(err, ErrEntityTokenExpired) {
+		t.Errorf("NewEntity(...) with expired entity token returned error %v; want ErrEntityTokenExpired\n", err)
+	}
+
+	// roles
+	err = SaveRoles(RoleCacheMap{`a`: {ContainedRole: []RoleIdType{`b`}}, `b`: {ContainedRole: []RoleIdType{`a`}}})
+	roleError := &RoleError{}
+	if !errors.Is(err, ErrRoleCycle) || !errors.As(err, &roleError) {
+		t.Errorf("SaveRoles(...) with cycle returned error %v; want RoleError with ErrRoleCycle\n", err)
+	}
+	err = SaveDefaultRoles([]RoleIdType{`unknown`})
+	if !errors.Is(err, ErrRoleNotFound) {
+		t.Errorf("SaveDefaultRoles(unknown) returned error %v; want ErrRoleNotFound\n", err)
+	}
+	_, err = CreateEntity(testNick, nil)
+	if !errors.Is(err, ErrEntityExists) {
+		t.Errorf("CreateEntity(testNick, nil) returned error %v; want ErrEntityExists\n", err)
+	}
+}
@@ -0,0 +1,141 @@
+package embiam
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/********************************************************************
+	GENERATORS
+
+	Identity tokens, entity tokens, nicks, PINs, passwords, secrets
+	and the ServerId are generated from a RandomSource. By default
+	crypto/rand is used. The characters are selected by rejection
+	sampling, so every character of an alphabet has exactly the
+	same probability (no modulo bias).
+
+	Entropy of the generated artifacts
+	  identity token   24 of 80 tokenChars      ~151.7 bit
+	  entity token     32 of 33 nickChars       ~161.4 bit
+	  PIN               6 of 33 nickChars        ~30.3 bit
+	  nick              8 of 33 nickChars        ~40.4 bit (not a secret)
+	  password         32 of 62 passwordChars   ~190.5 bit
+	  secret           64 of 62 passwordChars   ~381.1 bit
+	  ServerId         16 random bytes            128 bit
+	  recovery code    10 of 33 nickChars        ~50.4 bit
+	  TOTP seed        20 random bytes            160 bit
+	  encryption key   32 random bytes            256 bit
+********************************************************************/
+
+var tokenChars = []byte(`123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz.,-+#(){}[];:_*!$%=?|@~`)
+var nickChars = []byte("123456789ABCDEFGHJKLMNPQRSTUVWXYZ")
+var passwordChars = []byte("123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz.,-+#")
+
+// RandomSource provides the random bytes for all generators
+// crypto/rand is used by default; a deterministic source can be set for tests
+type RandomSource interface {
+	Read(b []byte) (n int, err error)
+}
+
+var randomSource RandomSource = rand.Reader
+
+// SetRandomSource replaces the source of random bytes, nil restores crypto/rand
+func SetRandomSource(rs RandomSource) {
+	if rs == nil {
+		rs = rand.Reader
+	}
+	randomSource = rs
+}
+
+// randomBytes reads length bytes from the random source
+// a failing random source is not recoverable, so randomBytes panics like Hash
+func randomBytes(length int) []byte {
+	b := make([]byte, length)
+	_, err := io.ReadFull(randomSource, b)
+	if err != nil {
+		panic(fmt.Sprintf("embiam: reading from random source failed: %s", err))
+	}
+	return b
+}
+
+// randomString generates a string of length characters out of chars (at most 256 characters)
+func randomString(length int, chars []byte) string {
+	// bytes >= limit are rejected, so that limit is a multiple of len(chars)
+	limit := 256 - 256%len(chars)
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		for _, b := range randomBytes(length - len(result)) {
+			if int(b) >= limit {
+				continue
+			}
+			result = append(result, chars[int(b)%len(chars)])
+		}
+	}
+	return string(result)
+}
+
+// generateIdentityToken generates a identity token
+func generateIdentityToken() string {
+	const tokenLength = 24
+	return randomString(tokenLength, tokenChars)
+}
+
+// generateNick generates a nick
+func generateNick() string {
+	const nickLength = 8
+	return randomString(nickLength, nickChars)
+}
+
+// generatePin generates a PIN
+func generatePin() string {
+	const pinLength = 6
+	return randomString(pinLength, nickChars)
+}
+
+// generatePassword generates a password
+func generatePassword(length int) string {
+	return randomString(length, passwordChars)
+}
+
+// generateEntityToken generates a valid entity token
+func generateEntityToken() string {
+	const tokenLength = 32
+	return randomString(tokenLength, nickChars)
+}
+
+// generateRecoveryCode generates a recovery code, e.g. 4KZ7Q-M2PXW
+func generateRecoveryCode() string {
+	const partLength = 5
+	return randomString(partLength, nickChars) + "-" + randomString(partLength, nickChars)
+}
+
+// generateEncryptionKey generates a base64-encoded 256-bit key, e.g. for the encryption of TOTP seeds
+func generateEncryptionKey() string {
+	return base64.StdEncoding.EncodeToString(randomBytes(32))
+}
+
+// random 128-bit Id of the server
+type ServerId [2]uint64
+
+// New generates a new ServerId
+func (id *ServerId) New() {
+	b := randomBytes(16)
+	id[0] = binary.BigEndian.Uint64(b[0:8])
+	id[1] = binary.BigEndian.Uint64(b[8:16])
+}
+
+// Stringer for ServerId
+func (id *ServerId) String() string {
+	a := id[0] & 0xffff
+	b := id[0] >> 16 & 0xffff
+	c := id[0] >> 32 & 0xffff
+	d := id[0] >> 48 & 0xffff
+	e := id[1] & 0xffff
+	f := id[1] >> 16 & 0xffff
+	g := id[1] >> 32 & 0xffff
+	h := id[1] >> 48 & 0xffff
+	return fmt.Sprintf("%04x.%04x.%04x.%04x-%04x.%04x.%04x.%04x", h, g, f, e, d, c, b, a)
+}
@@ -0,0 +1,99 @@
+package embiam
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// sequenceSource is a deterministic RandomSource that repeats its bytes
+type sequenceSource struct {
+	sequence []byte
+	position int
+}
+
+func (s *sequenceSource) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = s.sequence[s.position%len(s.sequence)]
+		s.position++
+	}
+	return len(b), nil
+}
+
+func TestGeneratorDeterministic(t *testing.T) {
+	defer SetRandomSource(nil)
+
+	// the same sequence leads to the same results
+	SetRandomSource(&sequenceSource{sequence: []byte{0, 1, 2, 3, 4, 5, 6, 7}})
+	nick1 := generateNick()
+	SetRandomSource(&sequenceSource{sequence: []byte{0, 1, 2, 3, 4, 5, 6, 7}})
+	nick2 := generateNick()
+	if nick1 != nick2 {
+		t.Errorf("generateNick() returned %s and %s for the same random source; want equal nicks\n", nick1, nick2)
+	}
+	if nick1 != "12345678" {
+		t.Errorf("generateNick() returned %s; want 12345678\n", nick1)
+	}
+
+	// bytes that would lead to modulo bias are rejected
+	// nickChars has 33 characters, so only bytes below 231 (7*33) are used
+	SetRandomSource(&sequenceSource{sequence: []byte{231, 255, 33, 240, 34}})
+	pin := generatePin()
+	if pin != "121212" {
+		t.Errorf("generatePin() returned %s; want 121212\n", pin)
+	}
+
+	// ServerId is taken from the random source
+	SetRandomSource(&sequenceSource{sequence: []byte{0x12, 0x34}})
+	sid := ServerId{}
+	sid.New()
+	if sid.String() != "1234.1234.1234.1234-1234.1234.1234.1234" {
+		t.Errorf("sid.String() returned %s; want 1234.1234.1234.1234-1234.1234.1234.1234\n", sid.String())
+	}
+}
+
+func TestGeneratorCharacters(t *testing.T) {
+	// generated values have the right length and only use the characters of their alphabet
+	checks := []struct {
+		name   string
+		value  string
+		length int
+		chars  []byte
+	}{
+		{"generateIdentityToken()", generateIdentityToken(), 24, tokenChars},
+		{"generateNick()", generateNick(), 8, nickChars},
+		{"generatePin()", generatePin(), 6, nickChars},
+		{"generatePassword(32)", generatePassword(32), 32, passwordChars},
+		{"generatePassword(64)", generatePassword(64), 64, passwordChars},
+		{"generateEntityToken()", generateEntityToken(), 32, nickChars},
+	}
+	for _, check := range checks {
+		if len(check.value) != check.length {
+			t.Errorf("%s returned %d characters; want %d\n", check.name, len(check.value), check.length)
+		}
+		for _, c := range []byte(check.value) {
+			if bytes.IndexByte(check.chars, c) < 0 {
+				t.Errorf("%s returned %s with invalid character %c\n", check.name, check.value, c)
+			}
+		}
+	}
+
+	// every character of the alphabet is used
+	sample := randomString(100*len(tokenChars), tokenChars)
+	for _, c := range tokenChars {
+		if !strings.ContainsRune(sample, rune(c)) {
+			t.Errorf("randomString(...) never returned character %c; want all characters\n", c)
+		}
+	}
+
+	// each alphabet contains every character only once
+	for _, chars := range [][]byte{tokenChars, nickChars, passwordChars} {
+		seen := map[byte]struct{}{}
+		for _, c := range chars {
+			if _, ok := seen[c]; ok {
+				t.Errorf("alphabet %s contains %c more than once\n", chars, c)
+			}
+			seen[c] = struct{}{}
+		}
+	}
+}
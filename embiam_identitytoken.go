@@ -0,0 +1,443 @@
+package embiam
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+/********************************************************************
+	IDENTITY TOKEN CACHE
+	An identity token is provides after authentication with
+	nick and password. For the subsequent actions (e.g. API calls)
+	the client (API consumer) is only using the identity token
+	instead of the credentials (nick and password).
+	So an identity token completely different than the entity token.
+
+	The cache is a map with the hash of the token as key and it
+	is protected by a read-write mutex, because it's used by
+	concurrent requests. A background sweeper removes expired
+	tokens. All changes are written to a TokenStore, so that
+	identity tokens survive a restart.
+	Identity tokens can be revoked before the end of their
+	validity, e.g. when the entity signs out.
+********************************************************************/
+
+type (
+	// identityTokenCacheItemStruct describes on record of the internal list of provided identity tokens
+	identityTokenCacheItemStruct struct {
+		IssuedAt   time.Time
+		ValidUntil time.Time
+		ValidFor   string // identification of the caller, e.g. the IP
+		Nick       string
+		Family     string // session of refresh tokens the identity token belongs to
+		Restricted bool   // only authorized for the password change (see Entity.MustChangePassword)
+	}
+
+	// identityTokenCacheType is the actual type of the cache for identity tokens
+	identityTokenCacheType struct {
+		mutex         sync.RWMutex
+		cache         map[string]identityTokenCacheItemStruct // key is the hash of the token
+		maxSize       int                                     // maximum number of tokens, 0 means unlimited
+		revokedBefore time.Time                               // tokens issued before are invalid
+		store         TokenStore                              // persistence of the tokens
+		stopSweeper   chan struct{}
+	}
+
+	// identityTokenStruct is the type for the identity token send to the client, containing the actual token and validUntil
+	// and the refresh token to get a new identity token without credentials
+	identityTokenStruct struct {
+		Token             string     `json:"token"`
+		ValidUntil        time.Time  `json:"validUntil"`
+		RefreshToken      string     `json:"refreshToken,omitempty"`
+		RefreshValidUntil *time.Time `json:"refreshValidUntil,omitempty"` // nil without refresh token
+		// the token is restricted to the password change, see Entity.MustChangePassword
+		MustChangePassword bool `json:"mustChangePassword,omitempty"`
+	}
+)
+
+var identityTokenCache identityTokenCacheType
+
+// initialize empties the cache, sets its maximum size and (re)starts the sweeper
+func (itc *identityTokenCacheType) initialize(maxSize int, sweepInterval time.Duration) {
+	itc.mutex.Lock()
+	defer itc.mutex.Unlock()
+
+	// stop sweeper of previous initialization
+	if itc.stopSweeper != nil {
+		close(itc.stopSweeper)
+		itc.stopSweeper = nil
+	}
+
+	itc.cache = make(map[string]identityTokenCacheItemStruct)
+	itc.maxSize = maxSize
+	itc.revokedBefore = time.Time{}
+	itc.store = new(MemoryTokenStore)
+
+	// start sweeper
+	if sweepInterval > 0 {
+		itc.stopSweeper = make(chan struct{})
+		go itc.sweep(sweepInterval, itc.stopSweeper)
+	}
+}
+
+// load replaces the token store and adds the live tokens of the store to the cache
+// expired tokens are deleted from the store, the nicks of the loaded tokens are returned
+func (itc *identityTokenCacheType) load(store TokenStore) (nicks map[string]struct{}, err error) {
+	storedTokens, err := store.ReadIdentityTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	itc.mutex.Lock()
+	itc.store = store
+	now := time.Now().UTC()
+	nicks = map[string]struct{}{}
+	expiredKeys := []string{}
+	for key, storedToken := range storedTokens {
+		if storedToken.ValidUntil.Before(now) {
+			expiredKeys = append(expiredKeys, key)
+			continue
+		}
+		itc.cache[key] = identityTokenCacheItemStruct{
+			IssuedAt:   storedToken.IssuedAt,
+			ValidUntil: storedToken.ValidUntil,
+			ValidFor:   storedToken.ValidFor,
+			Nick:       storedToken.Nick,
+			Family:     storedToken.Family,
+			Restricted: storedToken.Restricted,
+		}
+		nicks[storedToken.Nick] = struct{}{}
+	}
+	itc.mutex.Unlock()
+
+	return nicks, itc.deleteFromStore(store, expiredKeys)
+}
+
+// sweep removes expired tokens every interval until stop is closed
+func (itc *identityTokenCacheType) sweep(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now().UTC()
+			err := itc.removeWhere(func(item identityTokenCacheItemStruct) bool {
+				return item.ValidUntil.Before(now)
+			})
+			if err != nil {
+				log.Printf("Error removing expired identity tokens: %s\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// add a new token to the identity token cache (and to the token store)
+func (itc *identityTokenCacheType) add(token string, validUntil time.Time, validFor, nick, family string, restricted bool) error {
+	key := hashToken(token)
+	now := time.Now().UTC()
+	item := identityTokenCacheItemStruct{
+		IssuedAt:   now,
+		ValidUntil: validUntil,
+		ValidFor:   validFor,
+		Nick:       nick,
+		Family:     family,
+		Restricted: restricted,
+	}
+
+	itc.mutex.Lock()
+	if itc.cache == nil {
+		itc.cache = make(map[string]identityTokenCacheItemStruct)
+	}
+	if itc.store == nil {
+		itc.store = new(MemoryTokenStore)
+	}
+	expiredKeys := []string{}
+	if itc.maxSize > 0 && len(itc.cache) >= itc.maxSize {
+		// make room by removing expired tokens before the sweeper does
+		expiredKeys = itc.removeWhereLocked(func(item identityTokenCacheItemStruct) bool {
+			return item.ValidUntil.Before(now)
+		})
+		if len(itc.cache) >= itc.maxSize {
+			itc.mutex.Unlock()
+			return ErrIdentityTokenCacheFull
+		}
+	}
+	itc.cache[key] = item
+	store := itc.store
+	itc.mutex.Unlock()
+
+	// persist token (only the hash of the token is saved)
+	err := itc.deleteFromStore(store, expiredKeys)
+	if err != nil {
+		return err
+	}
+	return store.SaveIdentityToken(key, StoredIdentityToken{
+		IssuedAt:   item.IssuedAt,
+		ValidUntil: item.ValidUntil,
+		ValidFor:   item.ValidFor,
+		Nick:       item.Nick,
+		Family:     item.Family,
+		Restricted: item.Restricted,
+	})
+}
+
+// get returns the cache item for a token, if the token exists and is still valid
+func (itc *identityTokenCacheType) get(token string) (identityTokenCacheItemStruct, bool) {
+	key := hashToken(token)
+	itc.mutex.RLock()
+	item, ok := itc.cache[key]
+	revokedBefore := itc.revokedBefore
+	itc.mutex.RUnlock()
+	if !ok || item.ValidUntil.Before(time.Now().UTC()) || item.IssuedAt.Before(revokedBefore) {
+		return identityTokenCacheItemStruct{}, false
+	}
+	return item, true
+}
+
+// remove deletes a token from the cache
+func (itc *identityTokenCacheType) remove(token string) error {
+	key := hashToken(token)
+	itc.mutex.Lock()
+	_, ok := itc.cache[key]
+	delete(itc.cache, key)
+	store := itc.store
+	itc.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return itc.deleteFromStore(store, []string{key})
+}
+
+// removeNick deletes all tokens of nick from the cache
+func (itc *identityTokenCacheType) removeNick(nick string) error {
+	return itc.removeWhere(func(item identityTokenCacheItemStruct) bool {
+		return item.Nick == nick
+	})
+}
+
+// removeFamily deletes all tokens of a family of refresh tokens from the cache
+func (itc *identityTokenCacheType) removeFamily(family string) error {
+	return itc.removeWhere(func(item identityTokenCacheItemStruct) bool {
+		return item.Family == family
+	})
+}
+
+// removeIssuedBefore deletes all tokens issued before t and rejects them, if they are added again
+func (itc *identityTokenCacheType) removeIssuedBefore(t time.Time) error {
+	itc.mutex.Lock()
+	if t.After(itc.revokedBefore) {
+		itc.revokedBefore = t
+	}
+	itc.mutex.Unlock()
+	return itc.removeWhere(func(item identityTokenCacheItemStruct) bool {
+		return item.IssuedAt.Before(t)
+	})
+}
+
+// removeWhere deletes all tokens matching remove from the cache and from the token store
+func (itc *identityTokenCacheType) removeWhere(remove func(item identityTokenCacheItemStruct) bool) error {
+	itc.mutex.Lock()
+	removedKeys := itc.removeWhereLocked(remove)
+	store := itc.store
+	itc.mutex.Unlock()
+	return itc.deleteFromStore(store, removedKeys)
+}
+
+// removeWhereLocked deletes all tokens matching remove from the cache and returns their keys, the caller must hold the lock
+func (itc *identityTokenCacheType) removeWhereLocked(remove func(item identityTokenCacheItemStruct) bool) []string {
+	removedKeys := []string{}
+	for key, item := range itc.cache {
+		if remove(item) {
+			delete(itc.cache, key)
+			removedKeys = append(removedKeys, key)
+		}
+	}
+	return removedKeys
+}
+
+// deleteFromStore deletes tokens (identified by the hash of the token) from the token store
+func (itc *identityTokenCacheType) deleteFromStore(store TokenStore, keys []string) error {
+	if store == nil {
+		return nil
+	}
+	for _, key := range keys {
+		err := store.DeleteIdentityToken(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isIdentityTokenValid checks if an identity token is valid
+func (itc *identityTokenCacheType) isIdentityTokenValid(tokenToTest string, validFor string) bool {
+	if len(tokenToTest) == 0 {
+		return false
+	}
+	item, ok := itc.get(tokenToTest)
+	if !ok {
+		return false
+	}
+	// check if client's address is correct
+	return item.ValidFor == validFor
+}
+
+// isRestricted reports if a valid identity token is restricted to the password change
+func (itc *identityTokenCacheType) isRestricted(token string) bool {
+	item, ok := itc.get(token)
+	return ok && item.Restricted
+}
+
+// getNick returns the nick for a valid identity token
+func (itc *identityTokenCacheType) getNick(token string) (nick string) {
+	item, ok := itc.get(token)
+	if !ok {
+		return ""
+	}
+	return item.Nick
+}
+
+// size returns the number of tokens in the cache (including expired tokens, that are not swept yet)
+func (itc *identityTokenCacheType) size() int {
+	itc.mutex.RLock()
+	defer itc.mutex.RUnlock()
+	return len(itc.cache)
+}
+
+/********************************************************************
+	REVOCATION
+	Identity tokens are revoked individually (sign out), for all
+	tokens of a nick (e.g. the entity was deactivated or deleted)
+	or for all tokens issued before a certain time (kill switch).
+	The refresh tokens of the affected sessions are revoked too.
+********************************************************************/
+
+// RevokeIdentityToken invalidates an identity token before the end of its validity, e.g. to sign out
+// the refresh tokens of the token's session are revoked too
+func RevokeIdentityToken(token string) error {
+	item, ok := identityTokenCache.get(token)
+	err := identityTokenCache.remove(token)
+	if err != nil {
+		return err
+	}
+	if ok && item.Family != "" {
+		return revokeFamily(item.Family)
+	}
+	return nil
+}
+
+// RevokeAllIdentityTokensForNick invalidates all identity tokens and refresh tokens of a nick
+func RevokeAllIdentityTokensForNick(nick string) error {
+	refreshTokenCache.removeNick(nick)
+	return identityTokenCache.removeNick(nick)
+}
+
+// RevokeIdentityTokensIssuedBefore invalidates all identity tokens issued and sessions started before t
+// use time.Now() to sign out everybody
+func RevokeIdentityTokensIssuedBefore(t time.Time) error {
+	refreshTokenCache.removeStartedBefore(t.UTC())
+	return identityTokenCache.removeIssuedBefore(t.UTC())
+}
+
+// revokeFamily invalidates all identity tokens and refresh tokens of a session
+func revokeFamily(family string) error {
+	refreshTokenCache.removeFamily(family)
+	return identityTokenCache.removeFamily(family)
+}
+
+/********************************************************************
+	TOKEN STORE
+	The token store persists the identity tokens, so that they
+	survive a restart. Only the SHA-256 hash of a token is stored
+	(as hex string), together with issue time, validity, validFor,
+	nick and the session (family of refresh tokens), so that the
+	revocation works for reloaded tokens too.
+	DbFile and DbTransient implement TokenStore, for other Db
+	implementations the MemoryTokenStore is used.
+********************************************************************/
+
+type (
+	// TokenStore persists identity tokens identified by the hash of the token
+	TokenStore interface {
+		SaveIdentityToken(tokenHash string, identityToken StoredIdentityToken) error
+		DeleteIdentityToken(tokenHash string) error
+		ReadIdentityTokens() (map[string]StoredIdentityToken, error)
+	}
+
+	// StoredIdentityToken is an identity token in the token store (without the token itself)
+	StoredIdentityToken struct {
+		IssuedAt   time.Time `json:"issuedAt"` // for RevokeIdentityTokensIssuedBefore
+		ValidUntil time.Time `json:"validUntil"`
+		ValidFor   string    `json:"validFor"`
+		Nick       string    `json:"nick"`
+		Family     string    `json:"family,omitempty"` // session of refresh tokens
+		Restricted bool      `json:"restricted,omitempty"`
+	}
+
+	// MemoryTokenStore is a non-persistent token store
+	MemoryTokenStore struct {
+		mutex  sync.Mutex
+		tokens map[string]StoredIdentityToken
+	}
+)
+
+// InitializeTokenStore sets the token store for identity tokens and loads its live tokens, it's called by Initialize
+// the authorizations of the loaded nicks are added to the cache; tokens of inactive or missing entities are revoked
+func InitializeTokenStore(store TokenStore) error {
+	nicks, err := identityTokenCache.load(store)
+	if err != nil {
+		return err
+	}
+	for nick := range nicks {
+		entity, err := Db.ReadEntityByNick(nick)
+		if err == nil && entity.Active {
+			err = AddNicksAuthorizationsToCache(entity)
+		}
+		if err != nil || !entity.Active {
+			log.Printf("Identity tokens of %s are revoked while loading token store\n", nick)
+			err = identityTokenCache.removeNick(nick)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hashToken calculates the SHA-256 hash of a token as hex string
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func (m *MemoryTokenStore) SaveIdentityToken(tokenHash string, identityToken StoredIdentityToken) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.tokens == nil {
+		m.tokens = make(map[string]StoredIdentityToken)
+	}
+	m.tokens[tokenHash] = identityToken
+	return nil
+}
+
+func (m *MemoryTokenStore) DeleteIdentityToken(tokenHash string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.tokens, tokenHash)
+	return nil
+}
+
+func (m *MemoryTokenStore) ReadIdentityTokens() (map[string]StoredIdentityToken, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	tokens := make(map[string]StoredIdentityToken, len(m.tokens))
+	for tokenHash, identityToken := range m.tokens {
+		tokens[tokenHash] = identityToken
+	}
+	return tokens, nil
+}
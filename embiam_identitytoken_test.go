@@ -0,0 +1,391 @@
+package embiam
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdentityTokenCache(t *testing.T) {
+	itc := identityTokenCacheType{}
+	itc.initialize(3, 0)
+
+	now := time.Now().UTC()
+	err := itc.add(`token1`, now.Add(time.Minute), testHost, `N1CK0001`, ``, false)
+	if err != nil {
+		t.Errorf("itc.add(token1, ...) returned error %s; want no error\n", err)
+	}
+	err = itc.add(`token2`, now.Add(-time.Minute), testHost, `N1CK0002`, ``, false) // already expired
+	if err != nil {
+		t.Errorf("itc.add(token2, ...) returned error %s; want no error\n", err)
+	}
+
+	// valid token
+	if !itc.isIdentityTokenValid(`token1`, testHost) {
+		t.Errorf("itc.isIdentityTokenValid(token1, testHost) returned false; want true\n")
+	}
+	if itc.isIdentityTokenValid(`token1`, `192.168.1.1`) {
+		t.Errorf("itc.isIdentityTokenValid(token1, 192.168.1.1) returned true for other client; want false\n")
+	}
+	if itc.getNick(`token1`) != `N1CK0001` {
+		t.Errorf("itc.getNick(token1) returned %s; want N1CK0001\n", itc.getNick(`token1`))
+	}
+
+	// expired and unknown tokens
+	if itc.isIdentityTokenValid(`token2`, testHost) {
+		t.Errorf("itc.isIdentityTokenValid(token2, testHost) returned true for expired token; want false\n")
+	}
+	if itc.getNick(`token2`) != `` {
+		t.Errorf("itc.getNick(token2) returned %s for expired token; want empty nick\n", itc.getNick(`token2`))
+	}
+	if itc.isIdentityTokenValid(``, testHost) || itc.isIdentityTokenValid(`unknown`, testHost) {
+		t.Errorf("itc.isIdentityTokenValid() returned true for empty or unknown token; want false\n")
+	}
+
+	// maximum size: expired token2 is removed to make room
+	itc.add(`token3`, now.Add(time.Minute), testHost, `N1CK0003`, ``, false)
+	err = itc.add(`token4`, now.Add(time.Minute), testHost, `N1CK0004`, ``, false)
+	if err != nil {
+		t.Errorf("itc.add(token4, ...) returned error %s; want expired token to be replaced\n", err)
+	}
+	err = itc.add(`token5`, now.Add(time.Minute), testHost, `N1CK0005`, ``, false)
+	if err == nil {
+		t.Errorf("itc.add(token5, ...) returned NO error for full cache; want error\n")
+	}
+}
+
+func TestIdentityTokenCacheSweeper(t *testing.T) {
+	itc := identityTokenCacheType{}
+	itc.initialize(0, 10*time.Millisecond)
+	defer itc.initialize(0, 0) // stop sweeper
+
+	now := time.Now().UTC()
+	itc.add(`expired`, now.Add(-time.Minute), testHost, `N1CK0001`, ``, false)
+	itc.add(`valid`, now.Add(time.Minute), testHost, `N1CK0002`, ``, false)
+
+	// wait for the sweeper
+	deadline := time.Now().Add(time.Second)
+	for itc.size() > 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if itc.size() != 1 {
+		t.Errorf("itc.size() returned %d after sweep; want 1\n", itc.size())
+	}
+	if !itc.isIdentityTokenValid(`valid`, testHost) {
+		t.Errorf("itc.isIdentityTokenValid(valid, testHost) returned false after sweep; want true\n")
+	}
+}
+
+func TestIdentityTokenCacheConcurrent(t *testing.T) {
+	itc := identityTokenCacheType{}
+	itc.initialize(0, time.Millisecond)
+	defer itc.initialize(0, 0) // stop sweeper
+
+	validUntil := time.Now().UTC().Add(time.Minute)
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				token := fmt.Sprintf("token-%d-%d", g, i)
+				itc.add(token, validUntil, testHost, `N1CK0001`, ``, false)
+				if !itc.isIdentityTokenValid(token, testHost) {
+					t.Errorf("itc.isIdentityTokenValid(%s, testHost) returned false; want true\n", token)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if itc.size() != 8000 {
+		t.Errorf("itc.size() returned %d; want 8000\n", itc.size())
+	}
+}
+
+func TestRevokeIdentityToken(t *testing.T) {
+	// initialize embiam
+	Initialize(new(DbTransient))
+
+	// generate test entities with authorization for application
+	for i := 1; i <= 3; i++ {
+		e := Entity{
+			Nick:         fmt.Sprintf(nickPattern, i),
+			PasswordHash: testHash(t, testPassword),
+			Active:       true,
+			Roles:        []RoleIdType{`application`},
+		}
+		err := Db.SaveEntity(&e)
+		if err != nil {
+			t.Errorf("Db.SaveEntity(&e) returned error %s; want save entity without error\n", err)
+		}
+	}
+	signIn := func(nick string) string {
+		identityToken, err := CheckIdentity(nick, testPassword, testHost)
+		if err != nil {
+			t.Errorf("CheckIdentity(%s, testPassword, testHost) returned error %s; want identity token\n", nick, err)
+		}
+		return identityToken.Token
+	}
+	nick1, nick2, nick3 := fmt.Sprintf(nickPattern, 1), fmt.Sprintf(nickPattern, 2), fmt.Sprintf(nickPattern, 3)
+
+	// sign out: revoke a single token
+	token1a := signIn(nick1)
+	token1b := signIn(nick1)
+	err := RevokeIdentityToken(token1a)
+	if err != nil {
+		t.Errorf("RevokeIdentityToken(token1a) returned error %s; want no error\n", err)
+	}
+	authValue := "embiam " + base64.StdEncoding.EncodeToString([]byte(token1a))
+	if IsIdentityTokenValid(token1a, testHost) || IsAuthIdentityTokenValid(authValue, testHost) || IsAuthorized(token1a, `application`, `use`) {
+		t.Errorf("revoked token1a is still valid; want invalid token\n")
+	}
+	if !IsIdentityTokenValid(token1b, testHost) || !IsAuthorized(token1b, `application`, `use`) {
+		t.Errorf("token1b is invalid after revoking token1a; want valid token\n")
+	}
+
+	// delete entity: revoke all tokens of nick
+	token2 := signIn(nick2)
+	err = DeleteEntity(nick1)
+	if err != nil {
+		t.Errorf("DeleteEntity(nick1) returned error %s; want no error\n", err)
+	}
+	if IsIdentityTokenValid(token1b, testHost) || IsAuthorized(token1b, `application`, `use`) {
+		t.Errorf("token1b is still valid after DeleteEntity(nick1); want invalid token\n")
+	}
+	if !IsIdentityTokenValid(token2, testHost) {
+		t.Errorf("token2 is invalid after DeleteEntity(nick1); want valid token\n")
+	}
+
+	// deactivate entity: revoke all tokens of nick
+	err = DeactivateEntity(nick2)
+	if err != nil {
+		t.Errorf("DeactivateEntity(nick2) returned error %s; want no error\n", err)
+	}
+	if IsIdentityTokenValid(token2, testHost) {
+		t.Errorf("token2 is still valid after DeactivateEntity(nick2); want invalid token\n")
+	}
+	if _, err = CheckIdentity(nick2, testPassword, testHost); err == nil {
+		t.Errorf("CheckIdentity(nick2, ...) returned NO error for deactivated entity; want error\n")
+	}
+
+	// kill switch: revoke everything issued before now
+	token3 := signIn(nick3)
+	err = RevokeIdentityTokensIssuedBefore(time.Now())
+	if err != nil {
+		t.Errorf("RevokeIdentityTokensIssuedBefore(time.Now()) returned error %s; want no error\n", err)
+	}
+	if IsIdentityTokenValid(token3, testHost) || IsAuthorized(token3, `application`, `use`) {
+		t.Errorf("token3 is still valid after RevokeIdentityTokensIssuedBefore(); want invalid token\n")
+	}
+	token3 = signIn(nick3)
+	if !IsIdentityTokenValid(token3, testHost) {
+		t.Errorf("token3 issued after RevokeIdentityTokensIssuedBefore() is invalid; want valid token\n")
+	}
+}
+
+func TestTokenStoreFile(t *testing.T) {
+	const testNick = `N1CK0001`
+
+	// initialize embiam with identity tokens in the filesystem
+	db := new(DbFile)
+	Initialize(db)
+	defer func() { db.Close() }()
+	db.DeleteContentsFromDirectory(db.IdentityTokenFilePath)
+	e := Entity{
+		Nick:         testNick,
+		PasswordHash: testHash(t, testPassword),
+		Active:       true,
+		Roles:        []RoleIdType{`application`},
+	}
+	err := Db.SaveEntity(&e)
+	if err != nil {
+		t.Errorf("Db.SaveEntity(&e) returned error %s; want save entity without error\n", err)
+	}
+	identityToken, err := CheckIdentity(testNick, testPassword, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(testNick, testPassword, testHost) returned error %s; want identity token\n", err)
+	}
+	revokedIdentityToken, _ := CheckIdentity(testNick, testPassword, testHost)
+	RevokeIdentityToken(revokedIdentityToken.Token)
+
+	// only the hash of the token is saved
+	storedTokens, err := db.ReadIdentityTokens()
+	if err != nil {
+		t.Errorf("db.ReadIdentityTokens() returned error %s; want stored tokens\n", err)
+	}
+	if len(storedTokens) != 1 {
+		t.Errorf("db.ReadIdentityTokens() returned %d tokens; want 1\n", len(storedTokens))
+	}
+	storedToken, ok := storedTokens[hashToken(identityToken.Token)]
+	if !ok || storedToken.Nick != testNick || storedToken.ValidFor != testHost {
+		t.Errorf("db.ReadIdentityTokens() returned %v; want token of %s for %s\n", storedTokens, testNick, testHost)
+	}
+	jsonString, _ := ioutil.ReadFile(db.IdentityTokenFilePath + hashToken(identityToken.Token))
+	if strings.Contains(string(jsonString), identityToken.Token) {
+		t.Errorf("stored identity token contains the token itself; want only the hash\n")
+	}
+
+	// restart: identity tokens and authorizations are loaded again
+	db.Close()
+	db = new(DbFile)
+	Initialize(db)
+	if !IsIdentityTokenValid(identityToken.Token, testHost) {
+		t.Errorf("IsIdentityTokenValid(identityToken.Token, testHost) returned false after restart; want true\n")
+	}
+	if !IsAuthorized(identityToken.Token, `application`, `use`) {
+		t.Errorf("IsAuthorized(identityToken.Token, application, use) returned false after restart; want true\n")
+	}
+	if IsIdentityTokenValid(revokedIdentityToken.Token, testHost) {
+		t.Errorf("IsIdentityTokenValid(revokedIdentityToken.Token, testHost) returned true after restart; want false\n")
+	}
+
+	// tokens of deleted entities are not loaded
+	Db.DeleteEntity(testNick)
+	db.Close()
+	db = new(DbFile)
+	Initialize(db)
+	if IsIdentityTokenValid(identityToken.Token, testHost) {
+		t.Errorf("IsIdentityTokenValid(identityToken.Token, testHost) returned true for deleted entity after restart; want false\n")
+	}
+}
+
+func TestTokenStoreMemory(t *testing.T) {
+	Initialize(new(DbTransient))
+	e := Entity{Nick: `N1CK0001`, Active: true, Roles: []RoleIdType{`application`}}
+	Db.SaveEntity(&e)
+
+	// tokens of the store are loaded, expired tokens are deleted from the store
+	store := new(MemoryTokenStore)
+	store.SaveIdentityToken(hashToken(`token1`), StoredIdentityToken{ValidUntil: time.Now().Add(time.Minute), ValidFor: testHost, Nick: e.Nick})
+	store.SaveIdentityToken(hashToken(`token2`), StoredIdentityToken{ValidUntil: time.Now().Add(-time.Minute), ValidFor: testHost, Nick: e.Nick})
+	err := InitializeTokenStore(store)
+	if err != nil {
+		t.Errorf("InitializeTokenStore(store) returned error %s; want no error\n", err)
+	}
+	if !IsIdentityTokenValid(`token1`, testHost) || !IsAuthorized(`token1`, `application`, `use`) {
+		t.Errorf("token1 from token store is invalid; want valid token\n")
+	}
+	storedTokens, _ := store.ReadIdentityTokens()
+	if _, ok := storedTokens[hashToken(`token2`)]; ok {
+		t.Errorf("expired token2 is still in token store; want it deleted\n")
+	}
+
+	// revoked tokens are deleted from the store
+	RevokeIdentityToken(`token1`)
+	storedTokens, _ = store.ReadIdentityTokens()
+	if len(storedTokens) != 0 {
+		t.Errorf("token store contains %d tokens after revocation; want 0\n", len(storedTokens))
+	}
+}
+
+func TestTokenStoreTransientConcurrent(t *testing.T) {
+	db := new(DbTransient)
+	db.Initialize()
+
+	// the sweeper and concurrent requests use the token store at the same time
+	validUntil := time.Now().UTC().Add(time.Minute)
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				tokenHash := hashToken(fmt.Sprintf("token-%d-%d", g, i))
+				db.SaveIdentityToken(tokenHash, StoredIdentityToken{ValidUntil: validUntil, ValidFor: testHost, Nick: `N1CK0001`})
+				db.ReadIdentityTokens()
+				if i%2 == 0 {
+					db.DeleteIdentityToken(tokenHash)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	storedTokens, _ := db.ReadIdentityTokens()
+	if len(storedTokens) != 4000 {
+		t.Errorf("db.ReadIdentityTokens() returned %d tokens; want 4000\n", len(storedTokens))
+	}
+}
+
+func TestTokenStoreRevocationAfterRestart(t *testing.T) {
+	const testNick = `N1CK0001`
+	Initialize(new(DbTransient))
+	e := Entity{Nick: testNick, PasswordHash: testHash(t, testPassword), Active: true}
+	Db.SaveEntity(&e)
+	store := Db.(TokenStore)
+	restart := func() {
+		identityTokenCache.initialize(0, 0)
+		refreshTokenCache.initialize(0)
+		err := InitializeTokenStore(store)
+		if err != nil {
+			t.Errorf("InitializeTokenStore(store) returned error %s; want no error\n", err)
+		}
+	}
+
+	// identity tokens of a session are revoked together after a restart
+	identityToken1, _ := CheckIdentity(testNick, testPassword, testHost)
+	identityToken2, err := RefreshIdentityToken(identityToken1.RefreshToken, testHost)
+	if err != nil {
+		t.Errorf("RefreshIdentityToken(...) returned error %s; want identity token\n", err)
+	}
+	restart()
+	if !IsIdentityTokenValid(identityToken1.Token, testHost) || !IsIdentityTokenValid(identityToken2.Token, testHost) {
+		t.Errorf("identity tokens are invalid after restart; want valid tokens\n")
+	}
+	RevokeIdentityToken(identityToken2.Token)
+	if IsIdentityTokenValid(identityToken1.Token, testHost) {
+		t.Errorf("identity token of revoked session is valid after restart; want invalid token\n")
+	}
+
+	// tokens issued before are revoked after a restart, later tokens stay valid
+	identityToken3, _ := CheckIdentity(testNick, testPassword, testHost)
+	revokedBefore := time.Now()
+	identityToken4, _ := CheckIdentity(testNick, testPassword, testHost)
+	restart()
+	RevokeIdentityTokensIssuedBefore(revokedBefore)
+	if IsIdentityTokenValid(identityToken3.Token, testHost) {
+		t.Errorf("identity token issued before RevokeIdentityTokensIssuedBefore() is valid after restart; want invalid token\n")
+	}
+	if !IsIdentityTokenValid(identityToken4.Token, testHost) {
+		t.Errorf("identity token issued after RevokeIdentityTokensIssuedBefore() is invalid after restart; want valid token\n")
+	}
+}
+
+// prepareBenchmarkCache fills a cache with count valid tokens
+func prepareBenchmarkCache(count int) (*identityTokenCacheType, []string) {
+	itc := &identityTokenCacheType{}
+	itc.initialize(0, 0)
+	validUntil := time.Now().UTC().Add(time.Hour)
+	tokens := make([]string, count)
+	for i := range tokens {
+		tokens[i] = generateIdentityToken()
+		itc.add(tokens[i], validUntil, testHost, fmt.Sprintf(nickPattern, i), ``, false)
+	}
+	return itc, tokens
+}
+
+func BenchmarkIdentityTokenCacheLookup100k(b *testing.B) {
+	itc, tokens := prepareBenchmarkCache(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !itc.isIdentityTokenValid(tokens[i%len(tokens)], testHost) {
+			b.Fatal("itc.isIdentityTokenValid(...) returned false; want true")
+		}
+	}
+}
+
+func BenchmarkIdentityTokenCacheLookup100kParallel(b *testing.B) {
+	itc, tokens := prepareBenchmarkCache(100000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			itc.getNick(tokens[i%len(tokens)])
+			i++
+		}
+	})
+}
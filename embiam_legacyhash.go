@@ -0,0 +1,303 @@
+package embiam
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+/********************************************************************
+	LEGACY PASSWORD HASHES
+	Entities migrated from other systems keep their password hashes
+	in Entity.PasswordHash. These hashes are verified by registered
+	PasswordVerifiers and replaced by a hash of the configured
+	PasswordHasher after the next successful sign in.
+
+		embiam.RegisterPasswordVerifier(embiam.PBKDF2SHA256Verifier{})
+		embiam.RegisterPasswordVerifier(embiam.SHA512CryptVerifier{})
+
+	embiam provides verifiers for PBKDF2-SHA256 (formats of passlib
+	and Django) and SHA-512-crypt. ReportPasswordHashes shows how
+	many entities still have legacy hashes.
+********************************************************************/
+
+var errInvalidLegacyHash = errors.New("invalid legacy hash")
+
+// HashReport counts the hashes of the passwords of all entities (see ReportPasswordHashes)
+type HashReport struct {
+	Entities    int      `json:"entities"`
+	Current     int      `json:"current"`     // hashes of the configured algorithm and parameters
+	Outdated    int      `json:"outdated"`    // hashes of embiam with other algorithm or parameters
+	Legacy      int      `json:"legacy"`      // hashes of registered verifiers
+	Unknown     int      `json:"unknown"`     // hashes without verifier, these entities can't sign in
+	LegacyNicks []string `json:"legacyNicks"` // nicks of the entities with legacy hashes
+}
+
+// ReportPasswordHashes reads all entities and counts the algorithms of their password hashes
+// outdated and legacy hashes are replaced after the next successful sign in of the entity
+func ReportPasswordHashes() (HashReport, error) {
+	report := HashReport{LegacyNicks: []string{}}
+	nicks, err := Db.ReadEntityList()
+	if err != nil {
+		return report, err
+	}
+
+	passwordHasherMutex.RLock()
+	current := passwordHasher
+	hashers := append([]PasswordHasher{current}, passwordHashers...)
+	verifiers := append([]PasswordVerifier{}, passwordVerifiers...)
+	passwordHasherMutex.RUnlock()
+
+	for _, nick := range nicks {
+		entity, err := Db.ReadEntityByNick(nick)
+		if err != nil {
+			return report, err
+		}
+		report.Entities++
+		switch {
+		case current.Handles(entity.PasswordHash) && !current.NeedsRehash(entity.PasswordHash):
+			report.Current++
+		case handledByHasher(hashers, entity.PasswordHash):
+			report.Outdated++
+		case handledByVerifier(verifiers, entity.PasswordHash):
+			report.Legacy++
+			report.LegacyNicks = append(report.LegacyNicks, nick)
+		default:
+			report.Unknown++
+		}
+	}
+	sort.Strings(report.LegacyNicks)
+	return report, nil
+}
+
+func handledByHasher(hashers []PasswordHasher, hash string) bool {
+	for _, hasher := range hashers {
+		if hasher.Handles(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+func handledByVerifier(verifiers []PasswordVerifier, hash string) bool {
+	for _, verifier := range verifiers {
+		if verifier.Handles(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+/********************************************************************
+	PBKDF2-SHA256
+********************************************************************/
+
+// PBKDF2SHA256Verifier verifies PBKDF2-SHA256 hashes in the formats
+// of passlib ($pbkdf2-sha256$iterations$salt$key, adapted base64) and
+// of Django (pbkdf2_sha256$iterations$salt$key, salt as text and base64 key)
+type PBKDF2SHA256Verifier struct{}
+
+// Handles reports if hash is a PBKDF2-SHA256 hash
+func (v PBKDF2SHA256Verifier) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$pbkdf2-sha256$") || strings.HasPrefix(hash, "pbkdf2_sha256$")
+}
+
+// Verify compares password with the PBKDF2-SHA256 hash
+func (v PBKDF2SHA256Verifier) Verify(hash, password string) (bool, error) {
+	var salt, key []byte
+	parts := strings.Split(strings.TrimPrefix(hash, "$"), "$")
+	if len(parts) != 4 {
+		return false, errInvalidLegacyHash
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false, errInvalidLegacyHash
+	}
+	if strings.HasPrefix(hash, "$") {
+		// passlib: adapted base64 without padding, '.' instead of '+'
+		salt, err = base64.RawStdEncoding.DecodeString(strings.ReplaceAll(parts[2], ".", "+"))
+		if err == nil {
+			key, err = base64.RawStdEncoding.DecodeString(strings.ReplaceAll(parts[3], ".", "+"))
+		}
+	} else {
+		// Django
+		salt = []byte(parts[2])
+		key, err = base64.StdEncoding.DecodeString(parts[3])
+	}
+	if err != nil || len(key) == 0 {
+		return false, errInvalidLegacyHash
+	}
+	otherKey := pbkdf2.Key([]byte(password), salt, iterations, len(key), sha256.New)
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+/********************************************************************
+	SHA-512-CRYPT
+	The algorithm of glibc crypt for $6$ hashes, see
+	https://www.akkadia.org/drepper/SHA-crypt.txt
+********************************************************************/
+
+const (
+	sha512CryptPrefix        = "$6$"
+	sha512CryptRoundsPrefix  = "rounds="
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptMaxSaltLength = 16
+	sha512CryptAlphabet      = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// SHA512CryptVerifier verifies SHA-512-crypt hashes, e.g. $6$rounds=5000$salt$hash (of /etc/shadow)
+type SHA512CryptVerifier struct{}
+
+// Handles reports if hash is a SHA-512-crypt hash
+func (v SHA512CryptVerifier) Handles(hash string) bool {
+	return strings.HasPrefix(hash, sha512CryptPrefix)
+}
+
+// Verify compares password with the SHA-512-crypt hash
+func (v SHA512CryptVerifier) Verify(hash, password string) (bool, error) {
+	settings := strings.TrimPrefix(hash, sha512CryptPrefix)
+	separator := strings.LastIndex(settings, "$")
+	if separator < 0 {
+		return false, errInvalidLegacyHash
+	}
+	otherHash, err := sha512Crypt(password, hash[:len(sha512CryptPrefix)+separator])
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(otherHash)) == 1, nil
+}
+
+// sha512Crypt calculates the SHA-512-crypt hash of password for the settings $6$[rounds=n$]salt
+func sha512Crypt(password, settings string) (string, error) {
+	settings = strings.TrimPrefix(settings, sha512CryptPrefix)
+	rounds := sha512CryptDefaultRounds
+	roundsSpecified := false
+	if strings.HasPrefix(settings, sha512CryptRoundsPrefix) {
+		separator := strings.Index(settings, "$")
+		if separator < 0 {
+			return "", errInvalidLegacyHash
+		}
+		var err error
+		rounds, err = strconv.Atoi(settings[len(sha512CryptRoundsPrefix):separator])
+		if err != nil {
+			return "", errInvalidLegacyHash
+		}
+		if rounds < sha512CryptMinRounds {
+			rounds = sha512CryptMinRounds
+		}
+		if rounds > sha512CryptMaxRounds {
+			rounds = sha512CryptMaxRounds
+		}
+		roundsSpecified = true
+		settings = settings[separator+1:]
+	}
+	salt := settings
+	if separator := strings.Index(salt, "$"); separator >= 0 {
+		salt = salt[:separator]
+	}
+	if len(salt) > sha512CryptMaxSaltLength {
+		salt = salt[:sha512CryptMaxSaltLength]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	// digest B
+	digest := sha512.New()
+	digest.Write(p)
+	digest.Write(s)
+	digest.Write(p)
+	b := digest.Sum(nil)
+
+	// digest A
+	digest.Reset()
+	digest.Write(p)
+	digest.Write(s)
+	digest.Write(repeatBytes(b, len(p)))
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			digest.Write(b)
+		} else {
+			digest.Write(p)
+		}
+	}
+	a := digest.Sum(nil)
+
+	// byte sequences P and S
+	digest.Reset()
+	for i := 0; i < len(p); i++ {
+		digest.Write(p)
+	}
+	pSequence := repeatBytes(digest.Sum(nil), len(p))
+	digest.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		digest.Write(s)
+	}
+	sSequence := repeatBytes(digest.Sum(nil), len(s))
+
+	// rounds
+	c := a
+	for i := 0; i < rounds; i++ {
+		digest.Reset()
+		if i&1 != 0 {
+			digest.Write(pSequence)
+		} else {
+			digest.Write(c)
+		}
+		if i%3 != 0 {
+			digest.Write(sSequence)
+		}
+		if i%7 != 0 {
+			digest.Write(pSequence)
+		}
+		if i&1 != 0 {
+			digest.Write(c)
+		} else {
+			digest.Write(pSequence)
+		}
+		c = digest.Sum(nil)
+	}
+
+	// encode
+	var result strings.Builder
+	result.WriteString(sha512CryptPrefix)
+	if roundsSpecified {
+		result.WriteString(sha512CryptRoundsPrefix + strconv.Itoa(rounds) + "$")
+	}
+	result.WriteString(salt + "$")
+	for i := 0; i < 21; i++ {
+		// permutation of the bytes: (0, 21, 42), (22, 43, 1), (44, 2, 23), ...
+		writeCryptBase64(&result, c[i*22%63], c[(i*22+21)%63], c[(i*22+42)%63], 4)
+	}
+	writeCryptBase64(&result, 0, 0, c[63], 2)
+	return result.String(), nil
+}
+
+// repeatBytes repeats b until length bytes
+func repeatBytes(b []byte, length int) []byte {
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		n := length - len(result)
+		if n > len(b) {
+			n = len(b)
+		}
+		result = append(result, b[:n]...)
+	}
+	return result
+}
+
+// writeCryptBase64 writes n characters for the bytes b2, b1, b0 in the base64 of crypt (least significant bits first)
+func writeCryptBase64(result *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for i := 0; i < n; i++ {
+		result.WriteByte(sha512CryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
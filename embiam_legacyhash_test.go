@@ -0,0 +1,83 @@
+package embiam
+
+import (
+	"testing"
+)
+
+func TestLegacyHashVerifiers(t *testing.T) {
+	tests := []struct {
+		verifier PasswordVerifier
+		hash     string
+		password string
+	}{
+		// test vectors of https://www.akkadia.org/drepper/SHA-crypt.txt
+		{SHA512CryptVerifier{}, `$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1`, `Hello world!`},
+		{SHA512CryptVerifier{}, `$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.`, `Hello world!`},
+		{SHA512CryptVerifier{}, `$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0`, `This is just a test`},
+		{SHA512CryptVerifier{}, `$6$rounds=1000$abcdefgh$nMw4NxdbYvgtvh8jEwOu.mOUumgUx2qreFzflkECkEl5VW4t.N.eYx6XCuS0DAh.wRUp0dlzo6y5f932d5sNc1`, testPassword},
+		// passlib and Django
+		{PBKDF2SHA256Verifier{}, `$pbkdf2-sha256$2000$AQIDBAUGBwgJCgsM$4iKwa9L3xE6PybY9eKZT4bA.xXOAtLIMsFaf1cv22Xg`, testPassword},
+		{PBKDF2SHA256Verifier{}, `pbkdf2_sha256$1000$seasalt$JPxzicLxw4Qq+GE8yfaf91xcffZGTtFpEXGWJjAyXNo=`, testPassword},
+	}
+	for _, test := range tests {
+		if !test.verifier.Handles(test.hash) {
+			t.Errorf("%T.Handles(%s) returned false; want true\n", test.verifier, test.hash)
+		}
+		if ok, err := test.verifier.Verify(test.hash, test.password); !ok || err != nil {
+			t.Errorf("%T.Verify(%s, %s) returned %t, %v; want true\n", test.verifier, test.hash, test.password, ok, err)
+		}
+		if ok, err := test.verifier.Verify(test.hash, `Wr0ngPassWord`); ok || err != nil {
+			t.Errorf("%T.Verify(%s, Wr0ngPassWord) returned %t, %v; want false without error\n", test.verifier, test.hash, ok, err)
+		}
+	}
+	if _, err := (PBKDF2SHA256Verifier{}).Verify(`pbkdf2_sha256$many$salt$key`, testPassword); err == nil {
+		t.Errorf("PBKDF2SHA256Verifier.Verify() returned NO error for invalid hash; want error\n")
+	}
+}
+
+func TestLegacyHashUpgrade(t *testing.T) {
+	Initialize(new(DbTransient))
+	defer func() { passwordVerifiers = nil }()
+	outdatedHash, _ := BcryptHasher{Cost: 4}.Hash(testPassword)
+	legacyHashes := map[string]string{
+		`N1CK0001`: `$6$rounds=1000$abcdefgh$nMw4NxdbYvgtvh8jEwOu.mOUumgUx2qreFzflkECkEl5VW4t.N.eYx6XCuS0DAh.wRUp0dlzo6y5f932d5sNc1`,
+		`N1CK0002`: `pbkdf2_sha256$1000$seasalt$JPxzicLxw4Qq+GE8yfaf91xcffZGTtFpEXGWJjAyXNo=`,
+		`N1CK0003`: testHash(t, testPassword),
+		`N1CK0004`: outdatedHash,
+	}
+	for nick, hash := range legacyHashes {
+		Db.SaveEntity(&Entity{Nick: nick, PasswordHash: hash, Active: true})
+	}
+
+	// without verifiers the legacy hashes are unknown
+	_, err := CheckIdentity(`N1CK0001`, testPassword, testHost)
+	if err == nil {
+		t.Errorf("CheckIdentity(N1CK0001, ...) returned NO error without verifier; want error\n")
+	}
+	report, err := ReportPasswordHashes()
+	if err != nil || report.Entities != 4 || report.Current != 1 || report.Outdated != 1 || report.Legacy != 0 || report.Unknown != 2 {
+		t.Errorf("ReportPasswordHashes() returned %+v, %v; want 4 entities, 1 current, 1 outdated, 2 unknown\n", report, err)
+	}
+
+	// with verifiers the legacy hashes are replaced after sign in
+	RegisterPasswordVerifier(PBKDF2SHA256Verifier{})
+	RegisterPasswordVerifier(SHA512CryptVerifier{})
+	report, _ = ReportPasswordHashes()
+	if report.Legacy != 2 || len(report.LegacyNicks) != 2 || report.LegacyNicks[0] != `N1CK0001` || report.Unknown != 0 {
+		t.Errorf("ReportPasswordHashes() returned %+v; want 2 legacy hashes of N1CK0001 and N1CK0002\n", report)
+	}
+	for _, nick := range []string{`N1CK0001`, `N1CK0002`, `N1CK0004`} {
+		_, err = CheckIdentity(nick, testPassword, testHost)
+		if err != nil {
+			t.Errorf("CheckIdentity(%s, ...) returned error %s; want identity token\n", nick, err)
+		}
+	}
+	report, _ = ReportPasswordHashes()
+	if report.Current != 4 || report.Legacy != 0 || len(report.LegacyNicks) != 0 {
+		t.Errorf("ReportPasswordHashes() returned %+v after sign in; want 4 current hashes\n", report)
+	}
+	_, err = CheckIdentity(`N1CK0001`, testPassword, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(N1CK0001, ...) returned error %s after upgrade; want identity token\n", err)
+	}
+}
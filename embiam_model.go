@@ -3,11 +3,12 @@ package embiam
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 )
 
 /********************************************************************
@@ -28,6 +29,7 @@ type DbInterface interface {
 	// Entity Tokens
 	saveEntityToken(entityToken *EntityToken) error
 	readEntityToken(tokenoken string) (*EntityToken, error)
+	readEntityTokenList() ([]EntityToken, error)
 	deleteEntityToken(token string) error
 
 	// Roles
@@ -41,33 +43,36 @@ type DbInterface interface {
 	DbTransient - non-persistent database for testing and demonstration
 */
 type DbTransient struct {
-	entityStore      map[string]Entity
-	entityTokenStore map[string]EntityToken
+	entityStore        map[string]Entity
+	entityTokenStore   map[string]EntityToken
+	identityTokenStore map[string]StoredIdentityToken
+	identityTokenMutex sync.Mutex // the token store is used by the sweeper and by concurrent requests
 }
 
 func (m *DbTransient) Initialize() {
 	m.entityStore = make(map[string]Entity)
 	m.entityTokenStore = make(map[string]EntityToken)
+	m.identityTokenStore = make(map[string]StoredIdentityToken)
 }
 
 // ToDo: Reuqired???
-func (m DbTransient) ReadEntityList() (nicklist []string, e error) {
-	nicklist = make([]string, len(m.entityStore))
+func (m *DbTransient) ReadEntityList() (nicklist []string, e error) {
+	nicklist = make([]string, 0, len(m.entityStore))
 	for _, entity := range m.entityStore {
 		nicklist = append(nicklist, entity.Nick)
 	}
 	return nicklist, nil
 }
 
-func (m DbTransient) ReadEntityByNick(nick string) (*Entity, error) {
+func (m *DbTransient) ReadEntityByNick(nick string) (*Entity, error) {
 	e, found := m.entityStore[nick]
 	if found {
 		return &e, nil
 	}
-	return nil, errors.New("entity not found")
+	return nil, &DbError{Operation: "read entity", Key: nick, Err: ErrEntityNotFound}
 }
 
-func (m DbTransient) ReadPublicEntityByNick(nick string) (*PublicEntity, error) {
+func (m *DbTransient) ReadPublicEntityByNick(nick string) (*PublicEntity, error) {
 	entity, err := m.ReadEntityByNick(nick)
 	if err != nil {
 		return nil, err
@@ -76,76 +81,129 @@ func (m DbTransient) ReadPublicEntityByNick(nick string) (*PublicEntity, error)
 	return &publicEntity, nil
 }
 
-func (m DbTransient) EntityExists(nick string) bool {
+func (m *DbTransient) EntityExists(nick string) bool {
 	_, found := m.entityStore[nick]
 	return found
 }
 
-func (m DbTransient) SaveEntity(e *Entity) error {
+func (m *DbTransient) SaveEntity(e *Entity) error {
 	m.entityStore[e.Nick] = *e
 	return nil
 }
 
-func (m DbTransient) DeleteEntity(nick string) error {
+func (m *DbTransient) DeleteEntity(nick string) error {
+	if _, found := m.entityStore[nick]; !found {
+		return &DbError{Operation: "delete entity", Key: nick, Err: ErrEntityNotFound}
+	}
 	delete(m.entityStore, nick)
 	return nil
 }
 
-func (m DbTransient) saveEntityToken(et *EntityToken) error {
+func (m *DbTransient) saveEntityToken(et *EntityToken) error {
 	m.entityTokenStore[et.Token] = *et
 	return nil
 }
 
-func (m DbTransient) readEntityToken(token string) (*EntityToken, error) {
+func (m *DbTransient) readEntityToken(token string) (*EntityToken, error) {
 	et, found := m.entityTokenStore[token]
 	if found {
 		return &et, nil
 	}
-	return nil, errors.New("entity token not found")
+	return nil, &DbError{Operation: "read entity token", Key: token, Err: ErrEntityTokenNotFound}
 }
 
-func (m DbTransient) deleteEntityToken(token string) error {
+func (m *DbTransient) readEntityTokenList() ([]EntityToken, error) {
+	entityTokens := make([]EntityToken, 0, len(m.entityTokenStore))
+	for _, et := range m.entityTokenStore {
+		entityTokens = append(entityTokens, et)
+	}
+	return entityTokens, nil
+}
+
+func (m *DbTransient) deleteEntityToken(token string) error {
 	delete(m.entityTokenStore, token)
 	return nil
 }
 
-func (m DbTransient) readRoles() (RoleCacheMap, error) {
+func (m *DbTransient) readRoles() (RoleCacheMap, error) {
 	return roleCache, nil
 }
 
-func (m DbTransient) readDefaultRoles() (defaultRoles []RoleIdType, err error) {
+func (m *DbTransient) readDefaultRoles() (defaultRoles []RoleIdType, err error) {
 	return defaultRoles, nil
 }
 
-func (m DbTransient) saveRoles(newRoleCache RoleCacheMap) error {
+func (m *DbTransient) saveRoles(newRoleCache RoleCacheMap) error {
 	roleCache = newRoleCache
 	return nil
 }
 
-func (m DbTransient) saveDefaultRoles(newDefaultRoles []RoleIdType) error {
+func (m *DbTransient) saveDefaultRoles(newDefaultRoles []RoleIdType) error {
 	defaultRoles = newDefaultRoles
 	return nil
 }
 
+func (m *DbTransient) SaveIdentityToken(tokenHash string, identityToken StoredIdentityToken) error {
+	m.identityTokenMutex.Lock()
+	defer m.identityTokenMutex.Unlock()
+	m.identityTokenStore[tokenHash] = identityToken
+	return nil
+}
+
+func (m *DbTransient) DeleteIdentityToken(tokenHash string) error {
+	m.identityTokenMutex.Lock()
+	defer m.identityTokenMutex.Unlock()
+	delete(m.identityTokenStore, tokenHash)
+	return nil
+}
+
+func (m *DbTransient) ReadIdentityTokens() (map[string]StoredIdentityToken, error) {
+	m.identityTokenMutex.Lock()
+	defer m.identityTokenMutex.Unlock()
+	tokens := make(map[string]StoredIdentityToken, len(m.identityTokenStore))
+	for tokenHash, identityToken := range m.identityTokenStore {
+		tokens[tokenHash] = identityToken
+	}
+	return tokens, nil
+}
+
 /*
 	DbFile - use the filesystem and store json files
+	Files are written to a temporary file first and renamed afterwards,
+	so a crash never leaves a truncated file. Open (or Initialize)
+	locks the directory of the database, so that only one process
+	(and only one DbFile) uses it, and removes temporary files left
+	over by a crash. Close the DbFile before another one is opened.
 */
 type DbFile struct {
 	EntityFilePath        string
 	EntityDeletedFilePath string
 	EntityTokenFilePath   string
+	IdentityTokenFilePath string
+	SigningKeyFilePath    string
 	RolePath              string
+	AuditPath             string
 	DBPath                string
 
 	RoleFilename        string
 	DefaultRoleFilename string
+	SigningKeyFilename  string
 }
 
 func (m *DbFile) Initialize() {
+	err := m.Open()
+	if err != nil {
+		log.Fatalf("Error %s\n", err)
+	}
+}
+
+// Open sets the paths, creates the directories, locks the database and removes temporary files of interrupted writes
+// call Open before Initialize to handle errors (e.g. ErrDbLocked) instead of stopping the program
+func (m *DbFile) Open() error {
 	// get directory of executable as basis for relativ paths
 	executableDirectory, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
-		log.Fatalf("Error %s\n", err)
+		return newDbError("open database", "", err, nil)
 	}
 
 	// set paths
@@ -153,23 +211,51 @@ func (m *DbFile) Initialize() {
 	m.EntityFilePath = m.DBPath + `entity/`
 	m.EntityDeletedFilePath = m.DBPath + `entity/deleted/`
 	m.EntityTokenFilePath = m.DBPath + `entityToken/`
+	m.IdentityTokenFilePath = m.DBPath + `identityToken/`
+	m.SigningKeyFilePath = m.DBPath + `signingKey/`
 	m.RolePath = m.DBPath + `role/`
+	m.AuditPath = m.DBPath + `audit/`
+	paths := []string{m.EntityFilePath, m.EntityDeletedFilePath, m.EntityTokenFilePath, m.IdentityTokenFilePath, m.SigningKeyFilePath, m.RolePath, m.AuditPath}
 
 	// create paths
-	InitializeDirectory(m.EntityFilePath)
-	InitializeDirectory(m.EntityDeletedFilePath)
-	InitializeDirectory(m.EntityTokenFilePath)
-	InitializeDirectory(m.RolePath)
+	for _, path := range paths {
+		err = InitializeDirectory(path)
+		if err != nil {
+			return newDbError("open database", path, err, nil)
+		}
+	}
+
+	// lock database and remove temporary files of interrupted writes
+	acquired, err := lockDbDirectory(m.DBPath, m)
+	if err != nil {
+		return err
+	}
+	// only after a new lock, otherwise writes of this DbFile might be in progress
+	if acquired {
+		for _, path := range paths {
+			err = removeTempFiles(path)
+			if err != nil {
+				return newDbError("remove temporary files", path, err, nil)
+			}
+		}
+	}
 
 	// set standard filenames
 	m.RoleFilename = `all.json`
-	m.RoleFilename = `default.json`
+	m.DefaultRoleFilename = `default.json`
+	m.SigningKeyFilename = `keys.json`
+	return nil
+}
+
+// Close releases the lock of the database directory
+func (m *DbFile) Close() error {
+	return unlockDbDirectory(m.DBPath, m)
 }
 
 func (m DbFile) ReadEntityList() (nicklist []string, e error) {
 	files, err := ioutil.ReadDir(m.EntityFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("error '%s' reading directory '%s'", err.Error(), m.EntityFilePath)
+		return nil, newDbError("read entity list", "", err, nil)
 	}
 	nicklist = make([]string, 0, len(files))
 	for _, file := range files {
@@ -189,15 +275,18 @@ func (m DbFile) ReadEntityList() (nicklist []string, e error) {
 }
 
 func (m DbFile) ReadEntityByNick(nick string) (*Entity, error) {
+	if !IsValidNick(nick) {
+		return nil, &DbError{Operation: "read entity", Key: nick, Err: ErrEntityNotFound}
+	}
 	filepath := m.EntityFilePath + nick
 	jsonString, err := ioutil.ReadFile(filepath)
 	if err != nil {
-		return nil, fmt.Errorf("error '%s' reading file '%s'", err.Error(), filepath)
+		return nil, newDbError("read entity", nick, err, ErrEntityNotFound)
 	}
 	entity := Entity{}
 	err = json.Unmarshal([]byte(jsonString), &entity)
 	if err != nil {
-		return nil, fmt.Errorf("error '%s' unmarshalling nick %s", err.Error(), nick)
+		return nil, newDbError("unmarshal entity", nick, err, nil)
 	}
 	return &entity, nil
 }
@@ -212,6 +301,9 @@ func (m DbFile) ReadPublicEntityByNick(nick string) (*PublicEntity, error) {
 }
 
 func (m DbFile) EntityExists(nick string) bool {
+	if !IsValidNick(nick) {
+		return false
+	}
 	filepath := m.EntityFilePath + nick
 	_, err := os.Stat(filepath)
 	return err == nil
@@ -221,11 +313,11 @@ func (m DbFile) SaveEntity(e *Entity) error {
 	filepath := m.EntityFilePath + e.Nick
 	jsonbytes, err := json.MarshalIndent(e, "", "\t")
 	if err != nil {
-		return err
+		return newDbError("marshal entity", e.Nick, err, nil)
 	}
-	err = ioutil.WriteFile(filepath, jsonbytes, 0644)
+	err = writeFileAtomic(filepath, jsonbytes, 0644)
 	if err != nil {
-		return err
+		return newDbError("save entity", e.Nick, err, nil)
 	}
 	return nil
 }
@@ -235,7 +327,7 @@ func (m DbFile) DeleteEntity(nick string) error {
 	newFilepath := m.EntityDeletedFilePath + nick
 	err := os.Rename(oldFilepath, newFilepath)
 	if err != nil {
-		return err
+		return newDbError("delete entity", nick, err, ErrEntityNotFound)
 	}
 	return nil
 }
@@ -244,34 +336,57 @@ func (m DbFile) saveEntityToken(et *EntityToken) error {
 	filepath := m.EntityTokenFilePath + et.Token
 	jsonbytes, err := json.MarshalIndent(et, "", "\t")
 	if err != nil {
-		return err
+		return newDbError("marshal entity token", et.Token, err, nil)
 	}
-	err = ioutil.WriteFile(filepath, jsonbytes, 0644)
+	err = writeFileAtomic(filepath, jsonbytes, 0644)
 	if err != nil {
-		return err
+		return newDbError("save entity token", et.Token, err, nil)
 	}
 	return nil
 }
 
 func (m DbFile) readEntityToken(token string) (*EntityToken, error) {
+	if strings.ContainsAny(token, `/\`) {
+		return nil, &DbError{Operation: "read entity token", Key: token, Err: ErrEntityTokenNotFound}
+	}
 	filepath := m.EntityTokenFilePath + token
 	jsonString, err := ioutil.ReadFile(filepath)
 	if err != nil {
-		return nil, errors.New("entity token not found " + token)
+		return nil, newDbError("read entity token", token, err, ErrEntityTokenNotFound)
 	}
 	et := EntityToken{}
 	err = json.Unmarshal([]byte(jsonString), &et)
 	if err != nil {
-		return nil, err
+		return nil, newDbError("unmarshal entity token", token, err, nil)
 	}
 	return &et, nil
 }
 
+func (m DbFile) readEntityTokenList() ([]EntityToken, error) {
+	files, err := ioutil.ReadDir(m.EntityTokenFilePath)
+	if err != nil {
+		return nil, newDbError("read entity token list", "", err, nil)
+	}
+	entityTokens := make([]EntityToken, 0, len(files))
+	for _, file := range files {
+		token := file.Name()
+		if file.IsDir() || token[0:1] == "." {
+			continue
+		}
+		et, err := m.readEntityToken(token)
+		if err != nil {
+			return nil, err
+		}
+		entityTokens = append(entityTokens, *et)
+	}
+	return entityTokens, nil
+}
+
 func (m DbFile) deleteEntityToken(token string) error {
 	filepath := m.EntityTokenFilePath + token
 	err := os.Remove(filepath)
 	if err != nil {
-		return err
+		return newDbError("delete entity token", token, err, ErrEntityTokenNotFound)
 	}
 	return nil
 }
@@ -300,11 +415,11 @@ func (m DbFile) readRoles() (roleMap RoleCacheMap, err error) {
 	filepath := m.RolePath + m.RoleFilename
 	jsonString, err := ioutil.ReadFile(filepath)
 	if err != nil {
-		return roleMap, err
+		return roleMap, newDbError("read roles", m.RoleFilename, err, nil)
 	}
 	err = json.Unmarshal([]byte(jsonString), &roleMap)
 	if err != nil {
-		return roleMap, err
+		return roleMap, newDbError("unmarshal roles", m.RoleFilename, err, nil)
 	}
 	return roleMap, nil
 }
@@ -314,11 +429,11 @@ func (m DbFile) readDefaultRoles() (defaultRoles []RoleIdType, err error) {
 	filepath := m.RolePath + m.DefaultRoleFilename
 	jsonString, err := ioutil.ReadFile(filepath)
 	if err != nil {
-		return defaultRoles, err
+		return defaultRoles, newDbError("read default roles", m.DefaultRoleFilename, err, nil)
 	}
 	err = json.Unmarshal([]byte(jsonString), &defaultRoles)
 	if err != nil {
-		return defaultRoles, err
+		return defaultRoles, newDbError("unmarshal default roles", m.DefaultRoleFilename, err, nil)
 	}
 	return defaultRoles, nil
 }
@@ -326,22 +441,105 @@ func (m DbFile) readDefaultRoles() (defaultRoles []RoleIdType, err error) {
 func (m DbFile) saveRoles(roleMap RoleCacheMap) error {
 	jsonbytes, err := json.MarshalIndent(roleMap, "", "\t")
 	if err != nil {
-		return err
+		return newDbError("marshal roles", m.RoleFilename, err, nil)
 	}
 	filepath := m.RolePath + m.RoleFilename
-	os.Remove(filepath)
-	err = ioutil.WriteFile(filepath, jsonbytes, 0644)
+	err = writeFileAtomic(filepath, jsonbytes, 0644)
 	if err != nil {
-		return err
+		return newDbError("save roles", m.RoleFilename, err, nil)
 	}
 	return nil
 }
 
-func (m DbFile) saveDefaultRoles(efaultRoles []RoleIdType) error {
-	// ToDo: Implement
+func (m DbFile) saveDefaultRoles(defaultRoles []RoleIdType) error {
+	jsonbytes, err := json.MarshalIndent(defaultRoles, "", "\t")
+	if err != nil {
+		return newDbError("marshal default roles", m.DefaultRoleFilename, err, nil)
+	}
+	filepath := m.RolePath + m.DefaultRoleFilename
+	err = writeFileAtomic(filepath, jsonbytes, 0644)
+	if err != nil {
+		return newDbError("save default roles", m.DefaultRoleFilename, err, nil)
+	}
 	return nil
 }
 
+func (m DbFile) SaveIdentityToken(tokenHash string, identityToken StoredIdentityToken) error {
+	filepath := m.IdentityTokenFilePath + tokenHash
+	jsonbytes, err := json.MarshalIndent(identityToken, "", "\t")
+	if err != nil {
+		return newDbError("marshal identity token", tokenHash, err, nil)
+	}
+	err = writeFileAtomic(filepath, jsonbytes, 0600)
+	if err != nil {
+		return newDbError("save identity token", tokenHash, err, nil)
+	}
+	return nil
+}
+
+func (m DbFile) DeleteIdentityToken(tokenHash string) error {
+	filepath := m.IdentityTokenFilePath + tokenHash
+	err := os.Remove(filepath)
+	if err != nil && !os.IsNotExist(err) {
+		return newDbError("delete identity token", tokenHash, err, nil)
+	}
+	return nil
+}
+
+func (m DbFile) ReadIdentityTokens() (map[string]StoredIdentityToken, error) {
+	files, err := ioutil.ReadDir(m.IdentityTokenFilePath)
+	if err != nil {
+		return nil, newDbError("read identity tokens", "", err, nil)
+	}
+	tokens := make(map[string]StoredIdentityToken, len(files))
+	for _, file := range files {
+		tokenHash := file.Name()
+		if file.IsDir() || tokenHash[0:1] == "." {
+			continue
+		}
+		jsonString, err := ioutil.ReadFile(m.IdentityTokenFilePath + tokenHash)
+		if err != nil {
+			return nil, newDbError("read identity token", tokenHash, err, nil)
+		}
+		identityToken := StoredIdentityToken{}
+		err = json.Unmarshal(jsonString, &identityToken)
+		if err != nil {
+			return nil, newDbError("unmarshal identity token", tokenHash, err, nil)
+		}
+		tokens[tokenHash] = identityToken
+	}
+	return tokens, nil
+}
+
+func (m DbFile) SaveSigningKeys(keys []StoredSigningKey) error {
+	jsonbytes, err := json.MarshalIndent(keys, "", "\t")
+	if err != nil {
+		return newDbError("marshal signing keys", m.SigningKeyFilename, err, nil)
+	}
+	// the file contains the private keys, so it's only readable by the owner
+	err = writeFileAtomic(m.SigningKeyFilePath+m.SigningKeyFilename, jsonbytes, 0600)
+	if err != nil {
+		return newDbError("save signing keys", m.SigningKeyFilename, err, nil)
+	}
+	return nil
+}
+
+func (m DbFile) ReadSigningKeys() ([]StoredSigningKey, error) {
+	keys := []StoredSigningKey{}
+	jsonString, err := ioutil.ReadFile(m.SigningKeyFilePath + m.SigningKeyFilename)
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, newDbError("read signing keys", m.SigningKeyFilename, err, nil)
+	}
+	err = json.Unmarshal(jsonString, &keys)
+	if err != nil {
+		return nil, newDbError("unmarshal signing keys", m.SigningKeyFilename, err, nil)
+	}
+	return keys, nil
+}
+
 // InitializeDirectory checks if 'folderPath' exists and creates it, if it's not existing
 func InitializeDirectory(folderPath string) error {
 	fileinfo, err := os.Stat(folderPath)
@@ -357,3 +555,110 @@ func InitializeDirectory(folderPath string) error {
 	}
 	return nil
 }
+
+// tempFilePrefix starts the names of temporary files, the leading dot hides them from the lists
+const tempFilePrefix = ".tmp-"
+
+// writeFileAtomic writes data to a temporary file, syncs it and renames it to filename,
+// so that filename contains either the old or the new data, even after a crash
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir, name := filepath.Split(filename)
+	if dir == "" {
+		// relative filename, e.g. conf.json
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, tempFilePrefix+name+"-*")
+	if err != nil {
+		return err
+	}
+	tempName := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempName, filename)
+	}
+	if err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	return syncDirectory(dir)
+}
+
+// removeTempFiles removes the temporary files of writes, that were interrupted by a crash
+func removeTempFiles(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), tempFilePrefix) {
+			continue
+		}
+		err = os.Remove(filepath.Join(dir, file.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// dbLocks contains the locked lock files of the database directories and the DbFile holding them
+// the lock is only re-entrant for the same DbFile, e.g. Initialize after Open
+var dbLocks = struct {
+	sync.Mutex
+	files  map[string]*os.File
+	owners map[string]*DbFile
+}{files: make(map[string]*os.File), owners: make(map[string]*DbFile)}
+
+// lockDbDirectory sets an advisory lock on the file .lock in dir for owner,
+// it returns ErrDbLocked if another process or another DbFile holds the lock.
+// acquired is false, if owner already held the lock
+func lockDbDirectory(dir string, owner *DbFile) (acquired bool, err error) {
+	dbLocks.Lock()
+	defer dbLocks.Unlock()
+	if holder, ok := dbLocks.owners[dir]; ok {
+		if holder == owner {
+			return false, nil
+		}
+		return false, &DbError{Operation: "lock database", Key: dir, Err: ErrDbLocked}
+	}
+	f, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return false, err
+	}
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		return false, &DbError{Operation: "lock database", Key: dir, Err: err}
+	}
+	dbLocks.files[dir] = f
+	dbLocks.owners[dir] = owner
+	return true, nil
+}
+
+// unlockDbDirectory releases the lock of dir, if owner holds it
+func unlockDbDirectory(dir string, owner *DbFile) error {
+	dbLocks.Lock()
+	defer dbLocks.Unlock()
+	if dbLocks.owners[dir] != owner {
+		return nil
+	}
+	f := dbLocks.files[dir]
+	delete(dbLocks.files, dir)
+	delete(dbLocks.owners, dir)
+	err := unlockFile(f)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
@@ -0,0 +1,278 @@
+package embiam
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/********************************************************************
+	PASSWORD HASHING
+	Passwords, secrets and recovery codes are hashed with a
+	PasswordHasher. The hashes are self-describing: the prefix
+	identifies the algorithm and the hash contains its parameters,
+	e.g. $2a$10$... for bcrypt or $argon2id$v=19$m=65536,t=1,p=4$...
+	So every hash is verified by the hasher of its prefix, even
+	after the configuration was changed.
+
+	New hashes are created by the hasher of the configuration
+	(passwordHashAlgorithm, bcryptCost, argon2Time, argon2Memory,
+	argon2Threads). If the hash of a password uses another
+	algorithm or other parameters, it's replaced after the next
+	successful sign in (rehash).
+
+	Other algorithms can be added by implementing PasswordHasher,
+	see SetPasswordHasher. Hashes imported from other systems are
+	verified by a PasswordVerifier (see RegisterPasswordVerifier).
+********************************************************************/
+
+type (
+	// PasswordVerifier verifies self-describing hashes of passwords, e.g. legacy hashes (see RegisterPasswordVerifier)
+	PasswordVerifier interface {
+		// Handles reports if hash was created by the algorithm of the verifier (e.g. by the prefix)
+		Handles(hash string) bool
+		// Verify compares password with hash
+		Verify(hash, password string) (bool, error)
+	}
+
+	// PasswordHasher creates and verifies self-describing hashes of passwords
+	PasswordHasher interface {
+		PasswordVerifier
+		// Hash returns the hash of password including algorithm and parameters
+		Hash(password string) (string, error)
+		// NeedsRehash reports if hash uses other parameters than the hasher
+		NeedsRehash(hash string) bool
+	}
+)
+
+const (
+	PasswordHashBcrypt   = "bcrypt"
+	PasswordHashArgon2id = "argon2id"
+)
+
+var (
+	passwordHasher      PasswordHasher     = BcryptHasher{Cost: bcrypt.DefaultCost}
+	passwordHashers     []PasswordHasher   // hashers for verification, besides passwordHasher
+	passwordVerifiers   []PasswordVerifier // registered verifiers of legacy hashes
+	passwordHasherMutex sync.RWMutex
+)
+
+// SetPasswordHasher sets the hasher for new hashes, the previous hasher is kept for the verification of existing hashes
+func SetPasswordHasher(hasher PasswordHasher) {
+	passwordHasherMutex.Lock()
+	defer passwordHasherMutex.Unlock()
+	passwordHashers = append(passwordHashers, passwordHasher)
+	passwordHasher = hasher
+}
+
+// RegisterPasswordVerifier adds a verifier for hashes, that are not created by embiam, e.g. after a migration
+// the hashes are replaced by hashes of the configured PasswordHasher after the next successful sign in
+func RegisterPasswordVerifier(verifier PasswordVerifier) {
+	passwordHasherMutex.Lock()
+	defer passwordHasherMutex.Unlock()
+	passwordVerifiers = append(passwordVerifiers, verifier)
+}
+
+// initializePasswordHashers sets the hasher of the configuration, bcrypt and argon2id (with default parameters) verify existing hashes
+func initializePasswordHashers(config ConfigurationStruct) {
+	passwordHasherMutex.Lock()
+	defer passwordHasherMutex.Unlock()
+	passwordHashers = []PasswordHasher{BcryptHasher{}, Argon2idHasher{}}
+	passwordHasher = passwordHasherFromConfiguration(config)
+}
+
+// passwordHasherFromConfiguration returns the hasher with the algorithm and parameters of config
+func passwordHasherFromConfiguration(config ConfigurationStruct) PasswordHasher {
+	if config.PasswordHashAlgorithm == PasswordHashArgon2id {
+		return Argon2idHasher{
+			Time:      uint32(config.Argon2Time),
+			MemoryKiB: uint32(config.Argon2Memory),
+			Threads:   uint8(config.Argon2Threads),
+		}
+	}
+	return BcryptHasher{Cost: config.BcryptCost}
+}
+
+// HashPassword calculates the hash of password with the configured PasswordHasher
+func HashPassword(password string) (string, error) {
+	passwordHasherMutex.RLock()
+	hasher := passwordHasher
+	passwordHasherMutex.RUnlock()
+	return hasher.Hash(password)
+}
+
+// verifyHash compares password with hash, using the hasher that handles hash
+// needsRehash is set, if hash wasn't created by the configured hasher with its parameters
+func verifyHash(hash, password string) (ok bool, needsRehash bool, err error) {
+	passwordHasherMutex.RLock()
+	current := passwordHasher
+	verifiers := []PasswordVerifier{current}
+	for _, hasher := range passwordHashers {
+		verifiers = append(verifiers, hasher)
+	}
+	verifiers = append(verifiers, passwordVerifiers...)
+	passwordHasherMutex.RUnlock()
+
+	for _, verifier := range verifiers {
+		if !verifier.Handles(hash) {
+			continue
+		}
+		ok, err = verifier.Verify(hash, password)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, !current.Handles(hash) || current.NeedsRehash(hash), nil
+	}
+	return false, false, ErrUnknownHash
+}
+
+// rehash returns a new hash for password, if needsRehash is set; otherwise (or if hashing fails) hash is returned
+func rehash(hash, password string, needsRehash bool) string {
+	if !needsRehash {
+		return hash
+	}
+	newHash, err := HashPassword(password)
+	if err != nil {
+		log.Printf("Error rehashing password: %s\n", err)
+		return hash
+	}
+	return newHash
+}
+
+/********************************************************************
+	BCRYPT
+********************************************************************/
+
+// BcryptHasher hashes with bcrypt, e.g. $2a$10$...
+type BcryptHasher struct {
+	Cost int // bcrypt.MinCost .. bcrypt.MaxCost, 0 means bcrypt.DefaultCost
+}
+
+// Hash returns the bcrypt hash of password
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost())
+	return string(hash), err
+}
+
+// Handles reports if hash is a bcrypt hash
+func (h BcryptHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Verify compares password with the bcrypt hash
+func (h BcryptHasher) Verify(hash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NeedsRehash reports if the cost of hash differs from the cost of the hasher
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost()
+}
+
+func (h BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+/********************************************************************
+	ARGON2ID
+********************************************************************/
+
+const (
+	argon2idPrefix     = "$argon2id$"
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+// Argon2idHasher hashes with argon2id (RFC 9106) in the PHC string format, e.g. $argon2id$v=19$m=65536,t=1,p=4$salt$key
+// zero parameters are replaced by the defaults of DefaultConfiguration
+type Argon2idHasher struct {
+	Time      uint32 // number of passes
+	MemoryKiB uint32
+	Threads   uint8
+}
+
+// Hash returns the argon2id hash of password with a random salt
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	h = h.withDefaults()
+	salt := randomBytes(argon2idSaltLength)
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.MemoryKiB, h.Threads, argon2idKeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, h.MemoryKiB, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Handles reports if hash is an argon2id hash
+func (h Argon2idHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, argon2idPrefix)
+}
+
+// Verify compares password with the argon2id hash, using the parameters of the hash
+func (h Argon2idHasher) Verify(hash, password string) (bool, error) {
+	params, salt, key, err := parseArgon2idHash(hash)
+	if err != nil {
+		return false, err
+	}
+	otherKey := argon2.IDKey([]byte(password), salt, params.Time, params.MemoryKiB, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+// NeedsRehash reports if the parameters of hash differ from the parameters of the hasher
+func (h Argon2idHasher) NeedsRehash(hash string) bool {
+	params, _, key, err := parseArgon2idHash(hash)
+	return err != nil || params != h.withDefaults() || len(key) != argon2idKeyLength
+}
+
+func (h Argon2idHasher) withDefaults() Argon2idHasher {
+	defaults := DefaultConfiguration()
+	if h.Time == 0 {
+		h.Time = uint32(defaults.Argon2Time)
+	}
+	if h.MemoryKiB == 0 {
+		h.MemoryKiB = uint32(defaults.Argon2Memory)
+	}
+	if h.Threads == 0 {
+		h.Threads = uint8(defaults.Argon2Threads)
+	}
+	return h
+}
+
+// parseArgon2idHash splits an argon2id hash into parameters, salt and key
+func parseArgon2idHash(hash string) (params Argon2idHasher, salt, key []byte, err error) {
+	invalid := errors.New("invalid argon2id hash")
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, invalid
+	}
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, invalid
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.MemoryKiB, &params.Time, &params.Threads)
+	if err != nil || params.Time == 0 || params.Threads == 0 {
+		return params, nil, nil, invalid
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, invalid
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, invalid
+	}
+	return params, salt, key, nil
+}
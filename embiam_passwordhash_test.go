@@ -0,0 +1,92 @@
+package embiam
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := []PasswordHasher{
+		BcryptHasher{Cost: 4},
+		Argon2idHasher{Time: 1, MemoryKiB: 1024, Threads: 1},
+	}
+	for _, hasher := range hashers {
+		hash, err := hasher.Hash(testPassword)
+		if err != nil {
+			t.Errorf("%T.Hash(testPassword) returned error %s; want hash\n", hasher, err)
+			continue
+		}
+		if !hasher.Handles(hash) || hasher.NeedsRehash(hash) {
+			t.Errorf("%T doesn't handle its hash %s or needs rehash; want handled hash without rehash\n", hasher, hash)
+		}
+		if ok, err := hasher.Verify(hash, testPassword); !ok || err != nil {
+			t.Errorf("%T.Verify(hash, testPassword) returned %t, %v; want true\n", hasher, ok, err)
+		}
+		if ok, err := hasher.Verify(hash, `Wr0ngPassWord`); ok || err != nil {
+			t.Errorf("%T.Verify(hash, Wr0ngPassWord) returned %t, %v; want false without error\n", hasher, ok, err)
+		}
+		for _, other := range hashers {
+			if other != hasher && other.Handles(hash) {
+				t.Errorf("%T handles hash %s of %T; want false\n", other, hash, hasher)
+			}
+		}
+	}
+
+	// other parameters
+	hash, _ := hashers[1].Hash(testPassword)
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Argon2idHasher.Hash(testPassword) returned %s; want PHC string with parameters\n", hash)
+	}
+	if !(Argon2idHasher{Time: 2, MemoryKiB: 1024, Threads: 1}).NeedsRehash(hash) {
+		t.Errorf("Argon2idHasher.NeedsRehash(hash) returned false for other parameters; want true\n")
+	}
+	hash, _ = hashers[0].Hash(testPassword)
+	if !(BcryptHasher{Cost: 5}).NeedsRehash(hash) {
+		t.Errorf("BcryptHasher.NeedsRehash(hash) returned false for other cost; want true\n")
+	}
+}
+
+func TestRehashOnSignIn(t *testing.T) {
+	Initialize(new(DbTransient))
+	ne, _ := CreateEntity(`N1CK0001`, nil)
+	entity, _ := Db.ReadEntityByNick(ne.Nick)
+	if !strings.HasPrefix(entity.PasswordHash, "$2a$10$") {
+		t.Errorf("entity.PasswordHash is %s; want bcrypt hash with default cost\n", entity.PasswordHash)
+	}
+
+	// switch to argon2id, the bcrypt hash is still verified and replaced
+	config := Configuration
+	config.PasswordHashAlgorithm = PasswordHashArgon2id
+	config.Argon2Time, config.Argon2Memory, config.Argon2Threads = 1, 1024, 1
+	initializePasswordHashers(config)
+	defer initializePasswordHashers(DefaultConfiguration())
+	_, err := CheckIdentity(ne.Nick, ne.Password, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(...) returned error %s for bcrypt hash; want identity token\n", err)
+	}
+	entity, _ = Db.ReadEntityByNick(ne.Nick)
+	if !strings.HasPrefix(entity.PasswordHash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("entity.PasswordHash is %s after sign in; want argon2id hash\n", entity.PasswordHash)
+	}
+	argon2Hash := entity.PasswordHash
+	_, err = CheckIdentity(ne.Nick, ne.Password, testHost)
+	entity, _ = Db.ReadEntityByNick(ne.Nick)
+	if err != nil || entity.PasswordHash != argon2Hash {
+		t.Errorf("CheckIdentity(...) returned %v and changed hash %s; want identity token without rehash\n", err, entity.PasswordHash)
+	}
+	// a wrong password doesn't change the hash
+	CheckIdentity(ne.Nick, `Wr0ngPassWord`, testHost)
+	entity, _ = Db.ReadEntityByNick(ne.Nick)
+	if entity.PasswordHash != argon2Hash {
+		t.Errorf("entity.PasswordHash changed after wrong password; want %s\n", argon2Hash)
+	}
+
+	// unknown algorithm
+	entity.PasswordHash = "$unknown$hash"
+	Db.SaveEntity(entity)
+	_, err = CheckIdentity(ne.Nick, ne.Password, testHost)
+	if !errors.Is(err, ErrUnknownHash) {
+		t.Errorf("CheckIdentity(...) returned %v for unknown hash; want ErrUnknownHash\n", err)
+	}
+}
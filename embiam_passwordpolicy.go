@@ -0,0 +1,307 @@
+package embiam
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/********************************************************************
+	PASSWORD POLICY
+	Entities can change their generated password with
+	ChangePassword, administrators set passwords with SetPassword.
+	The new passwords are checked against Configuration.PasswordPolicy:
+
+	  minLength            minimum number of characters
+	  minCharacterClasses  minimum number of character classes
+	                       (lower case, upper case, digits, others)
+	  minEntropyBits       minimum estimated entropy (see passwordEntropy)
+	  forbiddenSubstrings  e.g. "password", the nick is always forbidden
+
+	If the password violates the policy, a PasswordPolicyError
+	lists every failed rule.
+
+	The hashes of the previous passwords are kept in the history
+	of the entity (passwordHistoryDepth), these passwords can't be
+	used again. Passwords expire after passwordMaxAgeDays, then
+	CheckIdentity returns ErrPasswordExpired and only
+	ChangePassword accepts the password.
+
+	ChangePassword checks the old password like a sign in (rate
+	limit for the client validFor, lock, wrong passwords). Entities
+	with TOTP use ChangePasswordWithOTP with a one-time password.
+
+	Entities created by administrators (CreateEntity) and entities
+	with a password set by SetPassword must change the password:
+	CheckIdentity provides a restricted identity token, that is
+	only authorized for RessourcePassword and ActionChangePassword
+	(see IsAuthorized) until ChangePassword was called.
+********************************************************************/
+
+// Rules of the password policy
+const (
+	PasswordRuleMinLength           = "minLength"
+	PasswordRuleMinCharacterClasses = "minCharacterClasses"
+	PasswordRuleMinEntropy          = "minEntropyBits"
+	PasswordRuleForbiddenSubstring  = "forbiddenSubstring"
+	PasswordRuleHistory             = "history"
+)
+
+// Ressource and action of the password change, every identity token is authorized for it (see IsAuthorized)
+const (
+	RessourcePassword    = "embiam.password"
+	ActionChangePassword = "change"
+)
+
+type (
+	// PasswordPolicy contains the rules for passwords chosen by entities or administrators
+	PasswordPolicy struct {
+		MinLength           int      `json:"minLength"`
+		MinCharacterClasses int      `json:"minCharacterClasses"`
+		MinEntropyBits      int      `json:"minEntropyBits"`
+		ForbiddenSubstrings []string `json:"forbiddenSubstrings"` // case-insensitive
+	}
+
+	// PasswordViolation describes a failed rule of the password policy
+	PasswordViolation struct {
+		Rule    string `json:"rule"` // e.g. PasswordRuleMinLength
+		Message string `json:"message"`
+	}
+
+	// PasswordPolicyError is returned for a password, that violates the policy, it lists all failed rules
+	PasswordPolicyError struct {
+		Violations []PasswordViolation
+	}
+)
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.Message
+	}
+	return ErrPasswordPolicy.Error() + ": " + strings.Join(messages, "; ")
+}
+
+func (e *PasswordPolicyError) Unwrap() error {
+	return ErrPasswordPolicy
+}
+
+// Check checks password of the entity nick against the policy
+// the result is nil or a PasswordPolicyError with all violations
+func (p PasswordPolicy) Check(nick, password string) error {
+	violations := []PasswordViolation{}
+	length := len([]rune(password))
+	if length < p.MinLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    PasswordRuleMinLength,
+			Message: fmt.Sprintf("password has %d characters, at least %d are required", length, p.MinLength),
+		})
+	}
+	if classes := passwordCharacterClasses(password); classes < p.MinCharacterClasses {
+		violations = append(violations, PasswordViolation{
+			Rule:    PasswordRuleMinCharacterClasses,
+			Message: fmt.Sprintf("password has %d character classes, at least %d of lower case, upper case, digits and others are required", classes, p.MinCharacterClasses),
+		})
+	}
+	if entropy := passwordEntropy(password); entropy < float64(p.MinEntropyBits) {
+		violations = append(violations, PasswordViolation{
+			Rule:    PasswordRuleMinEntropy,
+			Message: fmt.Sprintf("password has an estimated entropy of %.0f bit, at least %d bit are required", entropy, p.MinEntropyBits),
+		})
+	}
+	lowerPassword := strings.ToLower(password)
+	for _, forbidden := range append([]string{nick}, p.ForbiddenSubstrings...) {
+		if forbidden != "" && strings.Contains(lowerPassword, strings.ToLower(forbidden)) {
+			violations = append(violations, PasswordViolation{
+				Rule:    PasswordRuleForbiddenSubstring,
+				Message: fmt.Sprintf("password contains '%s'", forbidden),
+			})
+		}
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// passwordCharacterClasses returns the number of character classes (lower case, upper case, digits, others) in password
+func passwordCharacterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// passwordEntropy estimates the entropy of password in bit: the size of the alphabet of its
+// character classes to the power of its length; characters repeating the previous character
+// or continuing a sequence (like abc or 123) don't count
+func passwordEntropy(password string) float64 {
+	alphabet := 0
+	runes := []rune(password)
+	var lower, upper, digit, other bool
+	effectiveLength := 0
+	for i, c := range runes {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			other = true
+		}
+		if i > 0 && (c == runes[i-1] || c == runes[i-1]+1 || c == runes[i-1]-1) {
+			continue
+		}
+		effectiveLength++
+	}
+	if lower {
+		alphabet += 26
+	}
+	if upper {
+		alphabet += 26
+	}
+	if digit {
+		alphabet += 10
+	}
+	if other {
+		alphabet += 33
+	}
+	if alphabet == 0 {
+		return 0
+	}
+	return float64(effectiveLength) * math.Log2(float64(alphabet))
+}
+
+// ChangePassword replaces the password of an entity, the old password is checked and the new one must comply with the policy
+// all identity tokens of the entity are revoked, so the entity signs in again with the new password.
+// Entities with TOTP get ErrOTPRequired and use ChangePasswordWithOTP
+func ChangePassword(nick, oldPassword, newPassword, validFor string) error {
+	return ChangePasswordWithOTP(nick, oldPassword, "", newPassword, validFor)
+}
+
+// ChangePasswordWithOTP works like ChangePassword, but checks the one-time password code of entities with TOTP too
+func ChangePasswordWithOTP(nick, oldPassword, code, newPassword, validFor string) error {
+	err := changePassword(nick, oldPassword, code, newPassword, validFor)
+	audit(AuditPasswordChanged, nick, Actor{Nick: nick, ValidFor: validFor}, err, nil)
+	return err
+}
+
+// changePassword replaces the password of an entity (without audit event)
+func changePassword(nick, oldPassword, code, newPassword, validFor string) error {
+	// check old password and second factor like a sign in (rate limit, lock, wrong passwords and codes)
+	entity, _, err := readEntityWithPassword(nick, oldPassword, validFor)
+	if err != nil {
+		return err
+	}
+	err = checkSecondFactor(entity, code, validFor)
+	if err != nil {
+		return err
+	}
+	// check new password
+	err = Configuration.PasswordPolicy.Check(nick, newPassword)
+	if err != nil {
+		return err
+	}
+	return setPassword(entity, newPassword, false)
+}
+
+// SetPassword sets the password of an entity, e.g. by an administrator; the password must comply with the policy
+// all identity tokens of the entity are revoked and the entity must change the password (see MustChangePassword)
+func SetPassword(nick, password string) error {
+	return SetPasswordBy(Actor{}, nick, password)
+}
+
+// SetPasswordBy sets the password like SetPassword, actor is recorded in the audit event
+func SetPasswordBy(actor Actor, nick, password string) error {
+	err := Configuration.PasswordPolicy.Check(nick, password)
+	if err == nil {
+		var entity *Entity
+		entity, err = Db.ReadEntityByNick(nick)
+		if err == nil {
+			// only the entity itself keeps the password
+			err = setPassword(entity, password, actor.Nick != nick)
+		}
+	}
+	audit(AuditPasswordChanged, nick, actor, err, nil)
+	return err
+}
+
+// setPassword saves the hash of password, clears the counter of wrong passwords and revokes the identity tokens of entity
+// the current and the previous passwords (see passwordHistoryDepth) are rejected
+func setPassword(entity *Entity, password string, mustChangePassword bool) error {
+	err := entity.checkPasswordHistory(password)
+	if err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	entity.replacePasswordHash(hash)
+	entity.MustChangePassword = mustChangePassword
+	entity.WrongPasswordCounter = 0
+	entity.UpdateTimeStamp = time.Now().UTC()
+	err = Db.SaveEntity(entity)
+	if err != nil {
+		return err
+	}
+	return RevokeAllIdentityTokensForNick(entity.Nick)
+}
+
+// checkPasswordHistory returns a PasswordPolicyError, if password is the current password or one of the previous passwords
+func (e *Entity) checkPasswordHistory(password string) error {
+	// the current password is always checked, the history only up to the configured depth
+	hashes := []string{e.PasswordHash}
+	if depth := Configuration.PasswordHistoryDepth; depth > 0 {
+		history := e.PasswordHistory
+		if len(history) > depth {
+			history = history[:depth]
+		}
+		hashes = append(hashes, history...)
+	}
+	for _, hash := range hashes {
+		// hashes of unknown algorithms can't match
+		if ok, _, _ := verifyHash(hash, password); ok {
+			message := "password is the current password"
+			if Configuration.PasswordHistoryDepth > 0 {
+				message = fmt.Sprintf("password was used before, the last %d passwords can't be used again", Configuration.PasswordHistoryDepth)
+			}
+			return &PasswordPolicyError{Violations: []PasswordViolation{{
+				Rule:    PasswordRuleHistory,
+				Message: message,
+			}}}
+		}
+	}
+	return nil
+}
+
+// replacePasswordHash sets the hash of a new password, the hash of the current password is added to the history
+func (e *Entity) replacePasswordHash(hash string) {
+	history := e.PasswordHistory
+	if e.PasswordHash != "" {
+		history = append([]string{e.PasswordHash}, history...)
+	}
+	if len(history) > Configuration.PasswordHistoryDepth {
+		history = history[:Configuration.PasswordHistoryDepth]
+	}
+	if len(history) == 0 {
+		history = nil
+	}
+	e.PasswordHistory = history
+	e.PasswordHash = hash
+	e.PasswordChangedAt = time.Now().UTC()
+}
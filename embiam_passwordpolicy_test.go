@@ -0,0 +1,290 @@
+package embiam
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:           12,
+		MinCharacterClasses: 3,
+		MinEntropyBits:      50,
+		ForbiddenSubstrings: []string{"password"},
+	}
+	tests := []struct {
+		password  string
+		wantRules []string
+	}{
+		{`Tr0ub4dor&3horse`, nil},
+		{`Ab1!`, []string{PasswordRuleMinLength, PasswordRuleMinEntropy}},
+		{`correcthorsebatterystaple`, []string{PasswordRuleMinCharacterClasses}},
+		{`Aaaaaaaaaaaaaaaa1`, []string{PasswordRuleMinEntropy}},
+		{`Abcdefghijklmnop1`, []string{PasswordRuleMinEntropy}},
+		{`MyPassWord-2024!`, []string{PasswordRuleForbiddenSubstring}},
+		{`N1CK0001-xyz-Qrs`, []string{PasswordRuleForbiddenSubstring}},
+	}
+	for _, test := range tests {
+		err := policy.Check(`n1ck0001`, test.password)
+		if test.wantRules == nil {
+			if err != nil {
+				t.Errorf("policy.Check(nick, %s) returned error %s; want nil\n", test.password, err)
+			}
+			continue
+		}
+		policyError := &PasswordPolicyError{}
+		if !errors.As(err, &policyError) || !errors.Is(err, ErrPasswordPolicy) {
+			t.Errorf("policy.Check(nick, %s) returned %v; want PasswordPolicyError\n", test.password, err)
+			continue
+		}
+		rules := []string{}
+		for _, violation := range policyError.Violations {
+			rules = append(rules, violation.Rule)
+		}
+		if len(rules) != len(test.wantRules) {
+			t.Errorf("policy.Check(nick, %s) returned violations %v; want %v\n", test.password, rules, test.wantRules)
+			continue
+		}
+		for i := range rules {
+			if rules[i] != test.wantRules[i] {
+				t.Errorf("policy.Check(nick, %s) returned violations %v; want %v\n", test.password, rules, test.wantRules)
+				break
+			}
+		}
+	}
+
+	// nested configuration from environment
+	os.Setenv("EMBIAM_PASSWORD_POLICY_MIN_LENGTH", "20")
+	os.Setenv("EMBIAM_PASSWORD_POLICY_FORBIDDEN_SUBSTRINGS", "secret, embiam")
+	defer os.Unsetenv("EMBIAM_PASSWORD_POLICY_MIN_LENGTH")
+	defer os.Unsetenv("EMBIAM_PASSWORD_POLICY_FORBIDDEN_SUBSTRINGS")
+	config := DefaultConfiguration()
+	err := config.readEnvironment()
+	if err != nil || config.PasswordPolicy.MinLength != 20 || len(config.PasswordPolicy.ForbiddenSubstrings) != 2 ||
+		config.PasswordPolicy.ForbiddenSubstrings[1] != "embiam" {
+		t.Errorf("config.readEnvironment() returned %v and policy %v; want minLength 20 and forbidden substrings [secret embiam]\n", err, config.PasswordPolicy)
+	}
+	config.PasswordPolicy.MinCharacterClasses = 5
+	if err = config.Validate(); !errors.Is(err, ErrInvalidConfiguration) {
+		t.Errorf("config.Validate() returned %v for 5 character classes; want ErrInvalidConfiguration\n", err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	Initialize(new(DbTransient))
+	ne, _ := CreateEntity(`N1CK0001`, nil)
+	identityToken, _ := CheckIdentity(ne.Nick, ne.Password, testHost)
+	newPassword := `Tr0ub4dor&3horse`
+
+	err := ChangePassword(ne.Nick, `Wr0ngPassWord`, newPassword, testHost)
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("ChangePassword(nick, wrong password, ...) returned %v; want ErrInvalidCredentials\n", err)
+	}
+	err = ChangePassword(ne.Nick, ne.Password, `short`, testHost)
+	if !errors.Is(err, ErrPasswordPolicy) {
+		t.Errorf("ChangePassword(nick, password, short) returned %v; want ErrPasswordPolicy\n", err)
+	}
+	err = ChangePassword(ne.Nick, ne.Password, newPassword, testHost)
+	if err != nil {
+		t.Errorf("ChangePassword(nick, password, newPassword) returned error %s; want nil\n", err)
+	}
+	if IsIdentityTokenValid(identityToken.Token, testHost) {
+		t.Errorf("IsIdentityTokenValid(identityToken) returned true after ChangePassword; want revoked token\n")
+	}
+	if _, err = CheckIdentity(ne.Nick, ne.Password, testHost); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("CheckIdentity(nick, old password) returned %v; want ErrInvalidCredentials\n", err)
+	}
+	if _, err = CheckIdentity(ne.Nick, newPassword, testHost); err != nil {
+		t.Errorf("CheckIdentity(nick, new password) returned error %s; want identity token\n", err)
+	}
+
+	// set password (e.g. by an administrator)
+	err = SetPassword(ne.Nick, `weak`)
+	if !errors.Is(err, ErrPasswordPolicy) {
+		t.Errorf("SetPassword(nick, weak) returned %v; want ErrPasswordPolicy\n", err)
+	}
+	err = SetPassword(`UNKNOWN`, newPassword)
+	if !errors.Is(err, ErrEntityNotFound) {
+		t.Errorf("SetPassword(UNKNOWN, ...) returned %v; want ErrEntityNotFound\n", err)
+	}
+	err = SetPassword(ne.Nick, `C0rrect-Battery-Staple`)
+	if err != nil {
+		t.Errorf("SetPassword(nick, ...) returned error %s; want nil\n", err)
+	}
+	if _, err = CheckIdentity(ne.Nick, `C0rrect-Battery-Staple`, testHost); err != nil {
+		t.Errorf("CheckIdentity(nick, password set by SetPassword) returned error %s; want identity token\n", err)
+	}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	Initialize(new(DbTransient))
+	Configuration.PasswordHistoryDepth = 2
+	ne, _ := CreateEntity(`N1CK0001`, nil)
+	passwords := []string{ne.Password, `Tr0ub4dor&3horse`, `C0rrect-Battery-Staple`, `Qu1et-Violet-Ocean`}
+	for i := 1; i < len(passwords); i++ {
+		err := ChangePassword(ne.Nick, passwords[i-1], passwords[i], testHost)
+		if err != nil {
+			t.Errorf("ChangePassword(nick, %s, %s) returned error %s; want nil\n", passwords[i-1], passwords[i], err)
+		}
+	}
+	entity, _ := Db.ReadEntityByNick(ne.Nick)
+	if len(entity.PasswordHistory) != 2 {
+		t.Errorf("entity.PasswordHistory has %d hashes; want 2\n", len(entity.PasswordHistory))
+	}
+	// current and the last 2 passwords are rejected, older passwords are allowed again
+	current := passwords[3]
+	for _, password := range passwords[1:] {
+		err := ChangePassword(ne.Nick, current, password, testHost)
+		policyError := &PasswordPolicyError{}
+		if !errors.As(err, &policyError) || policyError.Violations[0].Rule != PasswordRuleHistory {
+			t.Errorf("ChangePassword(nick, current, %s) returned %v; want violation of rule history\n", password, err)
+		}
+	}
+	err := SetPassword(ne.Nick, passwords[2])
+	if !errors.Is(err, ErrPasswordPolicy) {
+		t.Errorf("SetPassword(nick, %s) returned %v; want ErrPasswordPolicy for previous password\n", passwords[2], err)
+	}
+	err = ChangePassword(ne.Nick, current, passwords[0], testHost)
+	if err != nil {
+		t.Errorf("ChangePassword(nick, current, first password) returned error %s; want nil\n", err)
+	}
+
+	// without history every password except the current one is allowed
+	Configuration.PasswordHistoryDepth = 0
+	err = ChangePassword(ne.Nick, passwords[0], passwords[0], testHost)
+	policyError := &PasswordPolicyError{}
+	if !errors.As(err, &policyError) || policyError.Violations[0].Rule != PasswordRuleHistory {
+		t.Errorf("ChangePassword(nick, current, current) returned %v for passwordHistoryDepth 0; want violation of rule history\n", err)
+	}
+	err = ChangePassword(ne.Nick, passwords[0], passwords[1], testHost)
+	entity, _ = Db.ReadEntityByNick(ne.Nick)
+	if err != nil || entity.PasswordHistory != nil {
+		t.Errorf("ChangePassword(...) returned %v with history %v for passwordHistoryDepth 0; want no error and no history\n", err, entity.PasswordHistory)
+	}
+}
+
+func TestPasswordExpiry(t *testing.T) {
+	Initialize(new(DbTransient))
+	Configuration.PasswordMaxAgeDays = 30
+	ne, _ := CreateEntity(`N1CK0001`, nil)
+	identityToken, err := CheckIdentity(ne.Nick, ne.Password, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(...) returned error %s for new password; want identity token\n", err)
+	}
+
+	// password changed 31 days ago
+	entity, _ := Db.ReadEntityByNick(ne.Nick)
+	entity.PasswordChangedAt = time.Now().UTC().AddDate(0, 0, -31)
+	Db.SaveEntity(entity)
+	if !entity.PasswordExpired() {
+		t.Errorf("entity.PasswordExpired() returned false after 31 days; want true\n")
+	}
+	_, err = CheckIdentity(ne.Nick, ne.Password, testHost)
+	if !errors.Is(err, ErrPasswordExpired) {
+		t.Errorf("CheckIdentity(...) returned %v for expired password; want ErrPasswordExpired\n", err)
+	}
+	_, err = RefreshIdentityToken(identityToken.RefreshToken, testHost)
+	if !errors.Is(err, ErrPasswordExpired) {
+		t.Errorf("RefreshIdentityToken(...) returned %v for expired password; want ErrPasswordExpired\n", err)
+	}
+	// a wrong password is still a wrong password
+	_, err = CheckIdentity(ne.Nick, `Wr0ngPassWord`, testHost)
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("CheckIdentity(...) returned %v for wrong password; want ErrInvalidCredentials\n", err)
+	}
+
+	// change the expired password
+	newPassword := `Tr0ub4dor&3horse`
+	err = ChangePassword(ne.Nick, ne.Password, newPassword, testHost)
+	if err != nil {
+		t.Errorf("ChangePassword(...) returned error %s for expired password; want nil\n", err)
+	}
+	_, err = CheckIdentity(ne.Nick, newPassword, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(...) returned error %s after ChangePassword; want identity token\n", err)
+	}
+
+	// entities of older versions without PasswordChangedAt expire relative to CreateTimeStamp
+	entity, _ = Db.ReadEntityByNick(ne.Nick)
+	entity.PasswordChangedAt = time.Time{}
+	entity.CreateTimeStamp = time.Now().UTC().AddDate(0, 0, -10)
+	if want := entity.CreateTimeStamp.AddDate(0, 0, 30); !entity.PasswordExpiresAt().Equal(want) {
+		t.Errorf("entity.PasswordExpiresAt() returned %s; want %s\n", entity.PasswordExpiresAt(), want)
+	}
+	Configuration.PasswordMaxAgeDays = 0
+	if !entity.PasswordExpiresAt().IsZero() {
+		t.Errorf("entity.PasswordExpiresAt() returned %s for passwordMaxAgeDays 0; want zero time\n", entity.PasswordExpiresAt())
+	}
+}
+
+func TestMustChangePassword(t *testing.T) {
+	Initialize(new(DbTransient))
+	roles := GetRoles()
+	roles["application"] = RoleBodyStruct{Authorization: []AuthorizationStruct{{
+		Ressource: "application",
+		Action:    ActionMap{"use": {}},
+	}}}
+	SaveRoles(roles)
+
+	// entities created by an administrator get a restricted identity token
+	ne, _ := CreateEntity(`N1CK0001`, []RoleIdType{`application`})
+	if !ne.MustChangePassword {
+		t.Errorf("CreateEntity(...) returned entity without MustChangePassword; want true\n")
+	}
+	identityToken, err := CheckIdentity(ne.Nick, ne.Password, testHost)
+	if err != nil || !identityToken.MustChangePassword {
+		t.Errorf("CheckIdentity(...) returned %v, %v; want restricted identity token\n", identityToken, err)
+	}
+	if IsIdentityTokenValid(identityToken.Token, testHost) || !IsIdentityTokenRestricted(identityToken.Token) {
+		t.Errorf("IsIdentityTokenValid(restricted token) returned true; want false\n")
+	}
+	if IsAuthorized(identityToken.Token, "application", "use") {
+		t.Errorf("IsAuthorized(restricted token, application, use) returned true; want false\n")
+	}
+	if !IsAuthorized(identityToken.Token, RessourcePassword, ActionChangePassword) {
+		t.Errorf("IsAuthorized(restricted token, RessourcePassword, ActionChangePassword) returned false; want true\n")
+	}
+	// refreshed tokens are still restricted
+	refreshedToken, err := RefreshIdentityToken(identityToken.RefreshToken, testHost)
+	if err != nil || !refreshedToken.MustChangePassword || !IsIdentityTokenRestricted(refreshedToken.Token) {
+		t.Errorf("RefreshIdentityToken(...) returned %v, %v; want restricted identity token\n", refreshedToken, err)
+	}
+
+	// change password: the restricted tokens are revoked, new tokens are not restricted
+	newPassword := `Tr0ub4dor&3horse`
+	err = ChangePassword(ne.Nick, ne.Password, newPassword, testHost)
+	if err != nil {
+		t.Errorf("ChangePassword(...) returned error %s; want nil\n", err)
+	}
+	if IsAuthorized(refreshedToken.Token, RessourcePassword, ActionChangePassword) {
+		t.Errorf("IsAuthorized(restricted token, ...) returned true after ChangePassword; want revoked token\n")
+	}
+	identityToken, err = CheckIdentity(ne.Nick, newPassword, testHost)
+	if err != nil || identityToken.MustChangePassword || !IsIdentityTokenValid(identityToken.Token, testHost) {
+		t.Errorf("CheckIdentity(...) returned %v, %v after ChangePassword; want unrestricted identity token\n", identityToken, err)
+	}
+	if !IsAuthorized(identityToken.Token, "application", "use") || !IsAuthorized(identityToken.Token, RessourcePassword, ActionChangePassword) {
+		t.Errorf("IsAuthorized(identityToken, ...) returned false after ChangePassword; want true\n")
+	}
+
+	// a password set by an administrator must be changed again, not by the entity itself
+	SetPassword(ne.Nick, `C0rrect-Battery-Staple`)
+	entity, _ := Db.ReadEntityByNick(ne.Nick)
+	if !entity.MustChangePassword {
+		t.Errorf("entity.MustChangePassword is false after SetPassword; want true\n")
+	}
+	SetPasswordBy(Actor{Nick: ne.Nick}, ne.Nick, `Qu1et-Violet-Ocean`)
+	entity, _ = Db.ReadEntityByNick(ne.Nick)
+	if entity.MustChangePassword {
+		t.Errorf("entity.MustChangePassword is true after SetPasswordBy the entity itself; want false\n")
+	}
+
+	// nobody else knows the password of entities created with an entity token
+	token, _ := NewEntityToken()
+	ne, err = NewEntity(token.Token, token.Pin)
+	if err != nil || ne.MustChangePassword {
+		t.Errorf("NewEntity(...) returned %v with MustChangePassword %t; want false\n", err, ne.MustChangePassword)
+	}
+}
@@ -0,0 +1,158 @@
+package embiam
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+/********************************************************************
+	SIGN IN RATE LIMIT
+	Every sign in attempt (CheckIdentity, CheckAuthIdentity) takes
+	a token from two token buckets: one for the client (validFor)
+	and one for the nick. So a client can't spray passwords across
+	many nicks and a nick can't be attacked from many clients.
+	A bucket holds up to Configuration.SignInRateLimitBurst tokens
+	and is refilled with SignInRateLimitPerMinute tokens per minute.
+	The check is done before the (expensive) check of the password.
+	If a bucket is empty, a RateLimitError with the time to wait
+	is returned.
+
+	The number of buckets is limited by SignInRateLimitMaxKeys.
+	The buckets are kept in a list ordered by their last use. If
+	the limit is reached, idle buckets (completely refilled) at the
+	end of the list are removed, and then the least recently used
+	bucket. So the costs don't grow with the number of buckets.
+********************************************************************/
+
+type (
+	// rateLimitBucketStruct is the token bucket of a client or a nick
+	rateLimitBucketStruct struct {
+		key      string
+		tokens   float64
+		lastUsed time.Time
+	}
+
+	// rateLimiterType keeps the token buckets for the sign in attempts
+	rateLimiterType struct {
+		mutex     sync.Mutex
+		buckets   map[string]*list.Element // key is the prefixed validFor or nick, value is a *rateLimitBucketStruct
+		lru       *list.List               // buckets, most recently used first
+		perMinute int                      // refill rate, 0 means no rate limit
+		burst     int                      // capacity of a bucket
+		maxKeys   int                      // maximum number of buckets
+	}
+)
+
+var signInRateLimiter rateLimiterType
+
+// initialize empties the rate limiter and sets its parameters
+func (rl *rateLimiterType) initialize(perMinute, burst, maxKeys int) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.buckets = make(map[string]*list.Element)
+	rl.lru = list.New()
+	rl.perMinute = perMinute
+	rl.burst = burst
+	rl.maxKeys = maxKeys
+}
+
+// checkSignInRateLimit takes a token for validFor and for nick, it returns a RateLimitError, if one of the buckets is empty
+// without validFor only the nick is limited
+func checkSignInRateLimit(nick, validFor string) error {
+	keys := []string{"nick:" + nick}
+	if validFor != "" {
+		keys = append(keys, "validFor:"+validFor)
+	}
+	retryAfter := signInRateLimiter.take(time.Now(), keys...)
+	if retryAfter > 0 {
+		return &RateLimitError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// take removes a token from the buckets of all keys at time now
+// if a bucket is empty, no token is taken at all and the time until a token is available is returned
+func (rl *rateLimiterType) take(now time.Time, keys ...string) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.perMinute <= 0 {
+		return 0
+	}
+	if rl.buckets == nil {
+		rl.buckets = make(map[string]*list.Element)
+		rl.lru = list.New()
+	}
+
+	// refill buckets and check them
+	buckets := make([]rateLimitBucketStruct, len(keys))
+	var retryAfter time.Duration
+	for i, key := range keys {
+		buckets[i] = rl.refill(key, now)
+		if buckets[i].tokens < 1 {
+			wait := time.Duration((1 - buckets[i].tokens) * float64(time.Minute) / float64(rl.perMinute))
+			if wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	if retryAfter > 0 {
+		// round up, so that a token is available after retryAfter
+		return (retryAfter + time.Second - 1).Truncate(time.Second)
+	}
+
+	// take tokens
+	for i, key := range keys {
+		buckets[i].tokens--
+		buckets[i].lastUsed = now
+		if element, ok := rl.buckets[key]; ok {
+			*element.Value.(*rateLimitBucketStruct) = buckets[i]
+			rl.lru.MoveToFront(element)
+			continue
+		}
+		rl.makeRoom(now)
+		rl.buckets[key] = rl.lru.PushFront(&buckets[i])
+	}
+	return 0
+}
+
+// refill returns the bucket of key with the tokens refilled until now, the caller must hold the lock
+func (rl *rateLimiterType) refill(key string, now time.Time) rateLimitBucketStruct {
+	element, ok := rl.buckets[key]
+	if !ok {
+		return rateLimitBucketStruct{key: key, tokens: float64(rl.burst), lastUsed: now}
+	}
+	bucket := *element.Value.(*rateLimitBucketStruct)
+	if now.After(bucket.lastUsed) {
+		bucket.tokens += now.Sub(bucket.lastUsed).Minutes() * float64(rl.perMinute)
+		bucket.lastUsed = now
+	}
+	if bucket.tokens > float64(rl.burst) {
+		bucket.tokens = float64(rl.burst)
+	}
+	return bucket
+}
+
+// makeRoom removes buckets, if the maximum number of buckets is reached, the caller must hold the lock
+// idle buckets (that are completely refilled) are removed from the end of the list first, then the least recently used bucket
+func (rl *rateLimiterType) makeRoom(now time.Time) {
+	if rl.maxKeys <= 0 || len(rl.buckets) < rl.maxKeys {
+		return
+	}
+	for element := rl.lru.Back(); element != nil; element = rl.lru.Back() {
+		bucket := element.Value.(*rateLimitBucketStruct)
+		if len(rl.buckets) >= rl.maxKeys || rl.refill(bucket.key, now).tokens >= float64(rl.burst) {
+			rl.lru.Remove(element)
+			delete(rl.buckets, bucket.key)
+			continue
+		}
+		break
+	}
+}
+
+// size returns the number of buckets
+func (rl *rateLimiterType) size() int {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return len(rl.buckets)
+}
@@ -0,0 +1,108 @@
+package embiam
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := rateLimiterType{}
+	rl.initialize(6, 2, 100) // a token every 10 seconds
+
+	// burst
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if retryAfter := rl.take(now, `validFor:a`, `nick:n`); retryAfter != 0 {
+			t.Errorf("rl.take(now, a, n) returned retry after %s for attempt %d; want 0\n", retryAfter, i)
+		}
+	}
+	retryAfter := rl.take(now, `validFor:a`, `nick:n`)
+	if retryAfter <= 0 || retryAfter > 10*time.Second {
+		t.Errorf("rl.take(now, a, n) returned retry after %s for empty bucket; want up to 10s\n", retryAfter)
+	}
+	// the nick is limited from other clients too, the bucket of the other client is kept
+	if rl.take(now, `validFor:b`, `nick:n`) == 0 {
+		t.Errorf("rl.take(now, b, n) returned 0 for empty bucket of nick; want retry after\n")
+	}
+	if rl.take(now, `validFor:b`, `nick:m`) != 0 || rl.take(now, `validFor:b`, `nick:o`) != 0 {
+		t.Errorf("rl.take(now, b, ...) returned retry after for full bucket of client; want 0\n")
+	}
+
+	// refill
+	now = now.Add(retryAfter)
+	if retryAfter := rl.take(now, `validFor:a`, `nick:n`); retryAfter != 0 {
+		t.Errorf("rl.take(now, a, n) returned retry after %s after refill; want 0\n", retryAfter)
+	}
+
+	// eviction: the least recently used bucket is removed, idle buckets are removed first
+	rl.initialize(6, 2, 3)
+	rl.take(now, `validFor:x`)
+	rl.take(now.Add(time.Second), `validFor:y`)
+	rl.take(now.Add(2*time.Second), `validFor:z`)
+	rl.take(now.Add(3*time.Second), `validFor:w`)
+	if _, ok := rl.buckets[`validFor:x`]; ok || rl.size() != 3 {
+		t.Errorf("rl.take(...) kept least recently used bucket validFor:x with %d buckets; want 3 buckets without validFor:x\n", rl.size())
+	}
+	rl.take(now.Add(4*time.Second), `validFor:y`)
+	rl.take(now.Add(5*time.Second), `validFor:v`)
+	if _, ok := rl.buckets[`validFor:z`]; ok || rl.size() != 3 {
+		t.Errorf("rl.take(...) kept least recently used bucket validFor:z with %d buckets; want 3 buckets without validFor:z\n", rl.size())
+	}
+	rl.take(now.Add(time.Minute), `validFor:u`)
+	if rl.size() != 1 {
+		t.Errorf("rl.size() returned %d after eviction of idle buckets; want 1\n", rl.size())
+	}
+
+	// no rate limit
+	rl.initialize(0, 0, 0)
+	for i := 0; i < 10; i++ {
+		if rl.take(now, `validFor:a`) != 0 {
+			t.Errorf("rl.take(now, a) returned retry after without rate limit; want 0\n")
+		}
+	}
+}
+
+func TestSignInRateLimit(t *testing.T) {
+	Initialize(new(DbTransient))
+	signInRateLimiter.initialize(1, 3, 100)
+	ne, err := CreateEntity(`N1CK0001`, nil)
+	if err != nil {
+		t.Fatalf("CreateEntity(N1CK0001, nil) returned error %s; want new entity\n", err)
+	}
+
+	// concurrent attempts from one client for different nicks
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	limited := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := CheckIdentity(`N1CK000`+string(rune('0'+i)), `Wr0ngPassWord`, testHost)
+			if errors.Is(err, ErrRateLimited) {
+				mutex.Lock()
+				limited++
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if limited != 7 {
+		t.Errorf("CheckIdentity(...) was limited %d times for 10 attempts; want 7\n", limited)
+	}
+
+	// typed error with retry after
+	_, err = CheckIdentity(`N1CK0001`, ne.Password, testHost)
+	rateLimitError := &RateLimitError{}
+	if !errors.As(err, &rateLimitError) || rateLimitError.RetryAfter <= 0 || rateLimitError.RetryAfter > time.Minute {
+		t.Errorf("CheckIdentity(N1CK0001, ne.Password, testHost) returned %v; want RateLimitError with retry after up to 1m\n", err)
+	}
+
+	// other clients are not limited
+	_, err = CheckIdentity(`N1CK0001`, ne.Password, `192.0.2.1`)
+	if err != nil {
+		t.Errorf("CheckIdentity(N1CK0001, ne.Password, 192.0.2.1) returned error %s; want identity token\n", err)
+	}
+}
@@ -0,0 +1,258 @@
+package embiam
+
+import (
+	"sync"
+	"time"
+)
+
+/********************************************************************
+	REFRESH TOKEN
+	A refresh token is provided together with the identity token.
+	It's used once to get a new identity token (and a new refresh
+	token) without sending nick and password again.
+
+	All refresh tokens of one sign in belong to the same family
+	(session). A session ends after Configuration.SessionLifetimeHours
+	regardless of refreshs. If a refresh token is used a second
+	time, it was probably stolen: the whole family is revoked,
+	including the identity tokens of the family.
+********************************************************************/
+
+type (
+	// refreshTokenCacheItemStruct describes one refresh token
+	refreshTokenCacheItemStruct struct {
+		Family     string
+		ValidUntil time.Time
+		Used       bool
+	}
+
+	// tokenFamilyStruct describes a session, all refresh tokens of a sign in belong to it
+	tokenFamilyStruct struct {
+		Nick       string
+		ValidFor   string // identification of the caller, e.g. the IP
+		StartedAt  time.Time
+		SessionEnd time.Time // absolute end of the session
+	}
+
+	// refreshTokenCacheType is the actual type of the cache for refresh tokens and their families
+	refreshTokenCacheType struct {
+		mutex       sync.Mutex
+		tokens      map[string]refreshTokenCacheItemStruct // key is the refresh token
+		families    map[string]tokenFamilyStruct           // key is the family id
+		stopSweeper chan struct{}
+	}
+)
+
+var refreshTokenCache refreshTokenCacheType
+
+// RefreshIdentityToken provides a new identity token and a new refresh token for a refresh token (for validFor)
+// the refresh token can only be used once
+func RefreshIdentityToken(refreshToken, validFor string) (identityTokenStruct, error) {
+	// use refresh token
+	family, nick, err := refreshTokenCache.use(refreshToken, validFor)
+	if err != nil {
+		if family != "" {
+			// refresh token was reused: revoke the identity tokens of the family too
+			identityTokenCache.removeFamily(family)
+		}
+		return identityTokenStruct{}, err
+	}
+
+	// the entity must still exist and be active (with a valid password)
+	entity, err := Db.ReadEntityByNick(nick)
+	if err != nil {
+		revokeFamily(family)
+		return identityTokenStruct{}, err
+	}
+	if !entity.Active {
+		revokeFamily(family)
+		return identityTokenStruct{}, ErrEntityInactive
+	}
+	// sessions don't outlive the password
+	if entity.PasswordExpired() {
+		revokeFamily(family)
+		return identityTokenStruct{}, ErrPasswordExpired
+	}
+
+	// create identity token and refresh token of the same family
+	return issueIdentityToken(entity, validFor, family)
+}
+
+// initialize empties the cache and (re)starts the sweeper
+func (rtc *refreshTokenCacheType) initialize(sweepInterval time.Duration) {
+	rtc.mutex.Lock()
+	defer rtc.mutex.Unlock()
+
+	// stop sweeper of previous initialization
+	if rtc.stopSweeper != nil {
+		close(rtc.stopSweeper)
+		rtc.stopSweeper = nil
+	}
+
+	rtc.tokens = make(map[string]refreshTokenCacheItemStruct)
+	rtc.families = make(map[string]tokenFamilyStruct)
+
+	// start sweeper
+	if sweepInterval > 0 {
+		rtc.stopSweeper = make(chan struct{})
+		go rtc.sweep(sweepInterval, rtc.stopSweeper)
+	}
+}
+
+// sweep removes expired refresh tokens and sessions every interval until stop is closed
+func (rtc *refreshTokenCacheType) sweep(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rtc.removeExpired(time.Now().UTC())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// removeExpired deletes all refresh tokens and families that ran out of validity
+// used refresh tokens are kept until the end of their validity to detect a reuse
+func (rtc *refreshTokenCacheType) removeExpired(now time.Time) {
+	rtc.mutex.Lock()
+	defer rtc.mutex.Unlock()
+	for family, familyItem := range rtc.families {
+		if familyItem.SessionEnd.Before(now) {
+			delete(rtc.families, family)
+		}
+	}
+	for token, item := range rtc.tokens {
+		if _, ok := rtc.families[item.Family]; !ok || item.ValidUntil.Before(now) {
+			delete(rtc.tokens, token)
+		}
+	}
+}
+
+// newFamily starts a new session for nick and validFor and returns the id of the family
+func (rtc *refreshTokenCacheType) newFamily(nick, validFor string) string {
+	rtc.mutex.Lock()
+	defer rtc.mutex.Unlock()
+
+	now := time.Now().UTC()
+	hours := Configuration.SessionLifetimeHours // absolute lifetime of the session
+	family := generateIdentityToken()
+	rtc.families[family] = tokenFamilyStruct{
+		Nick:       nick,
+		ValidFor:   validFor,
+		StartedAt:  now,
+		SessionEnd: now.Add(time.Hour * time.Duration(hours)),
+	}
+	return family
+}
+
+// add creates a new refresh token for family, its validity ends with the session at the latest
+func (rtc *refreshTokenCacheType) add(family string) (token string, validUntil, sessionEnd time.Time, err error) {
+	rtc.mutex.Lock()
+	defer rtc.mutex.Unlock()
+
+	familyItem, ok := rtc.families[family]
+	if !ok {
+		return "", time.Time{}, time.Time{}, ErrSessionRevoked
+	}
+	hours := Configuration.RefreshTokenValidityHours // number of hours the refresh token is valid
+	validUntil = time.Now().UTC().Add(time.Hour * time.Duration(hours))
+	if validUntil.After(familyItem.SessionEnd) {
+		validUntil = familyItem.SessionEnd
+	}
+	token = generateIdentityToken()
+	rtc.tokens[token] = refreshTokenCacheItemStruct{
+		Family:     family,
+		ValidUntil: validUntil,
+	}
+	return token, validUntil, familyItem.SessionEnd, nil
+}
+
+// use marks a refresh token as used and returns its family and nick
+// a reuse of a refresh token revokes the whole family, the revoked family is returned with the error
+func (rtc *refreshTokenCacheType) use(token, validFor string) (family, nick string, err error) {
+	rtc.mutex.Lock()
+	defer rtc.mutex.Unlock()
+
+	item, ok := rtc.tokens[token]
+	if !ok {
+		return "", "", ErrInvalidRefreshToken
+	}
+	familyItem, ok := rtc.families[item.Family]
+	if !ok {
+		return "", "", ErrInvalidRefreshToken
+	}
+	// check if client's address is correct
+	if familyItem.ValidFor != validFor {
+		return "", "", ErrInvalidRefreshToken
+	}
+	// detect reuse
+	if item.Used {
+		rtc.removeFamilyLocked(item.Family)
+		return item.Family, "", ErrRefreshTokenReused
+	}
+	// check validity
+	now := time.Now().UTC()
+	if item.ValidUntil.Before(now) {
+		return "", "", ErrRefreshTokenExpired
+	}
+	if familyItem.SessionEnd.Before(now) {
+		return "", "", ErrSessionExpired
+	}
+	// mark as used
+	item.Used = true
+	rtc.tokens[token] = item
+	return item.Family, familyItem.Nick, nil
+}
+
+// removeFamily deletes a family and all its refresh tokens
+func (rtc *refreshTokenCacheType) removeFamily(family string) {
+	rtc.mutex.Lock()
+	defer rtc.mutex.Unlock()
+	rtc.removeFamilyLocked(family)
+}
+
+// removeFamilyLocked deletes a family and all its refresh tokens, the caller must hold the lock
+func (rtc *refreshTokenCacheType) removeFamilyLocked(family string) {
+	rtc.removeFamiliesLocked(func(id string, _ tokenFamilyStruct) bool {
+		return id == family
+	})
+}
+
+// removeFamiliesLocked deletes all families matching remove and their refresh tokens, the caller must hold the lock
+func (rtc *refreshTokenCacheType) removeFamiliesLocked(remove func(family string, familyItem tokenFamilyStruct) bool) {
+	removed := map[string]struct{}{}
+	for family, familyItem := range rtc.families {
+		if remove(family, familyItem) {
+			delete(rtc.families, family)
+			removed[family] = struct{}{}
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	for token, item := range rtc.tokens {
+		if _, ok := removed[item.Family]; ok {
+			delete(rtc.tokens, token)
+		}
+	}
+}
+
+// removeNick deletes all families of nick and their refresh tokens
+func (rtc *refreshTokenCacheType) removeNick(nick string) {
+	rtc.mutex.Lock()
+	defer rtc.mutex.Unlock()
+	rtc.removeFamiliesLocked(func(_ string, familyItem tokenFamilyStruct) bool {
+		return familyItem.Nick == nick
+	})
+}
+
+// removeStartedBefore deletes all families started before t and their refresh tokens
+func (rtc *refreshTokenCacheType) removeStartedBefore(t time.Time) {
+	rtc.mutex.Lock()
+	defer rtc.mutex.Unlock()
+	rtc.removeFamiliesLocked(func(_ string, familyItem tokenFamilyStruct) bool {
+		return familyItem.StartedAt.Before(t)
+	})
+}
@@ -0,0 +1,113 @@
+package embiam
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshIdentityToken(t *testing.T) {
+	const testNick = `N1CK0001`
+
+	// initialize embiam
+	Initialize(new(DbTransient))
+	e := Entity{
+		Nick:         testNick,
+		PasswordHash: testHash(t, testPassword),
+		Active:       true,
+		Roles:        []RoleIdType{`application`},
+	}
+	err := Db.SaveEntity(&e)
+	if err != nil {
+		t.Errorf("Db.SaveEntity(&e) returned error %s; want save entity without error\n", err)
+	}
+
+	// sign in provides identity token and refresh token
+	identityToken1, err := CheckIdentity(testNick, testPassword, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(testNick, testPassword, testHost) returned error %s; want identity token\n", err)
+	}
+	if identityToken1.RefreshToken == "" {
+		t.Errorf("CheckIdentity(testNick, testPassword, testHost) returned no refresh token; want refresh token\n")
+	}
+
+	// refresh from other client fails
+	_, err = RefreshIdentityToken(identityToken1.RefreshToken, `192.168.1.1`)
+	if err == nil {
+		t.Errorf("RefreshIdentityToken(refreshToken, 192.168.1.1) returned NO error for other client; want error\n")
+	}
+
+	// refresh rotates identity token and refresh token
+	identityToken2, err := RefreshIdentityToken(identityToken1.RefreshToken, testHost)
+	if err != nil {
+		t.Errorf("RefreshIdentityToken(identityToken1.RefreshToken, testHost) returned error %s; want new identity token\n", err)
+	}
+	if identityToken2.Token == identityToken1.Token || identityToken2.RefreshToken == identityToken1.RefreshToken {
+		t.Errorf("RefreshIdentityToken(...) returned the same tokens; want new tokens\n")
+	}
+	if !IsIdentityTokenValid(identityToken2.Token, testHost) || !IsAuthorized(identityToken2.Token, `application`, `use`) {
+		t.Errorf("refreshed identity token is invalid; want valid identity token\n")
+	}
+	identityToken3, err := RefreshIdentityToken(identityToken2.RefreshToken, testHost)
+	if err != nil {
+		t.Errorf("RefreshIdentityToken(identityToken2.RefreshToken, testHost) returned error %s; want new identity token\n", err)
+	}
+
+	// reuse of a refresh token revokes the whole family
+	_, err = RefreshIdentityToken(identityToken1.RefreshToken, testHost)
+	if err == nil {
+		t.Errorf("RefreshIdentityToken(identityToken1.RefreshToken, testHost) returned NO error for reused refresh token; want error\n")
+	}
+	if IsIdentityTokenValid(identityToken2.Token, testHost) || IsIdentityTokenValid(identityToken3.Token, testHost) {
+		t.Errorf("identity token of revoked family is still valid; want invalid identity token\n")
+	}
+	_, err = RefreshIdentityToken(identityToken3.RefreshToken, testHost)
+	if err == nil {
+		t.Errorf("RefreshIdentityToken(identityToken3.RefreshToken, testHost) returned NO error for revoked family; want error\n")
+	}
+
+	// sign out revokes the refresh token
+	identityToken4, _ := CheckIdentity(testNick, testPassword, testHost)
+	RevokeIdentityToken(identityToken4.Token)
+	_, err = RefreshIdentityToken(identityToken4.RefreshToken, testHost)
+	if err == nil {
+		t.Errorf("RefreshIdentityToken(identityToken4.RefreshToken, testHost) returned NO error after sign out; want error\n")
+	}
+
+	// absolute session lifetime
+	identityToken5, _ := CheckIdentity(testNick, testPassword, testHost)
+	refreshTokenCache.mutex.Lock()
+	family := refreshTokenCache.tokens[identityToken5.RefreshToken].Family
+	familyItem := refreshTokenCache.families[family]
+	familyItem.SessionEnd = time.Now().UTC().Add(-time.Second)
+	refreshTokenCache.families[family] = familyItem
+	refreshTokenCache.mutex.Unlock()
+	_, err = RefreshIdentityToken(identityToken5.RefreshToken, testHost)
+	if err == nil {
+		t.Errorf("RefreshIdentityToken(identityToken5.RefreshToken, testHost) returned NO error after end of session; want error\n")
+	}
+
+	// deactivated entities can't refresh
+	identityToken6, _ := CheckIdentity(testNick, testPassword, testHost)
+	deactivatedEntity, _ := Db.ReadEntityByNick(testNick)
+	deactivatedEntity.Active = false
+	Db.SaveEntity(deactivatedEntity)
+	_, err = RefreshIdentityToken(identityToken6.RefreshToken, testHost)
+	if err == nil {
+		t.Errorf("RefreshIdentityToken(identityToken6.RefreshToken, testHost) returned NO error for deactivated entity; want error\n")
+	}
+
+	// refresh tokens can be switched off
+	Configuration.RefreshTokenValidityHours = 0
+	deactivatedEntity.Active = true
+	Db.SaveEntity(deactivatedEntity)
+	identityToken7, _ := CheckIdentity(testNick, testPassword, testHost)
+	if identityToken7.RefreshToken != "" || identityToken7.RefreshValidUntil != nil {
+		t.Errorf("CheckIdentity(...) returned refresh token with RefreshTokenValidityHours = 0; want no refresh token\n")
+	}
+	jsonBytes, _ := json.Marshal(identityToken7)
+	if strings.Contains(string(jsonBytes), `refreshValidUntil`) {
+		t.Errorf("json.Marshal(identityToken7) returned %s; want no refreshValidUntil without refresh token\n", jsonBytes)
+	}
+}
@@ -0,0 +1,387 @@
+package embiam
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/********************************************************************
+	SIGNED IDENTITY TOKEN
+	If Configuration.SignedIdentityTokens is set, identity tokens
+	are self-contained and signed with Ed25519. The token has the
+	compact format of a JWT: header.claims.signature (each part
+	base64url-encoded). The claims contain nick, validFor, expiry,
+	issuer (Configuration.ServerId) and the id of the signing key.
+
+	Other processes verify the tokens offline with
+	VerifyIdentityToken, they only need the public keys (see
+	PublicSigningKeys and ExportPublicSigningKeys) and the ServerId
+	of the issuer. The issuing process still uses the identity
+	token cache, so revocation works like for random tokens.
+	Tokens of entities, that must change the password, carry the
+	claim mcp; VerifyIdentityToken returns ErrIdentityTokenRestricted
+	for them.
+
+	RotateSigningKey creates a new signing key. The previous key
+	is kept for verification during an overlap, so that tokens
+	signed before the rotation stay valid. The signing keys are
+	saved next to the identity tokens, if the Db implements
+	SigningKeyStore (DbFile, DbSQL and DbBolt do), so that the
+	published keys stay valid after a restart.
+********************************************************************/
+
+type (
+	// IdentityTokenClaims is the content of a signed identity token
+	IdentityTokenClaims struct {
+		Nick       string `json:"sub"`
+		ValidFor   string `json:"validFor"`      // identification of the caller, e.g. the IP
+		IssuedAt   int64  `json:"iat"`           // unix time
+		ExpiresAt  int64  `json:"exp"`           // unix time
+		Issuer     string `json:"iss"`           // ServerId of the issuing server
+		TokenId    string `json:"jti"`           // random id, so that every token is unique
+		Restricted bool   `json:"mcp,omitempty"` // must change password, only authorized for the password change
+		KeyId      string `json:"-"`             // id of the signing key, taken from the header
+	}
+
+	// PublicKeySet contains the public keys to verify signed identity tokens (key is the key id)
+	PublicKeySet map[string]ed25519.PublicKey
+
+	// signedTokenHeaderStruct is the header of a signed identity token
+	signedTokenHeaderStruct struct {
+		Algorithm string `json:"alg"`
+		Type      string `json:"typ"`
+		KeyId     string `json:"kid"`
+	}
+
+	// signingKeyStruct is a key to sign identity tokens
+	signingKeyStruct struct {
+		KeyId      string
+		PrivateKey ed25519.PrivateKey
+		NotAfter   time.Time // end of verification after rotation, zero for the current key
+	}
+
+	// signingKeySetType contains the current signing key and previous keys, still valid for verification
+	signingKeySetType struct {
+		mutex sync.RWMutex
+		keys  []signingKeyStruct // the last key is the current key
+		store SigningKeyStore    // persistence of the keys, nil keeps them in memory only
+	}
+
+	// SigningKeyStore persists the keys to sign identity tokens
+	SigningKeyStore interface {
+		SaveSigningKeys(keys []StoredSigningKey) error // replaces all saved keys
+		ReadSigningKeys() ([]StoredSigningKey, error)
+	}
+
+	// StoredSigningKey is a key to sign identity tokens in the SigningKeyStore
+	StoredSigningKey struct {
+		KeyId      string    `json:"keyId"`
+		PrivateKey []byte    `json:"privateKey"`
+		NotAfter   time.Time `json:"notAfter"` // end of verification after rotation, zero for the current key
+	}
+
+	// jwkStruct is a public key in a JSON Web Key Set
+	jwkStruct struct {
+		KeyType   string `json:"kty"`
+		Curve     string `json:"crv"`
+		Use       string `json:"use"`
+		Algorithm string `json:"alg"`
+		KeyId     string `json:"kid"`
+		X         string `json:"x"`
+	}
+
+	// jwksStruct is a JSON Web Key Set
+	jwksStruct struct {
+		Keys []jwkStruct `json:"keys"`
+	}
+)
+
+const signedTokenAlgorithm = "EdDSA"
+
+var signingKeys signingKeySetType
+
+// RotateSigningKey creates a new key to sign identity tokens
+// the previous keys stay valid for the verification of tokens during overlap
+func RotateSigningKey(overlap time.Duration) error {
+	return signingKeys.rotate(overlap)
+}
+
+// PublicSigningKeys returns the public keys of all signing keys that are valid for verification
+func PublicSigningKeys() PublicKeySet {
+	return signingKeys.publicKeys()
+}
+
+// ExportPublicSigningKeys returns the public keys as JSON Web Key Set (JWKS)
+func ExportPublicSigningKeys() ([]byte, error) {
+	jwks := jwksStruct{Keys: []jwkStruct{}}
+	for keyId, publicKey := range PublicSigningKeys() {
+		jwks.Keys = append(jwks.Keys, jwkStruct{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			Use:       "sig",
+			Algorithm: signedTokenAlgorithm,
+			KeyId:     keyId,
+			X:         base64.RawURLEncoding.EncodeToString(publicKey),
+		})
+	}
+	return json.MarshalIndent(jwks, "", "\t")
+}
+
+// ParsePublicSigningKeys reads a JSON Web Key Set (JWKS), e.g. from ExportPublicSigningKeys
+func ParsePublicSigningKeys(jsonBytes []byte) (PublicKeySet, error) {
+	jwks := jwksStruct{}
+	err := json.Unmarshal(jsonBytes, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := PublicKeySet{}
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyType != "OKP" || jwk.Curve != "Ed25519" {
+			continue
+		}
+		publicKey, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid public key " + jwk.KeyId)
+		}
+		keys[jwk.KeyId] = ed25519.PublicKey(publicKey)
+	}
+	return keys, nil
+}
+
+// VerifyIdentityToken checks the signature and validity of a signed identity token (for validFor) with the public keys
+// issuer is the ServerId of the issuing server, tokens of other issuers are rejected
+// it doesn't need the identity token cache and can be used in other processes.
+// Restricted tokens (see Entity.MustChangePassword) return the claims with ErrIdentityTokenRestricted
+func VerifyIdentityToken(token, validFor, issuer string, keys PublicKeySet) (IdentityTokenClaims, error) {
+	// split token
+	tokenPart := strings.Split(token, ".")
+	if len(tokenPart) != 3 {
+		return IdentityTokenClaims{}, ErrInvalidIdentityToken
+	}
+	// read header and get key
+	header := signedTokenHeaderStruct{}
+	err := decodeTokenPart(tokenPart[0], &header)
+	if err != nil || header.Algorithm != signedTokenAlgorithm {
+		return IdentityTokenClaims{}, ErrInvalidIdentityToken
+	}
+	publicKey, ok := keys[header.KeyId]
+	if !ok {
+		return IdentityTokenClaims{}, fmt.Errorf("%w %s", ErrUnknownSigningKey, header.KeyId)
+	}
+	// check signature
+	signature, err := base64.RawURLEncoding.DecodeString(tokenPart[2])
+	if err != nil {
+		return IdentityTokenClaims{}, ErrInvalidIdentityToken
+	}
+	if !ed25519.Verify(publicKey, []byte(tokenPart[0]+"."+tokenPart[1]), signature) {
+		return IdentityTokenClaims{}, ErrInvalidIdentityToken
+	}
+	// read claims
+	claims := IdentityTokenClaims{}
+	err = decodeTokenPart(tokenPart[1], &claims)
+	if err != nil {
+		return IdentityTokenClaims{}, ErrInvalidIdentityToken
+	}
+	claims.KeyId = header.KeyId
+	// check issuer
+	if claims.Issuer != issuer {
+		return claims, ErrInvalidIdentityToken
+	}
+	// check validity
+	if time.Now().UTC().Unix() >= claims.ExpiresAt {
+		return claims, ErrIdentityTokenExpired
+	}
+	// check if client's address is correct
+	if claims.ValidFor != validFor {
+		return claims, ErrInvalidIdentityToken
+	}
+	// a restricted token is only accepted for the password change
+	if claims.Restricted {
+		return claims, ErrIdentityTokenRestricted
+	}
+	return claims, nil
+}
+
+// signIdentityToken creates a signed identity token for nick and validFor
+// a restricted token (see Entity.MustChangePassword) gets the claim mcp
+func signIdentityToken(nick, validFor string, validUntil time.Time, restricted bool) (string, error) {
+	key, err := signingKeys.current()
+	if err != nil {
+		return "", err
+	}
+	header, err := encodeTokenPart(signedTokenHeaderStruct{
+		Algorithm: signedTokenAlgorithm,
+		Type:      "JWT",
+		KeyId:     key.KeyId,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := encodeTokenPart(IdentityTokenClaims{
+		Nick:       nick,
+		ValidFor:   validFor,
+		IssuedAt:   time.Now().UTC().Unix(),
+		ExpiresAt:  validUntil.Unix(),
+		Issuer:     Configuration.ServerId,
+		TokenId:    randomString(16, nickChars),
+		Restricted: restricted,
+	})
+	if err != nil {
+		return "", err
+	}
+	signature := ed25519.Sign(key.PrivateKey, []byte(header+"."+claims))
+	return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// encodeTokenPart marshals v to json and encodes it with base64url
+func encodeTokenPart(v interface{}) (string, error) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(jsonBytes), nil
+}
+
+// decodeTokenPart decodes a base64url encoded part and unmarshals the json to v
+func decodeTokenPart(part string, v interface{}) error {
+	jsonBytes, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonBytes, v)
+}
+
+// initialize replaces the signing keys by the keys of store, that are still valid for verification
+// without keys, a new key is created with the first signed token; a nil store keeps the keys in memory only
+func (sks *signingKeySetType) initialize(store SigningKeyStore) error {
+	sks.mutex.Lock()
+	defer sks.mutex.Unlock()
+	sks.keys = nil
+	sks.store = store
+	if store == nil {
+		return nil
+	}
+	storedKeys, err := store.ReadSigningKeys()
+	if err != nil {
+		return err
+	}
+	for _, storedKey := range storedKeys {
+		if len(storedKey.PrivateKey) != ed25519.PrivateKeySize {
+			return errors.New("invalid signing key " + storedKey.KeyId)
+		}
+		sks.keys = append(sks.keys, signingKeyStruct{
+			KeyId:      storedKey.KeyId,
+			PrivateKey: ed25519.PrivateKey(storedKey.PrivateKey),
+			NotAfter:   storedKey.NotAfter,
+		})
+	}
+	// the current key is the last key, previous keys are ordered by the end of their verification
+	sort.SliceStable(sks.keys, func(i, j int) bool {
+		if sks.keys[i].NotAfter.IsZero() || sks.keys[j].NotAfter.IsZero() {
+			return sks.keys[j].NotAfter.IsZero() && !sks.keys[i].NotAfter.IsZero()
+		}
+		return sks.keys[i].NotAfter.Before(sks.keys[j].NotAfter)
+	})
+	sks.removeExpired()
+	return nil
+}
+
+// rotate creates a new current key, the previous keys stay valid for verification during overlap
+func (sks *signingKeySetType) rotate(overlap time.Duration) error {
+	sks.mutex.Lock()
+	defer sks.mutex.Unlock()
+	return sks.rotateLocked(overlap)
+}
+
+// rotateLocked creates a new current key, the caller must hold the lock
+func (sks *signingKeySetType) rotateLocked(overlap time.Duration) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(randomSource)
+	if err != nil {
+		return err
+	}
+	keyIdHash := sha256.Sum256(publicKey)
+	now := time.Now().UTC()
+	notAfter := now.Add(overlap)
+	keys := make([]signingKeyStruct, 0, len(sks.keys)+1)
+	for _, key := range sks.keys {
+		if key.NotAfter.IsZero() || key.NotAfter.After(notAfter) {
+			key.NotAfter = notAfter
+		}
+		// keys that are no longer valid for verification are removed
+		if key.NotAfter.After(now) {
+			keys = append(keys, key)
+		}
+	}
+	keys = append(keys, signingKeyStruct{
+		KeyId:      base64.RawURLEncoding.EncodeToString(keyIdHash[:8]),
+		PrivateKey: privateKey,
+	})
+
+	// save the keys before they are used, so that the published keys survive a restart
+	if sks.store != nil {
+		storedKeys := make([]StoredSigningKey, len(keys))
+		for i, key := range keys {
+			storedKeys[i] = StoredSigningKey{KeyId: key.KeyId, PrivateKey: key.PrivateKey, NotAfter: key.NotAfter}
+		}
+		err = sks.store.SaveSigningKeys(storedKeys)
+		if err != nil {
+			return err
+		}
+	}
+	sks.keys = keys
+	return nil
+}
+
+// removeExpired deletes keys that are no longer valid for verification, the caller must hold the lock
+func (sks *signingKeySetType) removeExpired() {
+	now := time.Now().UTC()
+	keys := sks.keys[:0]
+	for _, key := range sks.keys {
+		if key.NotAfter.IsZero() || key.NotAfter.After(now) {
+			keys = append(keys, key)
+		}
+	}
+	sks.keys = keys
+}
+
+// current returns the current signing key, it's created if there isn't any key
+func (sks *signingKeySetType) current() (signingKeyStruct, error) {
+	sks.mutex.RLock()
+	if len(sks.keys) > 0 {
+		key := sks.keys[len(sks.keys)-1]
+		sks.mutex.RUnlock()
+		return key, nil
+	}
+	sks.mutex.RUnlock()
+
+	// create first key (if no other request did it in the meantime)
+	sks.mutex.Lock()
+	defer sks.mutex.Unlock()
+	if len(sks.keys) == 0 {
+		err := sks.rotateLocked(0)
+		if err != nil {
+			return signingKeyStruct{}, err
+		}
+	}
+	return sks.keys[len(sks.keys)-1], nil
+}
+
+// publicKeys returns the public keys of all keys, that are valid for verification
+func (sks *signingKeySetType) publicKeys() PublicKeySet {
+	sks.mutex.Lock()
+	defer sks.mutex.Unlock()
+	sks.removeExpired()
+	keys := PublicKeySet{}
+	for _, key := range sks.keys {
+		keys[key.KeyId] = key.PrivateKey.Public().(ed25519.PublicKey)
+	}
+	return keys
+}
@@ -0,0 +1,163 @@
+package embiam
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedIdentityToken(t *testing.T) {
+	const testNick = `N1CK0001`
+
+	// initialize embiam with signed identity tokens
+	Initialize(new(DbTransient))
+	Configuration.SignedIdentityTokens = true
+	e := Entity{
+		Nick:         testNick,
+		PasswordHash: testHash(t, testPassword),
+		Active:       true,
+		Roles:        []RoleIdType{`application`},
+	}
+	err := Db.SaveEntity(&e)
+	if err != nil {
+		t.Errorf("Db.SaveEntity(&e) returned error %s; want save entity without error\n", err)
+	}
+
+	// sign in provides a signed identity token, that is also valid in the issuing process
+	identityToken1, err := CheckIdentity(testNick, testPassword, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(testNick, testPassword, testHost) returned error %s; want identity token\n", err)
+	}
+	if len(strings.Split(identityToken1.Token, ".")) != 3 {
+		t.Errorf("CheckIdentity(...) returned token %s; want signed token with header, claims and signature\n", identityToken1.Token)
+	}
+	if !IsIdentityTokenValid(identityToken1.Token, testHost) || !IsAuthorized(identityToken1.Token, `application`, `use`) {
+		t.Errorf("signed identity token is invalid in issuing process; want valid token\n")
+	}
+
+	// verify offline with the public keys exported as JWKS
+	jwks, err := ExportPublicSigningKeys()
+	if err != nil {
+		t.Errorf("ExportPublicSigningKeys() returned error %s; want JWKS\n", err)
+	}
+	keys, err := ParsePublicSigningKeys(jwks)
+	if err != nil {
+		t.Errorf("ParsePublicSigningKeys(jwks) returned error %s; want public keys\n", err)
+	}
+	claims, err := VerifyIdentityToken(identityToken1.Token, testHost, Configuration.ServerId, keys)
+	if err != nil {
+		t.Errorf("VerifyIdentityToken(identityToken1.Token, testHost, ServerId, keys) returned error %s; want claims\n", err)
+	}
+	if claims.Nick != testNick || claims.ValidFor != testHost || claims.Issuer != Configuration.ServerId || claims.KeyId == "" {
+		t.Errorf("VerifyIdentityToken(...) returned claims %v; want claims for nick, validFor, issuer and key id\n", claims)
+	}
+	if claims.ExpiresAt != identityToken1.ValidUntil.Unix() {
+		t.Errorf("claims.ExpiresAt = %d; want %d\n", claims.ExpiresAt, identityToken1.ValidUntil.Unix())
+	}
+
+	// wrong client, manipulated claims and expired tokens are rejected
+	_, err = VerifyIdentityToken(identityToken1.Token, `192.168.1.1`, Configuration.ServerId, keys)
+	if err == nil {
+		t.Errorf("VerifyIdentityToken(identityToken1.Token, 192.168.1.1, ServerId, keys) returned NO error for other client; want error\n")
+	}
+	_, err = VerifyIdentityToken(identityToken1.Token, testHost, `otherServer`, keys)
+	if err == nil {
+		t.Errorf("VerifyIdentityToken(identityToken1.Token, testHost, otherServer, keys) returned NO error for other issuer; want error\n")
+	}
+	tokenPart := strings.Split(identityToken1.Token, ".")
+	manipulatedClaims, _ := encodeTokenPart(IdentityTokenClaims{Nick: `ADM1N`, ValidFor: testHost, ExpiresAt: claims.ExpiresAt})
+	_, err = VerifyIdentityToken(tokenPart[0]+"."+manipulatedClaims+"."+tokenPart[2], testHost, Configuration.ServerId, keys)
+	if err == nil {
+		t.Errorf("VerifyIdentityToken(...) returned NO error for manipulated claims; want error\n")
+	}
+	// a restricted token is rejected offline too
+	restrictedEntity, _ := CreateEntity(`N1CK0002`, nil)
+	restrictedToken, err := CheckIdentity(restrictedEntity.Nick, restrictedEntity.Password, testHost)
+	if err != nil || !restrictedToken.MustChangePassword {
+		t.Errorf("CheckIdentity(...) returned %v, %v for entity created by administrator; want restricted identity token\n", restrictedToken, err)
+	}
+	claims, err = VerifyIdentityToken(restrictedToken.Token, testHost, Configuration.ServerId, keys)
+	if !errors.Is(err, ErrIdentityTokenRestricted) || !claims.Restricted || claims.Nick != restrictedEntity.Nick {
+		t.Errorf("VerifyIdentityToken(restrictedToken.Token, ...) returned %v, %v; want restricted claims with ErrIdentityTokenRestricted\n", claims, err)
+	}
+	expiredToken, _ := signIdentityToken(testNick, testHost, time.Now().Add(-time.Second), false)
+	_, err = VerifyIdentityToken(expiredToken, testHost, Configuration.ServerId, PublicSigningKeys())
+	if err == nil {
+		t.Errorf("VerifyIdentityToken(expiredToken, ...) returned NO error; want error\n")
+	}
+
+	// rotate key with overlap: tokens of the previous key stay valid
+	err = RotateSigningKey(time.Hour)
+	if err != nil {
+		t.Errorf("RotateSigningKey(time.Hour) returned error %s; want no error\n", err)
+	}
+	identityToken2, _ := CheckIdentity(testNick, testPassword, testHost)
+	keys = PublicSigningKeys()
+	if len(keys) != 2 {
+		t.Errorf("PublicSigningKeys() returned %d keys after rotation; want 2\n", len(keys))
+	}
+	claims1, err1 := VerifyIdentityToken(identityToken1.Token, testHost, Configuration.ServerId, keys)
+	claims2, err2 := VerifyIdentityToken(identityToken2.Token, testHost, Configuration.ServerId, keys)
+	if err1 != nil || err2 != nil {
+		t.Errorf("VerifyIdentityToken(...) returned errors %v and %v during overlap; want no errors\n", err1, err2)
+	}
+	if claims1.KeyId == claims2.KeyId {
+		t.Errorf("tokens before and after rotation have the same key id %s; want different key ids\n", claims1.KeyId)
+	}
+
+	// rotate key without overlap: tokens of previous keys can't be verified anymore
+	RotateSigningKey(0)
+	keys = PublicSigningKeys()
+	if len(keys) != 1 {
+		t.Errorf("PublicSigningKeys() returned %d keys after rotation without overlap; want 1\n", len(keys))
+	}
+	_, err = VerifyIdentityToken(identityToken2.Token, testHost, Configuration.ServerId, keys)
+	if err == nil {
+		t.Errorf("VerifyIdentityToken(identityToken2.Token, ...) returned NO error after end of overlap; want error\n")
+	}
+}
+
+func TestSigningKeyStore(t *testing.T) {
+	const testNick = `N1CK0001`
+	config := DefaultConfiguration()
+	config.ServerId = `server1`
+	config.SignedIdentityTokens = true
+
+	// initialize embiam with signing keys in the filesystem
+	db := new(DbFile)
+	Initialize(db)
+	defer func() { db.Close() }()
+	db.DeleteContentsFromDirectory(db.SigningKeyFilePath)
+	err := InitializeWithConfiguration(db, config)
+	if err != nil {
+		t.Fatalf("InitializeWithConfiguration(...) returned error %s; want no error\n", err)
+	}
+	e := Entity{Nick: testNick, PasswordHash: testHash(t, testPassword), Active: true}
+	Db.SaveEntity(&e)
+	identityToken1, _ := CheckIdentity(testNick, testPassword, testHost)
+	RotateSigningKey(time.Hour)
+	identityToken2, _ := CheckIdentity(testNick, testPassword, testHost)
+	jwks, _ := ExportPublicSigningKeys()
+
+	// restart: the published keys verify the tokens of both keys and the current key is kept
+	db.Close()
+	db = new(DbFile)
+	err = InitializeWithConfiguration(db, config)
+	if err != nil {
+		t.Fatalf("InitializeWithConfiguration(...) returned error %s after restart; want no error\n", err)
+	}
+	keys, _ := ParsePublicSigningKeys(jwks)
+	for _, token := range []string{identityToken1.Token, identityToken2.Token} {
+		_, err = VerifyIdentityToken(token, testHost, config.ServerId, keys)
+		if err != nil {
+			t.Errorf("VerifyIdentityToken(...) with published keys returned error %s after restart; want claims\n", err)
+		}
+	}
+	identityToken3, _ := CheckIdentity(testNick, testPassword, testHost)
+	claims2, _ := VerifyIdentityToken(identityToken2.Token, testHost, config.ServerId, keys)
+	claims3, err := VerifyIdentityToken(identityToken3.Token, testHost, config.ServerId, keys)
+	if err != nil || claims3.KeyId != claims2.KeyId {
+		t.Errorf("VerifyIdentityToken(...) returned key id %s, %v for token after restart; want current key %s\n", claims3.KeyId, err, claims2.KeyId)
+	}
+}
@@ -2,7 +2,9 @@ package embiam
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -25,6 +27,15 @@ func signIn(t *testing.T, nick, password string) {
 	testNickIdentityToken[nick] = identityToken
 }
 
+// testHash returns the hash of password for test fixtures
+func testHash(t *testing.T, password string) string {
+	hash, err := HashPassword(password)
+	if err != nil {
+		t.Fatalf("HashPassword(password) returned error %s; want hash\n", err)
+	}
+	return hash
+}
+
 func TestGetIdentityTokenMock(t *testing.T) {
 	const (
 		nickCount = 5
@@ -38,8 +49,8 @@ func TestGetIdentityTokenMock(t *testing.T) {
 		nick := fmt.Sprintf(nickPattern, i)
 		e := Entity{
 			Nick:                 nick,
-			PasswordHash:         Hash(testPassword),
-			SecretHash:           Hash(`SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
+			PasswordHash:         testHash(t, testPassword),
+			SecretHash:           testHash(t, `SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
 			Active:               true,
 			WrongPasswordCounter: 0,
 			LastSignInAttempt:    time.Time{},
@@ -101,6 +112,7 @@ func TestCreateEntityWithFileDb(t *testing.T) {
 	// Initiallize (using filesystem as database)
 	db := new(DbFile)
 	Initialize(db)
+	defer db.Close()
 
 	// clean up db
 	db.DeleteContentsFromDirectory(db.EntityFilePath)
@@ -113,8 +125,8 @@ func TestCreateEntityWithFileDb(t *testing.T) {
 		nick := fmt.Sprintf(nickPattern, i)
 		e := Entity{
 			Nick:                 nick,
-			PasswordHash:         Hash(testPassword),
-			SecretHash:           Hash(`SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
+			PasswordHash:         testHash(t, testPassword),
+			SecretHash:           testHash(t, `SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
 			Active:               true,
 			WrongPasswordCounter: 0,
 			LastSignInAttempt:    time.Time{},
@@ -268,9 +280,9 @@ func TestCreateEntityWithFileDb(t *testing.T) {
 
 	/*
 		LOCK ENTITY
-		After serveral wrong sign in attempts the entity is locked.
+		After serveral wrong sign in attempts the entity is locked temporarily.
 		The number of attempts can be configured, check embiam.Configuration.MaxSignInAttempts
-		The entity is locked by setting Entity.Active to false.
+		The lock ends after Configuration.LockoutSeconds, Entity.Active isn't changed.
 	*/
 	for i := 0; i <= Configuration.MaxSignInAttempts; i++ {
 		_, err = CheckIdentity(newEntity.Nick, `Wr0ngPassWord`, testHost)
@@ -278,16 +290,39 @@ func TestCreateEntityWithFileDb(t *testing.T) {
 			t.Errorf("CheckIdentity(entity.Nick, `Wr0ngPassWord`, TEST_HOST) returned NO error; want error")
 		}
 	}
+	lockedError := &LockedError{}
+	if !errors.As(err, &lockedError) || !errors.Is(err, ErrEntityLocked) {
+		t.Errorf("CheckIdentity(entity.Nick, `Wr0ngPassWord`, TEST_HOST) returned error %v; want LockedError", err)
+	}
 	e, err = Db.ReadEntityByNick(newEntity.Nick)
 	if err != nil {
 		t.Errorf("Db.ReadEntityByNick(entity.Nick) for %s returned error %s; want entity without error", newEntity.Nick, err)
 	}
-	if e.Active {
-		t.Errorf("e.Active = true; want false")
+	if !e.Active {
+		t.Errorf("e.Active = false; want true")
 	}
 	if e.WrongPasswordCounter != Configuration.MaxSignInAttempts+1 {
 		t.Errorf("e.WrongPasswordCounter = %d; want %d", e.WrongPasswordCounter, Configuration.MaxSignInAttempts+1)
 	}
+	if !lockedError.Until.Equal(e.LockedUntil()) || e.LockedUntil().Sub(e.LastSignInAttempt) != time.Second*time.Duration(Configuration.LockoutSeconds) {
+		t.Errorf("entity is locked until %s; want %d seconds after last sign in attempt %s", lockedError.Until, Configuration.LockoutSeconds, e.LastSignInAttempt)
+	}
+	// the correct password is rejected during the lock
+	_, err = CheckIdentity(newEntity.Nick, newEntity.Password, testHost)
+	if !errors.Is(err, ErrEntityLocked) {
+		t.Errorf("CheckIdentity(entity.Nick, entity.Password, TEST_HOST) for locked entity returned error %v; want ErrEntityLocked", err)
+	}
+	// after the lock the entity can sign in again and the counter is cleared
+	e.LastSignInAttempt = e.LastSignInAttempt.Add(-time.Second * time.Duration(Configuration.LockoutSeconds))
+	Db.SaveEntity(e)
+	_, err = CheckIdentity(newEntity.Nick, newEntity.Password, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(entity.Nick, entity.Password, TEST_HOST) after lock returned error %s; want identity token", err)
+	}
+	e, _ = Db.ReadEntityByNick(newEntity.Nick)
+	if e.WrongPasswordCounter != 0 {
+		t.Errorf("e.WrongPasswordCounter = %d after successful sign in; want 0", e.WrongPasswordCounter)
+	}
 
 	/*
 		DELETE ENTITY
@@ -298,3 +333,228 @@ func TestCreateEntityWithFileDb(t *testing.T) {
 		t.Errorf("Db.DeleteEntity(newEntity.Nick) for %s returned error %s; want delete without error", newEntity.Nick, err)
 	}
 }
+
+func TestLockedUntil(t *testing.T) {
+	Initialize(new(DbTransient))
+	Configuration.MaxSignInAttempts = 2
+	Configuration.LockoutSeconds = 60
+	Configuration.LockoutMaxSeconds = 300
+
+	lastSignInAttempt := time.Now().UTC()
+	tests := []struct {
+		counter int
+		seconds int // 0 = not locked
+	}{
+		{0, 0}, {2, 0}, {3, 60}, {4, 120}, {5, 240}, {6, 300}, {1000, 300},
+	}
+	for _, test := range tests {
+		e := Entity{WrongPasswordCounter: test.counter, LastSignInAttempt: lastSignInAttempt}
+		lockedUntil := e.LockedUntil()
+		if test.seconds == 0 && !lockedUntil.IsZero() || test.seconds > 0 && lockedUntil.Sub(lastSignInAttempt) != time.Second*time.Duration(test.seconds) {
+			t.Errorf("e.LockedUntil() with counter %d returned %s; want %d seconds after last sign in attempt\n", test.counter, lockedUntil, test.seconds)
+		}
+	}
+
+	// no lock without lockout seconds
+	Configuration.LockoutSeconds = 0
+	e := Entity{WrongPasswordCounter: 10, LastSignInAttempt: lastSignInAttempt}
+	if !e.LockedUntil().IsZero() {
+		t.Errorf("e.LockedUntil() returned %s without lockout seconds; want zero time\n", e.LockedUntil())
+	}
+}
+
+func TestResetPasswordAndUnlock(t *testing.T) {
+	const (
+		testNick   = `N1CK0001`
+		testSecret = `SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`
+	)
+	// initialize embiam
+	Initialize(new(DbTransient))
+
+	// generate test entity
+	e := Entity{
+		Nick:            testNick,
+		PasswordHash:    testHash(t, testPassword),
+		SecretHash:      testHash(t, testSecret),
+		Active:          true,
+		CreateTimeStamp: time.Now().UTC(),
+	}
+	err := Db.SaveEntity(&e)
+	if err != nil {
+		t.Errorf("Db.SaveEntity(&e) returned error %s; want save entity without error\n", err)
+	}
+
+	/*
+		LOCK ENTITY
+		with multiple wrong passwords
+	*/
+	for i := 0; i <= Configuration.MaxSignInAttempts; i++ {
+		CheckIdentity(testNick, `Wr0ngPassWord`, testHost)
+	}
+	_, err = CheckIdentity(testNick, testPassword, testHost)
+	if err == nil {
+		t.Errorf("CheckIdentity(testNick, testPassword, testHost) for locked entity returned NO error; want error\n")
+	}
+
+	/*
+		UNLOCK ENTITY
+		with secret, the password is kept
+	*/
+	err = UnlockEntity(testNick, `Wr0ngSeCrEt`, testHost)
+	if err == nil {
+		t.Errorf("UnlockEntity(testNick, `Wr0ngSeCrEt`, testHost) returned NO error; want error\n")
+	}
+	// an unknown nick returns the same error as a wrong secret
+	unknownErr := UnlockEntity(`N1CK9999`, testSecret, testHost)
+	if unknownErr != err || !errors.Is(unknownErr, ErrInvalidCredentials) {
+		t.Errorf("UnlockEntity(N1CK9999, testSecret, testHost) returned %v; want %v like for a wrong secret\n", unknownErr, err)
+	}
+	err = UnlockEntity(testNick, testSecret, testHost)
+	if err != nil {
+		t.Errorf("UnlockEntity(testNick, testSecret, testHost) returned error %s; want no error\n", err)
+	}
+	unlockedEntity, err := Db.ReadEntityByNick(testNick)
+	if err != nil {
+		t.Errorf("Db.ReadEntityByNick(testNick) returned error %s; want entity without error\n", err)
+	}
+	if !unlockedEntity.Active || unlockedEntity.WrongPasswordCounter != 0 {
+		t.Errorf("entity is active %t with counter %d after unlock; want active entity with counter 0\n", unlockedEntity.Active, unlockedEntity.WrongPasswordCounter)
+	}
+	identityToken, err := CheckIdentity(testNick, testPassword, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(testNick, testPassword, testHost) after unlock returned error %s; want identity token\n", err)
+	}
+
+	/*
+		RESET PASSWORD
+		with secret, a new password is generated
+	*/
+	_, err = ResetPassword(testNick, `Wr0ngSeCrEt`, testHost)
+	if err == nil {
+		t.Errorf("ResetPassword(testNick, `Wr0ngSeCrEt`, testHost) returned NO error; want error\n")
+	}
+	newPassword, err := ResetPassword(testNick, testSecret, testHost)
+	if err != nil {
+		t.Errorf("ResetPassword(testNick, testSecret, testHost) returned error %s; want new password\n", err)
+	}
+	if IsIdentityTokenValid(identityToken.Token, testHost) {
+		t.Errorf("IsIdentityTokenValid(identityToken.Token, testHost) returned true after ResetPassword; want revoked identity token\n")
+	}
+	_, err = CheckIdentity(testNick, testPassword, testHost)
+	if err == nil {
+		t.Errorf("CheckIdentity(testNick, testPassword, testHost) with old password returned NO error; want error\n")
+	}
+	_, err = CheckIdentity(testNick, newPassword, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(testNick, newPassword, testHost) returned error %s; want identity token\n", err)
+	}
+
+	/*
+		ENTITY DEACTIVATED BY ADMINISTRATOR
+		can't be activated with the secret
+	*/
+	deactivatedEntity, _ := Db.ReadEntityByNick(testNick)
+	deactivatedEntity.Active = false
+	deactivatedEntity.WrongPasswordCounter = 0
+	Db.SaveEntity(deactivatedEntity)
+	err = UnlockEntity(testNick, testSecret, testHost)
+	if err == nil {
+		t.Errorf("UnlockEntity(testNick, testSecret, testHost) for deactivated entity returned NO error; want error\n")
+	}
+
+	/*
+		LOCK RESETS AND UNLOCKS
+		with multiple wrong secrets, the password still works
+	*/
+	deactivatedEntity.Active = true
+	Db.SaveEntity(deactivatedEntity)
+	signInRateLimiter.initialize(Configuration.SignInRateLimitPerMinute, Configuration.SignInRateLimitBurst, Configuration.SignInRateLimitMaxKeys) // full buckets
+	for i := 0; i < Configuration.MaxSignInAttempts; i++ {
+		UnlockEntity(testNick, `Wr0ngSeCrEt`, testHost)
+	}
+	err = UnlockEntity(testNick, `Wr0ngSeCrEt`, testHost)
+	if !errors.Is(err, ErrEntityLocked) {
+		t.Errorf("UnlockEntity(testNick, `Wr0ngSeCrEt`, testHost) returned %v after %d wrong secrets; want ErrEntityLocked\n", err, Configuration.MaxSignInAttempts+1)
+	}
+	_, err = ResetPassword(testNick, testSecret, testHost)
+	if !errors.Is(err, ErrEntityLocked) {
+		t.Errorf("ResetPassword(testNick, testSecret, testHost) returned %v for locked resets; want ErrEntityLocked\n", err)
+	}
+	_, err = CheckIdentity(testNick, newPassword, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(testNick, newPassword, testHost) returned error %s for locked resets; want identity token\n", err)
+	}
+
+	/*
+		RATE LIMIT
+		like for sign ins
+	*/
+	signInRateLimiter.initialize(1, 1, 100)
+	UnlockEntity(`N1CK0002`, testSecret, testHost)
+	err = UnlockEntity(`N1CK0003`, testSecret, testHost)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("UnlockEntity(N1CK0003, testSecret, testHost) returned %v for empty bucket; want ErrRateLimited\n", err)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	Initialize(new(DbTransient))
+	ne, _ := CreateEntity(`N1CK0001`, nil)
+
+	codes, err := GenerateRecoveryCodes(ne.Nick)
+	if err != nil || len(codes) != 10 {
+		t.Fatalf("GenerateRecoveryCodes(nick) returned %d codes, error %v; want 10 codes\n", len(codes), err)
+	}
+	publicEntity, _ := Db.ReadPublicEntityByNick(ne.Nick)
+	if publicEntity.RecoveryCodes != 10 {
+		t.Errorf("publicEntity.RecoveryCodes = %d; want 10\n", publicEntity.RecoveryCodes)
+	}
+
+	/*
+		UNLOCK ENTITY
+		with recovery code, the code can only be used once
+	*/
+	for i := 0; i <= Configuration.MaxSignInAttempts; i++ {
+		CheckIdentity(ne.Nick, `Wr0ngPassWord`, testHost)
+	}
+	err = UnlockEntityWithRecoveryCode(ne.Nick, `WR0NG-C0DE1`, testHost)
+	if !errors.Is(err, ErrInvalidRecoveryCode) {
+		t.Errorf("UnlockEntityWithRecoveryCode(nick, WR0NG-C0DE1, testHost) returned %v; want ErrInvalidRecoveryCode\n", err)
+	}
+	err = UnlockEntityWithRecoveryCode(ne.Nick, strings.ToLower(codes[3]), testHost)
+	if err != nil {
+		t.Errorf("UnlockEntityWithRecoveryCode(nick, code, testHost) returned error %s; want no error\n", err)
+	}
+	_, err = CheckIdentity(ne.Nick, ne.Password, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(nick, password, testHost) after unlock returned error %s; want identity token\n", err)
+	}
+	err = UnlockEntityWithRecoveryCode(ne.Nick, codes[3], testHost)
+	if !errors.Is(err, ErrInvalidRecoveryCode) {
+		t.Errorf("UnlockEntityWithRecoveryCode(nick, code, testHost) returned %v for used code; want ErrInvalidRecoveryCode\n", err)
+	}
+
+	/*
+		RESET PASSWORD
+		with recovery code
+	*/
+	newPassword, err := ResetPasswordWithRecoveryCode(ne.Nick, codes[7], testHost)
+	if err != nil {
+		t.Errorf("ResetPasswordWithRecoveryCode(nick, code, testHost) returned error %s; want new password\n", err)
+	}
+	_, err = CheckIdentity(ne.Nick, newPassword, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(nick, newPassword, testHost) returned error %s; want identity token\n", err)
+	}
+	publicEntity, _ = Db.ReadPublicEntityByNick(ne.Nick)
+	if publicEntity.RecoveryCodes != 8 {
+		t.Errorf("publicEntity.RecoveryCodes = %d after using 2 codes; want 8\n", publicEntity.RecoveryCodes)
+	}
+
+	// new codes replace the old ones
+	GenerateRecoveryCodes(ne.Nick)
+	_, err = ResetPasswordWithRecoveryCode(ne.Nick, codes[0], testHost)
+	if !errors.Is(err, ErrInvalidRecoveryCode) {
+		t.Errorf("ResetPasswordWithRecoveryCode(nick, code, testHost) returned %v for replaced code; want ErrInvalidRecoveryCode\n", err)
+	}
+}
@@ -0,0 +1,271 @@
+package embiam
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/********************************************************************
+	TOTP
+	Entities can use time-based one-time passwords (RFC 6238) as
+	second factor, e.g. with an authenticator app. EnrollTOTP
+	generates a seed and returns an otpauth:// URI (usually shown
+	as QR code). The enrollment is completed with ConfirmTOTP and
+	a code from the app. After that, the entity signs in with
+	CheckIdentityWithOTP, CheckIdentity returns ErrOTPRequired.
+
+		uri, err := embiam.EnrollTOTP(nick)
+		...
+		err = embiam.ConfirmTOTP(nick, code, validFor)
+		...
+		identityToken, err := embiam.CheckIdentityWithOTP(nick, password, code, validFor)
+
+	The codes have 6 digits and change every 30 seconds. Codes of
+	Configuration.TOTPDriftSteps steps before and after the current
+	time are accepted for clocks out of sync. A code (and codes of
+	earlier steps) can only be used once. A wrong code counts as
+	wrong password (see LockedUntil), also in ConfirmTOTP.
+
+	The seed is encrypted with AES-GCM and the key in
+	Configuration.TOTPEncryptionKey before it's saved. The key
+	isn't generated on start (the seeds couldn't be decrypted
+	after a restart), without a key EnrollTOTP fails with
+	ErrInvalidConfiguration. LoadConfiguration generates and
+	saves it.
+********************************************************************/
+
+const (
+	totpDigits     = 6
+	totpPeriod     = 30 // seconds
+	totpSeedLength = 20 // bytes, like the key of HMAC-SHA1
+)
+
+// totpMutex serializes the use of codes, so that a code can't be used twice by concurrent sign ins
+var totpMutex sync.Mutex
+
+var totpBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EnrollTOTP generates a new TOTP seed for the entity of nick and returns the otpauth:// URI for the authenticator app
+// the seed is used after the confirmation with ConfirmTOTP
+func EnrollTOTP(nick string) (string, error) {
+	entity, err := Db.ReadEntityByNick(nick)
+	if err != nil {
+		return "", err
+	}
+	if entity.TOTPEnabled {
+		return "", ErrTOTPEnabled
+	}
+	seed := randomBytes(totpSeedLength)
+	entity.TOTPSeed, err = encryptTOTPSeed(nick, seed)
+	if err != nil {
+		return "", err
+	}
+	entity.TOTPLastCounter = 0
+	entity.UpdateTimeStamp = time.Now().UTC()
+	err = Db.SaveEntity(entity)
+	if err != nil {
+		return "", err
+	}
+	return totpURI(Configuration.TOTPIssuer, nick, seed), nil
+}
+
+// ConfirmTOTP completes the enrollment of EnrollTOTP with a code of the authenticator app (on client validFor)
+// a wrong code counts as wrong password, like in CheckIdentityWithOTP
+func ConfirmTOTP(nick, code, validFor string) error {
+	err := confirmTOTP(nick, code, validFor)
+	audit(AuditTOTPEnabled, nick, Actor{Nick: nick, ValidFor: validFor}, err, nil)
+	return err
+}
+
+// confirmTOTP enables TOTP for the entity of nick (without audit event)
+func confirmTOTP(nick, code, validFor string) error {
+	// check rate limit and lock like a sign in
+	err := checkSignInRateLimit(nick, validFor)
+	if err != nil {
+		return err
+	}
+	entity, err := Db.ReadEntityByNick(nick)
+	if err != nil {
+		return err
+	}
+	lockedUntil := entity.LockedUntil()
+	if time.Now().Before(lockedUntil) {
+		return &LockedError{Until: lockedUntil}
+	}
+	if entity.TOTPSeed == "" {
+		return ErrTOTPNotEnrolled
+	}
+	if entity.TOTPEnabled {
+		return ErrTOTPEnabled
+	}
+	err = useTOTPCode(entity, code)
+	if errors.Is(err, ErrInvalidOTP) {
+		return failSignIn(entity, validFor, err)
+	}
+	if err != nil {
+		return err
+	}
+	entity.TOTPEnabled = true
+	entity.UpdateTimeStamp = time.Now().UTC()
+	return Db.SaveEntity(entity)
+}
+
+// DisableTOTP removes the TOTP seed of an entity, e.g. by an administrator after the loss of the authenticator
+func DisableTOTP(nick string) error {
+	return DisableTOTPBy(Actor{}, nick)
+}
+
+// DisableTOTPBy removes the TOTP seed like DisableTOTP, actor is recorded in the audit event
+func DisableTOTPBy(actor Actor, nick string) error {
+	entity, err := Db.ReadEntityByNick(nick)
+	if err == nil {
+		entity.TOTPSeed = ""
+		entity.TOTPEnabled = false
+		entity.TOTPLastCounter = 0
+		entity.UpdateTimeStamp = time.Now().UTC()
+		err = Db.SaveEntity(entity)
+	}
+	audit(AuditTOTPDisabled, nick, actor, err, nil)
+	return err
+}
+
+// CheckIdentityWithOTP checks nick, password and the code of the authenticator app and provides an identity token (for validFor)
+// for entities without TOTP, the code is ignored
+func CheckIdentityWithOTP(nick, password, code, validFor string) (identityTokenStruct, error) {
+	identityToken, err := checkIdentity(nick, password, code, validFor)
+	audit(AuditSignIn, nick, Actor{ValidFor: validFor}, err, map[string]string{"otp": "true"})
+	return identityToken, err
+}
+
+// useTOTPCode checks code for the seed of entity and saves the time step of the code, so that it can't be used again
+// the entity is read again (under lock) to get the time step of the last code
+func useTOTPCode(entity *Entity, code string) error {
+	totpMutex.Lock()
+	defer totpMutex.Unlock()
+	current, err := Db.ReadEntityByNick(entity.Nick)
+	if err != nil {
+		return err
+	}
+	seed, err := decryptTOTPSeed(current.Nick, current.TOTPSeed)
+	if err != nil {
+		return err
+	}
+	counter, ok := verifyTOTPCode(seed, code, current.TOTPLastCounter, time.Now())
+	if !ok {
+		return ErrInvalidOTP
+	}
+	current.TOTPLastCounter = counter
+	err = Db.SaveEntity(current)
+	if err != nil {
+		return err
+	}
+	entity.TOTPLastCounter = counter
+	return nil
+}
+
+// verifyTOTPCode checks code for the time steps around now (see Configuration.TOTPDriftSteps)
+// only steps after lastCounter are accepted; the step of the code is returned
+func verifyTOTPCode(seed []byte, code string, lastCounter int64, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	drift := int64(Configuration.TOTPDriftSteps)
+	for counter := current - drift; counter <= current+drift; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(seed, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode calculates the code of seed for a time step (RFC 4226 and RFC 6238 with HMAC-SHA1)
+func totpCode(seed []byte, counter int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+	mac := hmac.New(sha1.New, seed)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpURI returns the otpauth:// URI for an authenticator app
+func totpURI(issuer, nick string, seed []byte) string {
+	query := url.Values{}
+	query.Set("secret", totpBase32.EncodeToString(seed))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + nick,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
+
+// encryptTOTPSeed encrypts seed with AES-GCM and Configuration.TOTPEncryptionKey, the nick is authenticated too
+// the result is the base64-encoded nonce and ciphertext
+func encryptTOTPSeed(nick string, seed []byte) (string, error) {
+	aead, err := totpCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := randomBytes(aead.NonceSize())
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, seed, []byte(nick))), nil
+}
+
+// decryptTOTPSeed decrypts a seed encrypted by encryptTOTPSeed
+func decryptTOTPSeed(nick, encryptedSeed string) ([]byte, error) {
+	if encryptedSeed == "" {
+		return nil, ErrTOTPNotEnrolled
+	}
+	aead, err := totpCipher()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encryptedSeed)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid TOTP seed of %s", nick)
+	}
+	seed, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(nick))
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt TOTP seed of %s: %s", nick, err)
+	}
+	return seed, nil
+}
+
+// totpCipher returns AES-GCM with the key of Configuration.TOTPEncryptionKey
+func totpCipher() (cipher.AEAD, error) {
+	if Configuration.TOTPEncryptionKey == "" {
+		return nil, fmt.Errorf("%w: totpEncryptionKey is missing", ErrInvalidConfiguration)
+	}
+	key, err := base64.StdEncoding.DecodeString(Configuration.TOTPEncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: totpEncryptionKey is not base64-encoded", ErrInvalidConfiguration)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: totpEncryptionKey: %s", ErrInvalidConfiguration, err)
+	}
+	return cipher.NewGCM(block)
+}
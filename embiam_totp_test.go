@@ -0,0 +1,176 @@
+package embiam
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors of RFC 6238 (SHA1), last 6 digits
+	seed := []byte("12345678901234567890")
+	tests := []struct {
+		unixTime int64
+		code     string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		code := totpCode(seed, test.unixTime/totpPeriod)
+		if code != test.code {
+			t.Errorf("totpCode(seed, %d) returned %s; want %s\n", test.unixTime/totpPeriod, code, test.code)
+		}
+	}
+
+	// drift and replay
+	Configuration.TOTPDriftSteps = 1
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	for _, counter := range []int64{current - 1, current, current + 1} {
+		if _, ok := verifyTOTPCode(seed, totpCode(seed, counter), 0, now); !ok {
+			t.Errorf("verifyTOTPCode(...) returned false for step %d; want true within drift window\n", counter-current)
+		}
+	}
+	if _, ok := verifyTOTPCode(seed, totpCode(seed, current+2), 0, now); ok {
+		t.Errorf("verifyTOTPCode(...) returned true for step 2; want false outside drift window\n")
+	}
+	if _, ok := verifyTOTPCode(seed, totpCode(seed, current), current, now); ok {
+		t.Errorf("verifyTOTPCode(...) returned true for used step; want false\n")
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	Initialize(new(DbTransient))
+	ne, _ := CreateEntity(`N1CK0001`, nil)
+	memorySink := new(MemoryAuditSink)
+	SetAuditSinks(memorySink)
+	defer SetAuditSinks()
+
+	// without encryption key
+	if _, err := EnrollTOTP(ne.Nick); !errors.Is(err, ErrInvalidConfiguration) {
+		t.Errorf("EnrollTOTP(nick) returned %v without TOTP encryption key; want ErrInvalidConfiguration\n", err)
+	}
+	Configuration.TOTPEncryptionKey = generateEncryptionKey()
+
+	// enroll
+	uri, err := EnrollTOTP(ne.Nick)
+	if err != nil {
+		t.Fatalf("EnrollTOTP(nick) returned error %s; want URI\n", err)
+	}
+	parsedURI, err := url.Parse(uri)
+	if err != nil || parsedURI.Scheme != "otpauth" || parsedURI.Host != "totp" || parsedURI.Path != "/embiam:N1CK0001" {
+		t.Errorf("EnrollTOTP(nick) returned URI %s; want otpauth://totp/embiam:N1CK0001?...\n", uri)
+	}
+	seed, err := totpBase32.DecodeString(parsedURI.Query().Get("secret"))
+	if err != nil || len(seed) != totpSeedLength {
+		t.Fatalf("EnrollTOTP(nick) returned URI with secret %s; want base32-encoded seed\n", parsedURI.Query().Get("secret"))
+	}
+	entity, _ := Db.ReadEntityByNick(ne.Nick)
+	if entity.TOTPEnabled || entity.TOTPSeed == "" || entity.TOTPSeed == base64.StdEncoding.EncodeToString(seed) {
+		t.Errorf("entity has TOTP seed %s (enabled %t) after enrollment; want encrypted seed, not enabled\n", entity.TOTPSeed, entity.TOTPEnabled)
+	}
+	// the seed is bound to the nick
+	if _, err = decryptTOTPSeed(`N1CK0002`, entity.TOTPSeed); err == nil {
+		t.Errorf("decryptTOTPSeed(N1CK0002, ...) returned NO error for seed of N1CK0001; want error\n")
+	}
+
+	// sign in without TOTP until confirmation
+	_, err = CheckIdentity(ne.Nick, ne.Password, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(...) returned error %s before confirmation; want identity token\n", err)
+	}
+
+	// confirm
+	current := time.Now().Unix() / totpPeriod
+	err = ConfirmTOTP(ne.Nick, `abcdef`, testHost)
+	if !errors.Is(err, ErrInvalidOTP) {
+		t.Errorf("ConfirmTOTP(nick, abcdef, testHost) returned %v; want ErrInvalidOTP\n", err)
+	}
+	entity, _ = Db.ReadEntityByNick(ne.Nick)
+	if entity.WrongPasswordCounter != 1 {
+		t.Errorf("entity.WrongPasswordCounter is %d after wrong code in ConfirmTOTP; want 1\n", entity.WrongPasswordCounter)
+	}
+	err = ConfirmTOTP(ne.Nick, totpCode(seed, current-1), testHost)
+	if err != nil {
+		t.Errorf("ConfirmTOTP(nick, code, testHost) returned error %s; want no error\n", err)
+	}
+	if _, err = EnrollTOTP(ne.Nick); !errors.Is(err, ErrTOTPEnabled) {
+		t.Errorf("EnrollTOTP(nick) returned %v for enabled TOTP; want ErrTOTPEnabled\n", err)
+	}
+
+	// sign in requires the code
+	_, err = CheckIdentity(ne.Nick, ne.Password, testHost)
+	if !errors.Is(err, ErrOTPRequired) {
+		t.Errorf("CheckIdentity(...) returned %v for entity with TOTP; want ErrOTPRequired\n", err)
+	}
+	_, err = CheckIdentityWithOTP(ne.Nick, ne.Password, totpCode(seed, current), testHost)
+	if err != nil {
+		t.Errorf("CheckIdentityWithOTP(...) returned error %s; want identity token\n", err)
+	}
+	// used code and earlier codes are rejected
+	for _, counter := range []int64{current - 1, current} {
+		_, err = CheckIdentityWithOTP(ne.Nick, ne.Password, totpCode(seed, counter), testHost)
+		if !errors.Is(err, ErrInvalidOTP) {
+			t.Errorf("CheckIdentityWithOTP(...) returned %v for used code; want ErrInvalidOTP\n", err)
+		}
+	}
+	entity, _ = Db.ReadEntityByNick(ne.Nick)
+	if entity.WrongPasswordCounter != 2 {
+		t.Errorf("entity.WrongPasswordCounter is %d after wrong codes; want 2\n", entity.WrongPasswordCounter)
+	}
+
+	// code in the authorization header
+	authValue := "embiam " + base64.StdEncoding.EncodeToString([]byte(ne.Nick+":"+ne.Password)) + " " + totpCode(seed, current+1)
+	_, nick, err := CheckAuthIdentity(authValue, testHost)
+	if err != nil || nick != ne.Nick {
+		t.Errorf("CheckAuthIdentity(authValue, testHost) returned %s, %v; want identity token for %s\n", nick, err, ne.Nick)
+	}
+
+	// password change requires the code too, used codes are rejected
+	newPassword := `Tr0ub4dor&3horse`
+	if err = ChangePassword(ne.Nick, ne.Password, newPassword, testHost); !errors.Is(err, ErrOTPRequired) {
+		t.Errorf("ChangePassword(...) returned %v for entity with TOTP; want ErrOTPRequired\n", err)
+	}
+	if err = ChangePasswordWithOTP(ne.Nick, ne.Password, totpCode(seed, current+1), newPassword, testHost); !errors.Is(err, ErrInvalidOTP) {
+		t.Errorf("ChangePasswordWithOTP(...) returned %v for used code; want ErrInvalidOTP\n", err)
+	}
+
+	// disable
+	admin := Actor{Nick: `ADM1N`, ValidFor: `192.0.2.9`}
+	DisableTOTPBy(admin, ne.Nick)
+	_, err = CheckIdentity(ne.Nick, ne.Password, testHost)
+	if err != nil {
+		t.Errorf("CheckIdentity(...) returned error %s after DisableTOTP; want identity token\n", err)
+	}
+	if err = ConfirmTOTP(ne.Nick, totpCode(seed, current), testHost); !errors.Is(err, ErrTOTPNotEnrolled) {
+		t.Errorf("ConfirmTOTP(...) returned %v after DisableTOTP; want ErrTOTPNotEnrolled\n", err)
+	}
+
+	// enabling and disabling are audited
+	want := []AuditEvent{
+		{Type: AuditTOTPEnabled, Outcome: AuditFailure, Nick: ne.Nick, Actor: ne.Nick, ValidFor: testHost},
+		{Type: AuditTOTPEnabled, Outcome: AuditSuccess, Nick: ne.Nick, Actor: ne.Nick, ValidFor: testHost},
+		{Type: AuditTOTPDisabled, Outcome: AuditSuccess, Nick: ne.Nick, Actor: admin.Nick, ValidFor: admin.ValidFor},
+		{Type: AuditTOTPEnabled, Outcome: AuditFailure, Nick: ne.Nick, Actor: ne.Nick, ValidFor: testHost},
+	}
+	events := []AuditEvent{}
+	for _, event := range memorySink.Events() {
+		if event.Type == AuditTOTPEnabled || event.Type == AuditTOTPDisabled {
+			events = append(events, event)
+		}
+	}
+	if len(events) != len(want) {
+		t.Fatalf("memorySink.Events() returned %d TOTP events; want %d\n", len(events), len(want))
+	}
+	for i, event := range events {
+		if event.Type != want[i].Type || event.Outcome != want[i].Outcome || event.Nick != want[i].Nick || event.Actor != want[i].Actor || event.ValidFor != want[i].ValidFor {
+			t.Errorf("TOTP event %d is %v; want %v\n", i, event, want[i])
+		}
+	}
+}
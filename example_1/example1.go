@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"log"
-	"time"
 
 	"github.com/janso/embiam"
 )
@@ -15,29 +14,22 @@ func main() {
 	// Generate test entities
 	for i := 1; i < 4; i++ {
 		nick := fmt.Sprintf("N1CK%04d", i)
-		// create entity
-		e := embiam.Entity{
-			Nick:                 nick,
-			PasswordHash:         embiam.Hash(`SeCrEtSeCrEt`),
-			SecretHash:           embiam.Hash(`SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
-			Active:               true,
-			WrongPasswordCounter: 0,
-			LastSignInAttempt:    time.Time{},
-			LastSignIn:           time.Now().UTC(),
-			CreateTimeStamp:      time.Time{},
-			UpdateTimeStamp:      time.Time{},
+		// create entity, the administrator gets a generated password, that must be changed
+		ne, err := embiam.CreateEntity(nick, nil)
+		if err != nil {
+			log.Fatal("error creating entity", err)
 		}
-		// save new entity
-		err := embiam.Db.SaveEntity(&e)
+		// the entity chooses its own password
+		err = embiam.ChangePassword(ne.Nick, ne.Password, `SeCrEt-SeCrEt-42`, `localhost`)
 		if err != nil {
-			log.Fatal("error saving entity", err)
+			log.Fatal("error changing password", err)
 		}
 	}
 
 	// Use nick and password to get an identity token (for the client's ip address)
 	// this step is done, after the user has entered his credentials
 	fmt.Printf("Sign in with correct nick and password\n")
-	identityToken, err := embiam.CheckIdentity(`N1CK0001`, `SeCrEtSeCrEt`, `localhost`)
+	identityToken, err := embiam.CheckIdentity(`N1CK0001`, `SeCrEt-SeCrEt-42`, `localhost`)
 	if err != nil {
 		log.Fatalln(err)
 	}
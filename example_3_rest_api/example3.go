@@ -5,14 +5,14 @@ The programm is a simple REST server and handles two request:
 
 Test with CURL
 1. Verify identity of nick and password and receive identity token (POST /api/embiam/getToken)
-	This example runs with a mock entity that has the nick NICK0001. It uses the password SeCrEtSeCrEt.
-	Nick and password are concatenated to NICK0001:SeCrEtSeCrEt Both terms are separated by a colon.
-	The result is base64-encoded, and leads to the credentials TklDSzAwMDE6U2VDckV0U2VDckV0.
+	This example runs with a mock entity that has the nick N1CK0001. It uses the password SeCrEt-SeCrEt-42.
+	Nick and password are concatenated to N1CK0001:SeCrEt-SeCrEt-42 Both terms are separated by a colon.
+	The result is base64-encoded, and leads to the credentials TjFDSzAwMDE6U2VDckV0LVNlQ3JFdC00Mg==.
 
 	make a HTTP GET request to http://localhost:8242/api/embiam/identityToken and
-	use the head field "Authorization:embiam TjFDSzAwMDE6U2VDckV0U2VDckV0"
+	use the head field "Authorization:embiam TjFDSzAwMDE6U2VDckV0LVNlQ3JFdC00Mg=="
 
-	$ curl -i -H "Authorization:embiam TjFDSzAwMDE6U2VDckV0U2VDckV0" http://localhost:8242/api/embiam/identityToken
+	$ curl -i -H "Authorization:embiam TjFDSzAwMDE6U2VDckV0LVNlQ3JFdC00Mg==" http://localhost:8242/api/embiam/identityToken
 
 	you receive
 	HTTP/1.1 200 OK
@@ -31,13 +31,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/janso/embiam"
+	"github.com/janso/embiam/httpauth"
 )
 
 // embiamidentityTokenGetHandler checks the identity for nick and password and provides an identity token
@@ -58,7 +60,7 @@ func embiamidentityTokenGetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// extract client host from r.RemoteAddr
-	validFor, _, err := net.SplitHostPort(r.RemoteAddr)
+	validFor, err := httpauth.RemoteAddr(r)
 	if err != nil {
 		http.Error(w, "", http.StatusBadRequest)
 		return
@@ -72,6 +74,13 @@ func embiamidentityTokenGetHandler(w http.ResponseWriter, r *http.Request) {
 	// like in simple authentication. e.g. 'embiam REhXUEhTVUw6ZFRjaHguNy15aC5CREVjNw=='
 	// the generated identity token will be connected to validFor to improve security
 	identityToken, nick, err := embiam.CheckAuthIdentity(authValue, validFor)
+	rateLimitError := &embiam.RateLimitError{}
+	if errors.As(err, &rateLimitError) {
+		// too many sign in attempts from this client or for this nick
+		w.Header().Set("Retry-After", strconv.Itoa(int(rateLimitError.RetryAfter.Seconds())))
+		http.Error(w, "", http.StatusTooManyRequests)
+		return
+	}
 	if err != nil {
 		http.Error(w, "", http.StatusForbidden)
 		return
@@ -86,24 +95,11 @@ func embiamidentityTokenGetHandler(w http.ResponseWriter, r *http.Request) {
 
 // gettimeHandler is the handler for an API that provides the current time
 // - but only if you are authorized and have a valid identity token
+// the identity token is checked by httpauth.RequireIdentity (see main)
 func gettimeHandler(w http.ResponseWriter, r *http.Request) {
 	// Log
-	fmt.Printf("Request received from %s\t on %s\t %s\n", r.RemoteAddr, r.URL.Path, r.Method)
-
-	// extract client host from r.RemoteAddr
-	clientHost, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		http.Error(w, "", http.StatusBadRequest)
-		return
-	}
-
-	// get identity token from header
-	authValue := r.Header.Get("Authorization")
-	if !embiam.IsAuthIdentityTokenValid(authValue, clientHost) {
-		http.Error(w, "", http.StatusForbidden)
-		return
-	}
-	fmt.Printf("\tAuthorization check successful. Identity token is valid.\n\n")
+	nick, _ := httpauth.NickFromContext(r.Context())
+	fmt.Printf("Request received from %s (%s)\t on %s\t %s\n", r.RemoteAddr, nick, r.URL.Path, r.Method)
 
 	// w.Header().Set("Access-Control-Allow-Origin", "*")
 	// w.Header().Set("Access-Control-Allow-Methods", "GET,HEAD,OPTIONS,POST,PUT")
@@ -124,27 +120,20 @@ func gettimeHandler(w http.ResponseWriter, r *http.Request) {
 func main() {
 	// Initiallize (with database in filesystem)
 	embiam.Initialize(new(embiam.DbTransient))
-	// create entity
-	e := embiam.Entity{
-		Nick:                 `N1CK0001`,
-		PasswordHash:         embiam.Hash(`SeCrEtSeCrEt`),
-		SecretHash:           embiam.Hash(`SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
-		Active:               true,
-		WrongPasswordCounter: 0,
-		LastSignInAttempt:    time.Time{},
-		LastSignIn:           time.Now().UTC(),
-		CreateTimeStamp:      time.Time{},
-		UpdateTimeStamp:      time.Time{},
+	// create entity, the administrator gets a generated password, that must be changed
+	ne, err := embiam.CreateEntity(`N1CK0001`, nil)
+	if err != nil {
+		log.Fatal("error creating entity", err)
 	}
-	// save new entity
-	err := embiam.Db.SaveEntity(&e)
+	// the entity chooses its own password
+	err = embiam.ChangePassword(ne.Nick, ne.Password, `SeCrEt-SeCrEt-42`, `localhost`)
 	if err != nil {
-		log.Fatal("error saving entity", err)
+		log.Fatal("error changing password", err)
 	}
 
 	// starting server
 	fmt.Printf("Starting Auth Server. Listening on port %s\n", embiam.Configuration.Port)
 	http.HandleFunc("/api/embiam/identityToken", embiamidentityTokenGetHandler)
-	http.HandleFunc("/api/gettime", gettimeHandler)
+	http.Handle("/api/gettime", httpauth.RequireIdentity(http.HandlerFunc(gettimeHandler)))
 	log.Fatal(http.ListenAndServe(":"+embiam.Configuration.Port, nil))
 }
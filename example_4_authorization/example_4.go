@@ -3,16 +3,12 @@ package main
 import (
 	"fmt"
 	"log"
-	"time"
 
 	"github.com/janso/embiam"
 )
 
 func main() {
-	const (
-		testPassword = `PaSsWoRdPaSsWoRd`
-		nickPattern  = "N1CK%04d"
-	)
+	const testPassword = `Wild-Plum-Tree-17`
 
 	db := new(embiam.DbFile)
 	embiam.Initialize(db)
@@ -43,22 +39,16 @@ func main() {
 		log.Printf("db.SaveRoles(&roles) returned error %s; want no error\n", err)
 	}
 
-	// generate example entity with role embiam.reader
-	entity1 := embiam.Entity{
-		Nick:                 fmt.Sprintf(nickPattern, 1),
-		PasswordHash:         embiam.Hash(testPassword),
-		SecretHash:           embiam.Hash(`SeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEtSeCrEt`),
-		Active:               true,
-		WrongPasswordCounter: 0,
-		LastSignInAttempt:    time.Time{},
-		LastSignIn:           time.Now().UTC(),
-		CreateTimeStamp:      time.Time{},
-		UpdateTimeStamp:      time.Time{},
-		Roles:                []embiam.RoleIdType{"embiam.reader"},
+	// generate example entity with role embiam.reader (with generated nick and password, that must be changed)
+	entity1, err := embiam.CreateEntity("", []embiam.RoleIdType{"embiam.reader"})
+	if err != nil {
+		log.Printf("CreateEntity(\"\", roles) returned error %s; want new entity\n", err)
+		return
 	}
-	err = db.SaveEntity(&entity1)
+	err = embiam.ChangePassword(entity1.Nick, entity1.Password, testPassword, "localhost")
 	if err != nil {
-		log.Printf("Db.SaveEntity(&entity1) returned error %s; want save entity without error\n", err)
+		log.Printf("ChangePassword(nick, password, testPassword, localhost) returned error %s; want no error\n", err)
+		return
 	}
 
 	// Sign in with correct credentials
@@ -2,4 +2,8 @@ module github.com/janso/embiam
 
 go 1.16
 
-require golang.org/x/crypto v0.0.0-20210616213533-5ff15b29337e
+require (
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20210616213533-5ff15b29337e
+	modernc.org/sqlite v1.17.3
+)
@@ -0,0 +1,260 @@
+/*
+Package httpauth provides net/http middleware for embiam.
+
+RequireIdentity checks the identity token in the header field
+"Authorization" (embiam base64-encoded-identity-token) and
+RequireAuthorization additionally checks the authorization of the
+nick for a ressource and an action.
+
+	http.Handle("/api/gettime", httpauth.RequireIdentity(http.HandlerFunc(gettimeHandler)))
+	http.Handle("/api/entity", httpauth.RequireAuthorization("embiam.entity", "read", entityHandler))
+
+The handler gets the authenticated nick from the request context
+with NickFromContext. Requests without valid identity token are
+answered with 401 Unauthorized, requests without authorization with
+403 Forbidden.
+
+Entities, that must change their password (embiam.Entity.MustChangePassword),
+get a restricted identity token. RequireIdentity rejects it with 403 Forbidden,
+it's only accepted by RequireAuthorization for the password change:
+
+	http.Handle("/api/password", httpauth.RequireAuthorization(embiam.RessourcePassword, embiam.ActionChangePassword, passwordHandler))
+
+The identity token is bound to the client (validFor). By default the
+host of r.RemoteAddr is used. Behind a reverse proxy use ForwardedFor
+with the addresses of the trusted proxies.
+*/
+package httpauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/janso/embiam"
+)
+
+type (
+	// ValidForExtractor determines the identification of the client (validFor) from the request, e.g. the IP address
+	ValidForExtractor func(r *http.Request) (string, error)
+
+	// Authenticator provides the middleware, ValidFor determines the client of a request
+	Authenticator struct {
+		ValidFor ValidForExtractor
+	}
+
+	// contextKeyType is the type of keys for values in the request context
+	contextKeyType int
+)
+
+const (
+	nickContextKey contextKeyType = iota
+	identityTokenContextKey
+	validForContextKey
+)
+
+// DefaultAuthenticator is used by RequireIdentity and RequireAuthorization
+var DefaultAuthenticator = &Authenticator{ValidFor: RemoteAddr}
+
+// RequireIdentity calls next only for requests with a valid identity token (using DefaultAuthenticator)
+func RequireIdentity(next http.Handler) http.Handler {
+	return DefaultAuthenticator.RequireIdentity(next)
+}
+
+// RequireAuthorization calls next only for requests with a valid identity token and authorization for action on ressource (using DefaultAuthenticator)
+func RequireAuthorization(ressource, action string, next http.Handler) http.Handler {
+	return DefaultAuthenticator.RequireAuthorization(ressource, action, next)
+}
+
+// RequireIdentity calls next only for requests with a valid identity token, that is not restricted to the password change
+// the nick, the identity token and validFor are placed in the request context
+func (a *Authenticator) RequireIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, ok := a.authenticate(w, r)
+		if !ok {
+			return
+		}
+		identityToken, _ := IdentityTokenFromContext(r.Context())
+		if embiam.IsIdentityTokenRestricted(identityToken) {
+			Forbidden(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAuthorization calls next only for requests with a valid identity token and authorization for action on ressource
+// the nick, the identity token and validFor are placed in the request context
+func (a *Authenticator) RequireAuthorization(ressource, action string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, ok := a.authenticate(w, r)
+		if !ok {
+			return
+		}
+		identityToken, _ := IdentityTokenFromContext(r.Context())
+		if !embiam.IsAuthorized(identityToken, ressource, action) {
+			Forbidden(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate checks the identity token of the request and adds nick and identity token to the context
+// if the identity token is invalid, the response is sent and false is returned
+func (a *Authenticator) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	// extract client
+	validFor, err := a.validFor(r)
+	if err != nil {
+		Unauthorized(w)
+		return r, false
+	}
+	// get identity token from header
+	identityToken, ok := embiam.IdentityTokenFromAuthValue(r.Header.Get("Authorization"))
+	if !ok {
+		Unauthorized(w)
+		return r, false
+	}
+	// check identity token
+	nick, ok := embiam.GetNickForIdentityToken(identityToken, validFor)
+	if !ok {
+		Unauthorized(w)
+		return r, false
+	}
+	ctx := context.WithValue(r.Context(), nickContextKey, nick)
+	ctx = context.WithValue(ctx, identityTokenContextKey, identityToken)
+	ctx = context.WithValue(ctx, validForContextKey, validFor)
+	return r.WithContext(ctx), true
+}
+
+// validFor determines the client of the request, RemoteAddr is used if no extractor is set
+func (a *Authenticator) validFor(r *http.Request) (string, error) {
+	if a.ValidFor == nil {
+		return RemoteAddr(r)
+	}
+	return a.ValidFor(r)
+}
+
+// NickFromContext returns the authenticated nick, placed in the context by the middleware
+func NickFromContext(ctx context.Context) (string, bool) {
+	nick, ok := ctx.Value(nickContextKey).(string)
+	return nick, ok
+}
+
+// IdentityTokenFromContext returns the identity token of the request, placed in the context by the middleware
+func IdentityTokenFromContext(ctx context.Context) (string, bool) {
+	identityToken, ok := ctx.Value(identityTokenContextKey).(string)
+	return identityToken, ok
+}
+
+// ValidForFromContext returns the client of the request (validFor), placed in the context by the middleware
+func ValidForFromContext(ctx context.Context) (string, bool) {
+	validFor, ok := ctx.Value(validForContextKey).(string)
+	return validFor, ok
+}
+
+// ActorFromContext returns nick and client of the request, e.g. for the audit events of embiam
+func ActorFromContext(ctx context.Context) embiam.Actor {
+	nick, _ := NickFromContext(ctx)
+	validFor, _ := ValidForFromContext(ctx)
+	return embiam.Actor{Nick: nick, ValidFor: validFor}
+}
+
+// Unauthorized sends the response for a missing or invalid identity token
+func Unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "embiam")
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// Forbidden sends the response for a missing authorization
+func Forbidden(w http.ResponseWriter) {
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+/********************************************************************
+	VALIDFOR EXTRACTORS
+********************************************************************/
+
+// RemoteAddr uses the host of r.RemoteAddr as validFor
+func RemoteAddr(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	return host, nil
+}
+
+// ForwardedFor returns an extractor that uses the header field X-Forwarded-For for requests from trusted proxies
+// trustedProxies contains IP addresses or networks in CIDR notation, e.g. 10.0.0.1 or 10.0.0.0/8
+// the client is the last address in X-Forwarded-For that isn't a trusted proxy
+func ForwardedFor(trustedProxies ...string) (ValidForExtractor, error) {
+	trustedNetworks := make([]*net.IPNet, 0, len(trustedProxies))
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, errors.New("invalid trusted proxy " + proxy)
+			}
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			trustedNetworks = append(trustedNetworks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.New("invalid trusted proxy " + proxy)
+		}
+		trustedNetworks = append(trustedNetworks, network)
+	}
+	isTrusted := func(address string) bool {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return false
+		}
+		for _, network := range trustedNetworks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) (string, error) {
+		remoteHost, err := RemoteAddr(r)
+		if err != nil {
+			return "", err
+		}
+		// only trusted proxies can set X-Forwarded-For
+		if !isTrusted(remoteHost) {
+			return remoteHost, nil
+		}
+		// collect addresses from all X-Forwarded-For fields
+		addresses := []string{}
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, address := range strings.Split(value, ",") {
+				address = strings.TrimSpace(address)
+				if address != "" {
+					addresses = append(addresses, address)
+				}
+			}
+		}
+		if len(addresses) == 0 {
+			return remoteHost, nil
+		}
+		// the client is the last address, that isn't a trusted proxy
+		for i := len(addresses) - 1; i >= 0; i-- {
+			if !isTrusted(addresses[i]) {
+				if net.ParseIP(addresses[i]) == nil {
+					return "", errors.New("invalid address in X-Forwarded-For " + addresses[i])
+				}
+				return addresses[i], nil
+			}
+		}
+		return addresses[0], nil
+	}, nil
+}
@@ -0,0 +1,145 @@
+package httpauth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/janso/embiam"
+)
+
+const (
+	testNick     = `N1CK0001`
+	testPassword = `SeCrEtSeCrEt`
+	testHost     = `192.0.2.1`
+)
+
+// nickHandler writes the nick from the request context
+var nickHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	nick, _ := NickFromContext(r.Context())
+	w.Write([]byte(nick))
+})
+
+// testHash returns the hash of password for test fixtures
+func testHash(t *testing.T, password string) string {
+	hash, err := embiam.HashPassword(password)
+	if err != nil {
+		t.Fatalf("embiam.HashPassword(password) returned error %s; want hash\n", err)
+	}
+	return hash
+}
+
+func TestMiddleware(t *testing.T) {
+	// initialize embiam with entity
+	embiam.Initialize(new(embiam.DbTransient))
+	e := embiam.Entity{
+		Nick:         testNick,
+		PasswordHash: testHash(t, testPassword),
+		Active:       true,
+		Roles:        []embiam.RoleIdType{`application`},
+	}
+	err := embiam.Db.SaveEntity(&e)
+	if err != nil {
+		t.Errorf("embiam.Db.SaveEntity(&e) returned error %s; want save entity without error\n", err)
+	}
+	identityToken, err := embiam.CheckIdentity(testNick, testPassword, testHost)
+	if err != nil {
+		t.Errorf("embiam.CheckIdentity(testNick, testPassword, testHost) returned error %s; want identity token\n", err)
+	}
+	authValue := "embiam " + base64.StdEncoding.EncodeToString([]byte(identityToken.Token))
+
+	// entity, that must change the password
+	e = embiam.Entity{
+		Nick:               `N1CK0002`,
+		PasswordHash:       testHash(t, testPassword),
+		Active:             true,
+		Roles:              []embiam.RoleIdType{`application`},
+		MustChangePassword: true,
+	}
+	embiam.Db.SaveEntity(&e)
+	restrictedToken, err := embiam.CheckIdentity(e.Nick, testPassword, testHost)
+	if err != nil || !restrictedToken.MustChangePassword {
+		t.Errorf("embiam.CheckIdentity(N1CK0002, testPassword, testHost) returned %v, %v; want restricted identity token\n", restrictedToken, err)
+	}
+	restrictedAuthValue := "embiam " + base64.StdEncoding.EncodeToString([]byte(restrictedToken.Token))
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		remoteAddr string
+		authValue  string
+		wantStatus int
+		wantBody   string
+	}{
+		{"identity", RequireIdentity(nickHandler), testHost + ":1234", authValue, http.StatusOK, testNick},
+		{"no token", RequireIdentity(nickHandler), testHost + ":1234", "", http.StatusUnauthorized, ""},
+		{"invalid token", RequireIdentity(nickHandler), testHost + ":1234", "embiam " + base64.StdEncoding.EncodeToString([]byte("invalid")), http.StatusUnauthorized, ""},
+		{"other client", RequireIdentity(nickHandler), "192.0.2.2:1234", authValue, http.StatusUnauthorized, ""},
+		{"authorized", RequireAuthorization(`application`, `use`, nickHandler), testHost + ":1234", authValue, http.StatusOK, testNick},
+		{"not authorized", RequireAuthorization(`embiam.entity`, `read`, nickHandler), testHost + ":1234", authValue, http.StatusForbidden, ""},
+		{"not authorized without token", RequireAuthorization(`application`, `use`, nickHandler), testHost + ":1234", "", http.StatusUnauthorized, ""},
+		{"restricted identity", RequireIdentity(nickHandler), testHost + ":1234", restrictedAuthValue, http.StatusForbidden, ""},
+		{"restricted not authorized", RequireAuthorization(`application`, `use`, nickHandler), testHost + ":1234", restrictedAuthValue, http.StatusForbidden, ""},
+		{"restricted password change", RequireAuthorization(embiam.RessourcePassword, embiam.ActionChangePassword, nickHandler), testHost + ":1234", restrictedAuthValue, http.StatusOK, `N1CK0002`},
+		{"password change", RequireAuthorization(embiam.RessourcePassword, embiam.ActionChangePassword, nickHandler), testHost + ":1234", authValue, http.StatusOK, testNick},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/test", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.authValue != "" {
+			r.Header.Set("Authorization", test.authValue)
+		}
+		w := httptest.NewRecorder()
+		test.handler.ServeHTTP(w, r)
+		if w.Code != test.wantStatus {
+			t.Errorf("%s: handler returned status %d; want %d\n", test.name, w.Code, test.wantStatus)
+		}
+		if test.wantStatus == http.StatusOK && w.Body.String() != test.wantBody {
+			t.Errorf("%s: handler returned body %s; want %s\n", test.name, w.Body.String(), test.wantBody)
+		}
+		if test.wantStatus == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "embiam" {
+			t.Errorf("%s: handler returned no WWW-Authenticate header; want embiam\n", test.name)
+		}
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	_, err := ForwardedFor("no-address")
+	if err == nil {
+		t.Errorf("ForwardedFor(no-address) returned NO error; want error\n")
+	}
+	extractor, err := ForwardedFor("10.0.0.1", "172.16.0.0/12")
+	if err != nil {
+		t.Errorf("ForwardedFor(...) returned error %s; want extractor\n", err)
+	}
+
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor string
+		wantValidFor string
+		wantErr      bool
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1", false},                            // direct request
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1", false},                // untrusted proxy can't set client
+		{"10.0.0.1:1234", "", "10.0.0.1", false},                              // trusted proxy without header
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1", false},              // trusted proxy
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.1", "198.51.100.1", false}, // client can't spoof address
+		{"10.0.0.1:1234", "198.51.100.1, 172.16.1.1", "198.51.100.1", false},  // chain of trusted proxies
+		{"10.0.0.1:1234", "garbage", "", true},                                // invalid address
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/test", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		validFor, err := extractor(r)
+		if (err != nil) != test.wantErr {
+			t.Errorf("extractor for %s, %s returned error %v; want error %t\n", test.remoteAddr, test.forwardedFor, err, test.wantErr)
+		}
+		if validFor != test.wantValidFor {
+			t.Errorf("extractor for %s, %s returned %s; want %s\n", test.remoteAddr, test.forwardedFor, validFor, test.wantValidFor)
+		}
+	}
+}